@@ -1,16 +1,30 @@
 // Package auth provides authorization methods.
 //
-// Authorization token format (bytes):
+// Authorization token format (bytes), the signature is HMAC-SHA256 of all previous fields
+// and the challenge for TokenChallenge version:
+// +---------+--------+--------+------+------+-----------+-----------+
+// | version | action | client |  IP  | salt | timestamp | signature |
+// +---------+--------+--------+------+------+-----------+-----------+
+// |    1    |    1   |    2   |  16  |  32  |     8     |    32     |
+// +---------+--------+--------+------+------+-----------+-----------+
+//
+// Legacy token format (bytes), the signature is sha512 of all previous fields and the secret:
 // +--------+--------+------+------+-----------+-----------+
 // | action | client |  IP  | salt | timestamp | signature |
 // +--------+--------+------+------+-----------+-----------+
 // |    1   |    2   |  16  |  32  |     8     |    64     |
 // +--------+--------+------+------+-----------+-----------+
+//
+// The action is 0 for download and 1 for upload, so the first byte distinguishes the formats.
+//
+// The challenge is server's random value from hello for client's token and client's salt for server's reply.
+// Challenge tokens prove their freshness without synchronized clocks, so their timestamps are not checked.
 
 package auth
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -45,11 +59,73 @@ var (
 
 	// ErrTokenFormat is an error for invalid token format.
 	ErrTokenFormat = errors.New("invalid token format")
+
+	// ErrUnknownClient is an error for token with unknown client ID.
+	ErrUnknownClient = errors.New("unknown client")
+
+	// ErrClockSkew is an error for token with timestamp out of the allowed time difference.
+	ErrClockSkew = errors.New("clock skew")
+
+	// ErrLegacyToken is an error for token in legacy format when it's not allowed.
+	ErrLegacyToken = errors.New("legacy token format")
 )
 
-// NewToken returns new token from string "clientID:secret".
+// Negotiate returns the newest token format version supported by both the client and the server,
+// where version is the newest one of the server and challenge is its hello random value.
+// Old servers don't report them and support only the legacy format.
+func Negotiate(version uint8, challenge []byte) uint8 {
+	switch {
+	case version == 0:
+		return TokenLegacy
+	case len(challenge) == 0:
+		return min(version, TokenHMAC)
+	}
+
+	return min(version, TokenVersion)
+}
+
+// NewChallenge returns a new random challenge of server's hello.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, lenSalt)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("challenge: %w", err)
+	}
+
+	return challenge, nil
+}
+
+// HeaderVersion returns token format version of the auth header, it's zero for headers without token.
+func HeaderVersion(header []byte) uint8 {
+	switch {
+	case len(header) <= lenAction:
+		return 0
+	case header[0] < TokenHMAC:
+		// legacy format starts with the action
+		return TokenLegacy
+	}
+
+	return header[0]
+}
+
+// NewToken returns new token from string "clientID:secret",
+// it can be followed by space-separated "key=value" attributes of client's policy.
 func NewToken(pair string) (*Token, error) {
-	clientPair := strings.Split(pair, ":")
+	fields := strings.Fields(pair)
+	if len(fields) == 0 {
+		return nil, errors.Join(ErrTokenFormat, errors.New("empty pair"))
+	}
+
+	attributes, err := parseAttributes(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := ParsePolicy(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPair := strings.Split(fields[0], ":")
 	if n := len(clientPair); n != 2 {
 		return nil, errors.Join(ErrTokenFormat, fmt.Errorf("invalid pair length: %d", n))
 	}
@@ -64,7 +140,7 @@ func NewToken(pair string) (*Token, error) {
 		return nil, errors.Join(ErrTokenFormat, fmt.Errorf("decode hex value: %w", err))
 	}
 
-	return &Token{ClientID: uint16(clientID), Secret: token}, nil
+	return &Token{ClientID: uint16(clientID), Secret: token, Attributes: attributes, Policy: policy}, nil
 }
 
 // ServerTokens loads server's tokens from environment variable.
@@ -101,68 +177,112 @@ func ClientToken() (*Token, error) {
 }
 
 // Verify is called by servers, it checks authorization header and returns new token if `r` data is valid.
+//
+// Deprecated: use Tokens.Authenticate or another Authenticator, Verify reads the header and calls it.
 func Verify(r io.Reader, tokens map[uint16]*Token) (*Token, error) {
 	if r == nil {
 		return nil, errors.Join(ErrUnauthorized, errors.New("nil reader"))
 	}
 
-	header := make([]byte, lenToken)
+	header := make([]byte, max(lenToken, lenTokenHMAC))
 	n, err := r.Read(header)
 
 	if err != nil {
 		return nil, errors.Join(ErrUnauthorized, fmt.Errorf("failed to read header data: %w", err))
 	}
 
-	if n != lenToken {
+	if n != lenToken && n != lenTokenHMAC {
 		return nil, errors.Join(ErrUnauthorized, errors.New("invalid token length"))
 	}
 
-	return verifyHeader(header, tokens)
+	identity, err := Tokens(tokens).Authenticate(&Handshake{Header: header[:n]})
+	if err != nil {
+		return nil, err
+	}
+
+	return identity.Token, nil
 }
 
-func verifyHeader(header []byte, serverTokens map[uint16]*Token) (*Token, error) {
-	var clientID uint16
+// splitHeader returns token's format version, data and signature of the header.
+func splitHeader(header []byte) (uint8, []byte, []byte, error) {
+	version, n := HeaderVersion(header), len(header)
+
+	switch {
+	case version == TokenLegacy && n == lenToken:
+		return version, header[:endTime], header[endTime:], nil
+	case (version == TokenHMAC || version == TokenChallenge) && n == lenTokenHMAC:
+		return version, header[lenVersion : lenVersion+endTime], header[lenVersion+endTime:], nil
+	case version > TokenVersion:
+		return 0, nil, nil, errors.Join(ErrUnauthorized, ErrTokenFormat, fmt.Errorf("unsupported version: %d", version))
+	}
+
+	return 0, nil, nil, errors.Join(ErrUnauthorized, ErrTokenFormat, fmt.Errorf("invalid header length: %d", n))
+}
 
-	if n := len(header); n != lenToken {
-		return nil, fmt.Errorf("invalid header length: %d", n)
+// verifyHeader checks the header signed with the challenge and returns a new token for the reply.
+func verifyHeader(header []byte, serverTokens map[uint16]*Token, challenge []byte) (*Token, error) {
+	var (
+		clientID  uint16
+		timestamp int64
+	)
+
+	version, data, signature, err := splitHeader(header)
+	if err != nil {
+		return nil, err
 	}
 
-	clientIDBytes := header[lenAction:endClient]
-	err := binary.Read(bytes.NewReader(clientIDBytes), binary.BigEndian, &clientID)
+	if version == TokenChallenge && len(challenge) == 0 {
+		return nil, errors.Join(ErrUnauthorized, ErrTokenFormat, errors.New("no challenge"))
+	}
+
+	clientIDBytes := data[lenAction:endClient]
+	err = binary.Read(bytes.NewReader(clientIDBytes), binary.BigEndian, &clientID)
 	if err != nil {
 		return nil, errors.Join(ErrUnauthorized, fmt.Errorf("clientID parse: %w", err))
 	}
 
 	serverToken, ok := serverTokens[clientID]
 	if !ok {
-		return nil, errors.Join(ErrUnauthorized, fmt.Errorf("unknown clientID: %d", clientID))
+		return nil, errors.Join(ErrUnauthorized, ErrUnknownClient, fmt.Errorf("unknown clientID: %d", clientID))
 	}
 
-	timestamp, err := verifyTimestamp(header[endSalt:endTime])
-	if err != nil {
+	if version == TokenChallenge {
+		// the signed challenge proves freshness, so clocks can be not synchronized
+		timestamp = int64(binary.BigEndian.Uint64(data[endSalt:endTime]))
+	} else if timestamp, err = verifyTimestamp(data[endSalt:endTime]); err != nil {
 		return nil, err
 	}
 
 	token := &Token{
-		ClientID:  clientID,
-		Secret:    serverToken.Secret,
-		Download:  header[0] == 0,
-		IP:        net.IP(header[endClient:endIP]),
-		timestamp: timestamp,
+		ClientID:   clientID,
+		Secret:     serverToken.Secret,
+		Download:   data[0] == 0,
+		IP:         net.IP(data[endClient:endIP]),
+		Version:    version,
+		Challenge:  challenge,
+		Attributes: serverToken.Attributes,
+		Policy:     serverToken.Policy,
+		timestamp:  timestamp,
 	}
 
-	copy(token.salt[:], header[endIP:endSalt])
-	signature := header[endTime:]
+	copy(token.salt[:], data[endIP:endSalt])
 
 	if !token.Verify(signature) {
-		return nil, ErrTokenSignature
+		return nil, errors.Join(ErrUnauthorized, ErrTokenSignature)
 	}
 
-	// token is correct, reinitialize it to reset timestamp and salt for response
+	// token is correct, reinitialize it to reset timestamp and salt for response,
+	// client's salt is kept for replays detection
+	token.nonce = token.salt
 	if err = token.init(); err != nil {
 		return nil, fmt.Errorf("failed to initialize token: %w", err)
 	}
 
+	if version == TokenChallenge {
+		// the reply proves the secret by client's challenge
+		token.Challenge = bytes.Clone(token.nonce[:])
+	}
+
 	return token, nil
 }
 
@@ -178,6 +298,7 @@ func verifyTimestamp(value []byte) (int64, error) {
 	if timeDiff > timestampLimit || timeDiff < -timestampLimit {
 		return 0, errors.Join(
 			ErrUnauthorized,
+			ErrClockSkew,
 			fmt.Errorf("not synchronized time, diff=%d, but abs limit=%d", timeDiff, timestampLimit),
 		)
 	}
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
@@ -152,6 +154,21 @@ func TestNewToken(t *testing.T) {
 			pair:    "100000:3312a18b", // clientID - unsigned 16-bit integers (0 to 65535)
 			withErr: true,
 		},
+		{
+			name: "attributes",
+			pair: "1:3312a18b scope=download plan=isp",
+			want: &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+		},
+		{
+			name:    "invalid_attribute",
+			pair:    "1:3312a18b scope",
+			withErr: true,
+		},
+		{
+			name:    "invalid_policy",
+			pair:    "1:3312a18b max_sessions=0",
+			withErr: true,
+		},
 	}
 
 	for i := range testCases {
@@ -204,6 +221,7 @@ func TestVerify(t *testing.T) {
 		tokens    map[uint16]*Token
 		reader    io.Reader
 		errSubstr string
+		errIs     error
 	}{
 		{
 			name:      "empty_tokens",
@@ -232,6 +250,7 @@ func TestVerify(t *testing.T) {
 			},
 			reader:    testTokenReader(nil, map[int]byte{1: 0x02}),
 			errSubstr: "unknown clientID",
+			errIs:     ErrUnknownClient,
 		},
 		{
 			name: "invalid_timestamp",
@@ -249,6 +268,7 @@ func TestVerify(t *testing.T) {
 				endSalt + 7: 0x01,
 			}),
 			errSubstr: "not synchronized time",
+			errIs:     ErrClockSkew,
 		},
 		{
 			name: "invalid_signature",
@@ -257,6 +277,7 @@ func TestVerify(t *testing.T) {
 			},
 			reader:    testTokenReader(nil, nil),
 			errSubstr: "invalid token signature",
+			errIs:     ErrTokenSignature,
 		},
 		{
 			name: "valid",
@@ -281,6 +302,10 @@ func TestVerify(t *testing.T) {
 				if errStr := err.Error(); !strings.Contains(errStr, tc.errSubstr) {
 					t.Errorf("Verify() error = %v, want %v", errStr, tc.errSubstr)
 				}
+
+				if tc.errIs != nil && !errors.Is(err, tc.errIs) {
+					t.Errorf("Verify() error = %v, want %v", err, tc.errIs)
+				}
 				return
 			}
 
@@ -331,6 +356,15 @@ func TestToken_Verify(t *testing.T) {
 			token:          &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
 			touchTimestamp: true,
 		},
+		{
+			name:  "valid_legacy",
+			token: &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}, Version: TokenLegacy},
+		},
+		{
+			name:        "invalid_secret_legacy",
+			token:       &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}, Version: TokenLegacy},
+			touchSecret: true,
+		},
 		{
 			name:           "invalid",
 			token:          &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
@@ -363,7 +397,7 @@ func TestToken_Verify(t *testing.T) {
 				tc.token.timestamp -= 1
 			}
 
-			offset := len(data) - sha512.Size
+			offset := len(data) - len(tc.token.signature)
 			signature := data[offset:]
 
 			ok := tc.token.Verify(signature)
@@ -377,7 +411,6 @@ func TestToken_Verify(t *testing.T) {
 }
 
 func TestToken_Build(t *testing.T) {
-	// useless, just for coverage
 	token := &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
 
 	data, err := token.Build()
@@ -385,14 +418,182 @@ func TestToken_Build(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if n := len(data); n != lenTokenHMAC || data[0] != TokenHMAC {
+		t.Fatalf("Build() length = %d, version = %d", n, data[0])
+	}
+
+	mac := hmac.New(sha256.New, token.Secret)
+	mac.Write(data[:lenVersion+endTime])
+
+	if signature := mac.Sum(nil); !bytes.Equal(signature, token.signature) {
+		t.Errorf("Build() = %v, want %v", signature, token.signature)
+	}
+
+	token.Version = TokenLegacy
+	if data, err = token.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(data); n != lenToken {
+		t.Fatalf("Build() legacy length = %d", n)
+	}
+
 	prefixPart := data[:endTime]
 
 	h := sha512.New()
 	h.Write(prefixPart)
 	h.Write(token.Secret)
 
-	if signature := h.Sum(nil); !bytes.Equal(signature, token.signature[:]) {
-		t.Errorf("Build() = %v, want %v", signature, token.signature[:])
+	if signature := h.Sum(nil); !bytes.Equal(signature, token.signature) {
+		t.Errorf("Build() = %v, want %v", signature, token.signature)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	challenge := []byte{1, 2, 3}
+
+	testCases := []struct {
+		name      string
+		version   uint8
+		challenge []byte
+		expected  uint8
+	}{
+		{name: "old_server", expected: TokenLegacy},
+		{name: "legacy", version: TokenLegacy, expected: TokenLegacy},
+		{name: "hmac", version: TokenHMAC, expected: TokenHMAC},
+		{name: "challenge", version: TokenChallenge, challenge: challenge, expected: TokenChallenge},
+		{name: "no_challenge", version: TokenChallenge, expected: TokenHMAC},
+		{name: "newer_server", version: TokenVersion + 1, challenge: challenge, expected: TokenVersion},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			if v := Negotiate(tc.version, tc.challenge); v != tc.expected {
+				t.Errorf("Negotiate() = %d, want %d", v, tc.expected)
+			}
+		})
+	}
+}
+
+func TestVerifyHeader_Versions(t *testing.T) {
+	var (
+		secret    = []byte{0x33, 0x12, 0xa1, 0x8b}
+		tokens    = map[uint16]*Token{1: {ClientID: 1, Secret: secret}}
+		challenge = []byte{0x01, 0x02, 0x03, 0x04}
+		skewed    = time.Now().Add(-time.Hour).Unix()
+	)
+
+	testCases := []struct {
+		name            string
+		version         uint8
+		timestamp       int64
+		challenge       []byte
+		serverChallenge []byte
+		header          func([]byte) []byte
+		err             error
+	}{
+		{name: "hmac", version: TokenHMAC},
+		{name: "legacy", version: TokenLegacy},
+		{name: "challenge", version: TokenChallenge, challenge: challenge, serverChallenge: challenge},
+		{
+			name:            "challenge_clock_skew",
+			version:         TokenChallenge,
+			timestamp:       skewed,
+			challenge:       challenge,
+			serverChallenge: challenge,
+		},
+		{name: "hmac_clock_skew", version: TokenHMAC, timestamp: skewed, err: ErrClockSkew},
+		{
+			name:            "challenge_mismatch",
+			version:         TokenChallenge,
+			challenge:       challenge,
+			serverChallenge: []byte{0x04, 0x03, 0x02, 0x01},
+			err:             ErrTokenSignature,
+		},
+		{name: "no_challenge", version: TokenChallenge, challenge: challenge, err: ErrTokenFormat},
+		{
+			name:    "unsupported_version",
+			version: TokenHMAC,
+			header:  func(h []byte) []byte { h[0] = TokenVersion + 1; return h },
+			err:     ErrTokenFormat,
+		},
+		{
+			name:    "invalid_length",
+			version: TokenHMAC,
+			header:  func(h []byte) []byte { return h[:len(h)-1] },
+			err:     ErrTokenFormat,
+		},
+		{
+			name:    "legacy_signature",
+			version: TokenHMAC,
+			header:  func(h []byte) []byte { h[len(h)-1] ^= 0xff; return h },
+			err:     ErrTokenSignature,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Token{
+				ClientID:  1,
+				Secret:    secret,
+				Download:  true,
+				Version:   tc.version,
+				Challenge: tc.challenge,
+				timestamp: tc.timestamp,
+			}
+
+			header, err := client.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.header != nil {
+				header = tc.header(header)
+			}
+
+			token, err := verifyHeader(header, tokens, tc.serverChallenge)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("verifyHeader() error = %v, want %v", err, tc.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("verifyHeader() error = %v", err)
+			}
+
+			if token.Version != tc.version || !token.Download || token.ClientID != 1 {
+				t.Errorf("verifyHeader() = %+v", token)
+			}
+
+			// server replies by the same format
+			reply := token.Sign()
+			if err = client.VerifyReply(reply); err != nil {
+				t.Errorf("VerifyReply() error = %v", err)
+			}
+
+			if tc.version == TokenChallenge {
+				// the reply must be signed with client's salt
+				token.Challenge = tc.challenge
+				if err = client.VerifyReply(token.Sign()); !errors.Is(err, ErrTokenSignature) {
+					t.Errorf("VerifyReply() error = %v, want %v", err, ErrTokenSignature)
+				}
+			}
+
+			client.Version = TokenLegacy
+			if tc.version == TokenLegacy {
+				client.Version = TokenHMAC
+			}
+
+			if err = client.VerifyReply(reply); !errors.Is(err, ErrTokenFormat) {
+				t.Errorf("VerifyReply() error = %v, want %v", err, ErrTokenFormat)
+			}
+		})
 	}
 }
 
@@ -454,27 +655,33 @@ func TestToken_Handshake(t *testing.T) {
 		{
 			name:      "failed_write_length",
 			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
-			rw:        &testReadWriter{lengthW: lenToken + 1},
+			rw:        &testReadWriter{lengthW: lenTokenHMAC + 1},
 			errSubstr: "invalid write token length",
 		},
 		{
 			name:      "failed_read",
 			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
-			rw:        &failedReader{lenToken},
+			rw:        &failedReader{lenTokenHMAC},
 			errSubstr: "failed to read header data:",
 		},
 		{
 			name:      "failed_read_length",
 			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
-			rw:        &testReadWriter{lengthW: lenToken, lengthR: lenToken + 1},
+			rw:        &testReadWriter{lengthW: lenTokenHMAC, lengthR: lenTokenHMAC + 1},
 			errSubstr: "invalid read token length",
 		},
 		{
 			name:      "unknown_client_id",
-			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}, Version: TokenLegacy},
 			rw:        &testReadWriter{lengthW: lenToken, lengthR: lenToken},
 			errSubstr: "unknown clientID",
 		},
+		{
+			name:      "invalid_reply_version",
+			token:     &Token{ClientID: 10, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+			rw:        &testReadWriter{lengthW: lenTokenHMAC, lengthR: lenTokenHMAC},
+			errSubstr: "reply token version",
+		},
 	}
 
 	for i := range testCases {
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// Handshake is client's authentication data of a connection.
+// Challenge is a random value sent by the server in hello, State is nil for plain TCP connections.
+type Handshake struct {
+	Header     []byte
+	Challenge  []byte
+	RemoteAddr net.Addr
+	State      *tls.ConnectionState
+}
+
+// Authenticator verifies client's handshake and returns its identity.
+// Errors should be joined with ErrUnauthorized and a reason sentinel, e.g. ErrUnknownClient.
+type Authenticator interface {
+	Authenticate(h *Handshake) (*Identity, error)
+}
+
+// Identity is an authenticated client.
+// Token is the verified client's token to sign server's reply, it's nil if the client has no shared secret.
+// Name and Attributes are optional values of the authenticator, e.g. certificate name or account data.
+// RetiredAt is set for identities authenticated by removed or changed secrets,
+// they can only join sessions opened before this time.
+// Policy limits client's tests, it's nil for not limited clients.
+type Identity struct {
+	ClientID   uint16
+	Name       string
+	Download   bool
+	Anonymous  bool
+	RetiredAt  time.Time
+	Token      *Token
+	Attributes map[string]string
+	Policy     *Policy
+}
+
+// Action returns identity's action.
+func (i *Identity) Action() string {
+	if i.Download {
+		return "download"
+	}
+
+	return "upload"
+}
+
+// tokenIdentity returns an identity of the verified token.
+func tokenIdentity(token *Token) *Identity {
+	return &Identity{
+		ClientID:   token.ClientID,
+		Download:   token.Download,
+		Token:      token,
+		Attributes: token.Attributes,
+		Policy:     token.Policy,
+	}
+}
+
+// Tokens is an authenticator by shared secrets of clients, e.g. loaded by ServerTokens.
+type Tokens map[uint16]*Token
+
+// Authenticate verifies signed token header.
+func (t Tokens) Authenticate(h *Handshake) (*Identity, error) {
+	token, err := verifyHeader(h.Header, t, h.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenIdentity(token), nil
+}
+
+// Anonymous is an authenticator, which allows clients without tokens as anonymous ones with zero client ID.
+// Other clients and ones with certificates are verified by optional Fallback.
+type Anonymous struct {
+	Fallback Authenticator
+}
+
+// Authenticate returns an anonymous identity if the header contains only the action and Fallback didn't verify it.
+func (a *Anonymous) Authenticate(h *Handshake) (*Identity, error) {
+	if len(h.Header) != lenAction {
+		if a.Fallback == nil {
+			return nil, errors.Join(ErrUnauthorized, ErrUnknownClient, errors.New("only anonymous clients are allowed"))
+		}
+		return a.Fallback.Authenticate(h)
+	}
+
+	if a.Fallback != nil {
+		if identity, err := a.Fallback.Authenticate(h); err == nil {
+			return identity, nil
+		}
+	}
+
+	return &Identity{Anonymous: true, Download: h.Header[0] == 0}, nil
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+)
+
+func TestAnonymous_Authenticate(t *testing.T) {
+	var (
+		token = &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		state = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "probe-1"}}}},
+		}
+		certificates = &Certificates{Names: map[string]uint16{"probe-1": 2}, Fallback: Tokens{1: token}}
+	)
+
+	header, err := token.Build()
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		header    []byte
+		state     *tls.ConnectionState
+		fallback  Authenticator
+		clientID  uint16
+		anonymous bool
+		download  bool
+		err       error
+	}{
+		{name: "anonymous", header: ActionHeader(true), anonymous: true, download: true},
+		{name: "anonymous_upload", header: ActionHeader(false), anonymous: true},
+		{name: "token_only_anonymous", header: header, err: ErrUnknownClient},
+		{name: "token", header: header, fallback: Tokens{1: token}, clientID: 1},
+		{name: "invalid_token", header: header[:10], fallback: Tokens{1: token}, err: ErrTokenFormat},
+		{name: "certificate", header: ActionHeader(true), state: state, fallback: certificates, clientID: 2, download: true},
+		{name: "no_certificate", header: ActionHeader(true), fallback: certificates, anonymous: true, download: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Anonymous{Fallback: tc.fallback}
+
+			identity, e := a.Authenticate(&Handshake{Header: tc.header, State: tc.state})
+			if tc.err != nil {
+				if !errors.Is(e, tc.err) || !errors.Is(e, ErrUnauthorized) {
+					t.Errorf("want %v, got %v", tc.err, e)
+				}
+				return
+			}
+
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+
+			if identity.ClientID != tc.clientID || identity.Anonymous != tc.anonymous || identity.Download != tc.download {
+				t.Errorf("unexpected identity: %+v", identity)
+			}
+
+			if (identity.Token != nil) != (tc.header[0] == TokenHMAC) {
+				t.Errorf("unexpected identity token: %+v", identity.Token)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxCallbackResponse is a max size of callback's response body.
+const maxCallbackResponse = 1 << 16
+
+// ErrCallback is an error for failed request to the auth service.
+var ErrCallback = errors.New("auth callback")
+
+// CallbackRequest is a JSON request of Callback authenticator.
+// Names are verified TLS certificate's names of the client if it has one.
+type CallbackRequest struct {
+	ClientID uint16   `json:"client_id"`
+	Address  string   `json:"address,omitempty"`
+	Download bool     `json:"download"`
+	Names    []string `json:"names,omitempty"`
+}
+
+// CallbackResponse is a JSON response of the auth service with client's hex-encoded secret.
+// Attributes can contain client's policy, e.g. {"scope": "download", "daily_quota": "10GB"}.
+type CallbackResponse struct {
+	Secret     string            `json:"secret"`
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Callback is an authenticator by an HTTP service, which stores clients' secrets, e.g. a local one.
+// The server posts CallbackRequest for every token and verifies it by the secret of CallbackResponse.
+// Statuses 403 and 404 mean an unknown client, other ones except 200 are service's errors.
+type Callback struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewCallback creates a new callback authenticator with the request timeout.
+func NewCallback(url string, timeout time.Duration) *Callback {
+	return &Callback{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// Authenticate requests client's secret by token's client ID and verifies the token.
+func (c *Callback) Authenticate(h *Handshake) (*Identity, error) {
+	_, data, _, err := splitHeader(h.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &CallbackRequest{
+		ClientID: binary.BigEndian.Uint16(data[lenAction:endClient]),
+		Download: data[0] == 0,
+	}
+
+	if h.RemoteAddr != nil {
+		request.Address = h.RemoteAddr.String()
+	}
+
+	if h.State != nil && len(h.State.VerifiedChains) > 0 {
+		request.Names = certificateNames(h.State.VerifiedChains[0][0])
+	}
+
+	response, err := c.request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := hex.DecodeString(response.Secret)
+	if err != nil || len(secret) == 0 {
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, fmt.Errorf("invalid secret of client %d: %v", request.ClientID, err))
+	}
+
+	policy, err := ParsePolicy(response.Attributes)
+	if err != nil {
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, fmt.Errorf("client %d: %w", request.ClientID, err))
+	}
+
+	tokens := map[uint16]*Token{
+		request.ClientID: {ClientID: request.ClientID, Secret: secret, Attributes: response.Attributes, Policy: policy},
+	}
+	token, err := verifyHeader(h.Header, tokens, h.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := tokenIdentity(token)
+	identity.Name = response.Name
+
+	return identity, nil
+}
+
+// request posts the request to the auth service and decodes its response.
+func (c *Callback) request(request *CallbackRequest) (*CallbackResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, err)
+	}
+
+	resp, err := c.Client.Post(c.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound:
+		return nil, errors.Join(ErrUnauthorized, ErrUnknownClient, fmt.Errorf("unknown clientID: %d", request.ClientID))
+	default:
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, fmt.Errorf("unexpected status: %s", resp.Status))
+	}
+
+	response := &CallbackResponse{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxCallbackResponse)).Decode(response); err != nil {
+		return nil, errors.Join(ErrUnauthorized, ErrCallback, fmt.Errorf("decode response: %w", err))
+	}
+
+	return response, nil
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallback_Authenticate(t *testing.T) {
+	requests := make(chan *CallbackRequest, 1)
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &CallbackRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- request
+
+		switch request.ClientID {
+		case 1:
+			_ = json.NewEncoder(w).Encode(&CallbackResponse{
+				Secret: "3312a18b", Name: "probe-1", Attributes: map[string]string{"plan": "free", AttrScope: ScopeDownload},
+			})
+		case 2:
+			_ = json.NewEncoder(w).Encode(&CallbackResponse{Secret: "666bf6a2"})
+		case 3:
+			_ = json.NewEncoder(w).Encode(&CallbackResponse{Secret: "xyz"})
+		case 4:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 6:
+			_ = json.NewEncoder(w).Encode(&CallbackResponse{Secret: "3312a18b", Attributes: map[string]string{AttrScope: "none"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer service.Close()
+
+	var (
+		secret  = []byte{0x33, 0x12, 0xa1, 0x8b}
+		address = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 28082}
+	)
+
+	testCases := []struct {
+		name     string
+		clientID uint16
+		header   []byte
+		err      error
+	}{
+		{name: "valid", clientID: 1},
+		{name: "invalid_signature", clientID: 2, err: ErrTokenSignature},
+		{name: "invalid_secret", clientID: 3, err: ErrCallback},
+		{name: "service_error", clientID: 4, err: ErrCallback},
+		{name: "unknown", clientID: 5, err: ErrUnknownClient},
+		{name: "invalid_policy", clientID: 6, err: ErrPolicy},
+		{name: "action_header", header: ActionHeader(true), err: ErrTokenFormat},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			header := tc.header
+			if header == nil {
+				var err error
+				token := &Token{ClientID: tc.clientID, Secret: secret, Download: true}
+
+				if header, err = token.Build(); err != nil {
+					t.Fatalf("failed to build token: %v", err)
+				}
+			}
+
+			c := NewCallback(service.URL, time.Second)
+			identity, err := c.Authenticate(&Handshake{Header: header, RemoteAddr: address})
+
+			if tc.header == nil {
+				request := <-requests
+				if request.ClientID != tc.clientID || request.Address != address.String() || !request.Download {
+					t.Errorf("unexpected request: %+v", request)
+				}
+			}
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) || !errors.Is(err, ErrUnauthorized) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if identity.ClientID != 1 || identity.Name != "probe-1" || identity.Attributes["plan"] != "free" {
+				t.Errorf("unexpected identity: %+v", identity)
+			}
+
+			if identity.Policy == nil || !identity.Policy.NoUpload {
+				t.Errorf("unexpected policy: %+v", identity.Policy)
+			}
+
+			if identity.Token == nil || len(identity.Token.Secret) == 0 {
+				t.Error("identity has no token to sign the reply")
+			}
+		})
+	}
+
+	// not available service
+	c := NewCallback("http://127.0.0.1:1", time.Second)
+	header, err := (&Token{ClientID: 1, Secret: secret}).Build()
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	if _, err = c.Authenticate(&Handshake{Header: header}); !errors.Is(err, ErrCallback) {
+		t.Errorf("want %v, got %v", ErrCallback, err)
+	}
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CertEnv is an environment variable name for server's client certificates mapping.
+// It is comma-separated list of "clientID:name" pairs, where "name" is a subject common name
+// or a subject alternative name (DNS, email, URI or IP) of client's certificate.
+const CertEnv = "SPTS_CLIENT_CERTS"
+
+// ErrNoCertificate is an error for connection without verified client's certificate.
+var ErrNoCertificate = errors.New("no client certificate")
+
+// Certificates is an authenticator by verified TLS client's certificates.
+// Names maps certificate names to client IDs, optional Fallback verifies clients without certificates or with tokens.
+type Certificates struct {
+	Names    map[string]uint16
+	Fallback Authenticator
+}
+
+// Authenticate finds client ID by certificate names if the header contains only the action,
+// other headers are verified by Fallback.
+// The returned identity has no token, so the reply is not signed.
+func (c *Certificates) Authenticate(h *Handshake) (*Identity, error) {
+	certified := h.State != nil && len(h.State.VerifiedChains) > 0
+
+	if !certified || len(h.Header) != lenAction {
+		switch {
+		case c.Fallback != nil:
+			return c.Fallback.Authenticate(h)
+		case !certified:
+			return nil, errors.Join(ErrUnauthorized, ErrNoCertificate)
+		}
+		return nil, errors.Join(ErrUnauthorized, ErrTokenFormat, fmt.Errorf("invalid action header length: %d", len(h.Header)))
+	}
+
+	cert := h.State.VerifiedChains[0][0]
+	for _, name := range certificateNames(cert) {
+		if clientID, ok := c.Names[name]; ok {
+			return &Identity{ClientID: clientID, Name: name, Download: h.Header[0] == 0}, nil
+		}
+	}
+
+	return nil, errors.Join(ErrUnauthorized, ErrUnknownClient, fmt.Errorf("unknown certificate: %s", cert.Subject))
+}
+
+// ActionHeader returns auth header of the client authenticated without token.
+func ActionHeader(download bool) []byte {
+	if download {
+		return []byte{0}
+	}
+
+	return []byte{1}
+}
+
+// ServerCertificates loads server's client certificates mapping from environment variable.
+func ServerCertificates() (map[string]uint16, error) {
+	value := strings.Trim(os.Getenv(CertEnv), ", ")
+	if value == "" {
+		return nil, ErrAuthRequired
+	}
+
+	pairs := strings.Split(value, ",")
+	names := make(map[string]uint16, len(pairs))
+
+	for _, pair := range pairs {
+		clientPair := strings.SplitN(pair, ":", 2)
+		if n := len(clientPair); n != 2 || clientPair[1] == "" {
+			return nil, errors.Join(ErrTokenFormat, fmt.Errorf("invalid certificate pair: %q", pair))
+		}
+
+		clientID, err := strconv.ParseUint(clientPair[0], 10, 16)
+		if err != nil {
+			return nil, errors.Join(ErrTokenFormat, fmt.Errorf("clientID: %w", err))
+		}
+
+		names[clientPair[1]] = uint16(clientID)
+	}
+
+	return names, nil
+}
+
+// certificateNames returns subject common name and alternative names of the certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs)+len(cert.IPAddresses))
+
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return names
+}
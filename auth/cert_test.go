@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestServerCertificates(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected map[string]uint16
+		err      error
+	}{
+		{name: "empty", err: ErrAuthRequired},
+		{name: "valid", value: "1:probe-1", expected: map[string]uint16{"probe-1": 1}},
+		{
+			name:     "valid_multiple",
+			value:    "1:probe-1,2:spts://probe/2,",
+			expected: map[string]uint16{"probe-1": 1, "spts://probe/2": 2},
+		},
+		{name: "no_name", value: "1:", err: ErrTokenFormat},
+		{name: "no_pair", value: "probe-1", err: ErrTokenFormat},
+		{name: "invalid_client_id", value: "100000:probe-1", err: ErrTokenFormat},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.Setenv(CertEnv, tc.value); err != nil {
+				t.Fatalf("failed to set environment variable: %v", err)
+			}
+
+			defer func() {
+				if e := os.Unsetenv(CertEnv); e != nil {
+					t.Errorf("failed to unset environment variable: %v", e)
+				}
+			}()
+
+			names, err := ServerCertificates()
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if n, m := len(names), len(tc.expected); n != m {
+				t.Fatalf("want %d names, got %d", m, n)
+			}
+
+			for name, clientID := range tc.expected {
+				if id, ok := names[name]; !ok || id != clientID {
+					t.Errorf("want %d for %q, got %d", clientID, name, id)
+				}
+			}
+		})
+	}
+}
+
+func TestCertificates_Authenticate(t *testing.T) {
+	var (
+		uri, _ = url.Parse("spts://probe/3")
+		token  = &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}, IP: net.IPv4(127, 0, 0, 1)}
+		names  = map[string]uint16{"probe-1": 1, "probe2.example.com": 2, "spts://probe/3": 3}
+	)
+
+	header, err := token.Build()
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	state := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	testCases := []struct {
+		name     string
+		header   []byte
+		state    *tls.ConnectionState
+		fallback Authenticator
+		clientID uint16
+		download bool
+		err      error
+	}{
+		{
+			name:     "common_name",
+			header:   ActionHeader(true),
+			state:    state(&x509.Certificate{Subject: pkix.Name{CommonName: "probe-1"}}),
+			clientID: 1,
+			download: true,
+		},
+		{
+			name:     "dns",
+			header:   ActionHeader(false),
+			state:    state(&x509.Certificate{Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"probe2.example.com"}}),
+			clientID: 2,
+		},
+		{
+			name:     "uri",
+			header:   ActionHeader(false),
+			state:    state(&x509.Certificate{URIs: []*url.URL{uri}}),
+			clientID: 3,
+		},
+		{
+			name:   "unknown",
+			header: ActionHeader(true),
+			state:  state(&x509.Certificate{Subject: pkix.Name{CommonName: "other"}}),
+			err:    ErrUnknownClient,
+		},
+		{
+			name:   "no_certificate",
+			header: ActionHeader(true),
+			state:  &tls.ConnectionState{},
+			err:    ErrNoCertificate,
+		},
+		{
+			name:   "plain",
+			header: ActionHeader(true),
+			err:    ErrNoCertificate,
+		},
+		{
+			name:   "token_header",
+			header: header,
+			state:  state(&x509.Certificate{Subject: pkix.Name{CommonName: "probe-1"}}),
+			err:    ErrTokenFormat,
+		},
+		{
+			name:     "fallback_token",
+			header:   header,
+			state:    state(&x509.Certificate{Subject: pkix.Name{CommonName: "probe-1"}}),
+			fallback: Tokens{1: token},
+			clientID: 1,
+		},
+		{
+			name:     "fallback_no_certificate",
+			header:   ActionHeader(true),
+			fallback: Tokens{1: token},
+			err:      ErrUnauthorized,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Certificates{Names: names, Fallback: tc.fallback}
+
+			result, e := c.Authenticate(&Handshake{Header: tc.header, State: tc.state})
+			if tc.err != nil {
+				if !errors.Is(e, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, e)
+				}
+				return
+			}
+
+			if e != nil {
+				t.Fatalf("unexpected error: %v", e)
+			}
+
+			if result.ClientID != tc.clientID || result.Download != tc.download {
+				t.Errorf("unexpected token: %+v", result)
+			}
+		})
+	}
+}
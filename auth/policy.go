@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+// Policy attributes of tokens and auth service's responses.
+const (
+	AttrScope        = "scope"
+	AttrMaxDuration  = "max_duration"
+	AttrMaxBytes     = "max_bytes"
+	AttrDailyQuota   = "daily_quota"
+	AttrMonthlyQuota = "monthly_quota"
+	AttrMaxSessions  = "max_sessions"
+	AttrExpires      = "expires"
+)
+
+// Scopes of policy's AttrScope.
+const (
+	ScopeAll      = "all"
+	ScopeDownload = "download"
+	ScopeUpload   = "upload"
+)
+
+// expiresDate is a date format of AttrExpires, the token is valid until the end of this day in UTC.
+const expiresDate = "2006-01-02"
+
+var (
+	// ErrPolicy is returned when client's policy attributes are invalid.
+	ErrPolicy = errors.New("invalid policy")
+
+	// ErrExpired is returned when client's token is expired.
+	ErrExpired = errors.New("token expired")
+)
+
+// Policy is a client's tests limits, zero values are not limited.
+// NoDownload and NoUpload disable directions, MaxBytes is a data size limit of every direction of a session,
+// DailyQuota and MonthlyQuota limit transferred bytes of all client's sessions during UTC calendar day and month.
+type Policy struct {
+	NoDownload   bool
+	NoUpload     bool
+	MaxDuration  time.Duration
+	MaxBytes     uint64
+	DailyQuota   uint64
+	MonthlyQuota uint64
+	MaxSessions  int
+	Expires      time.Time
+}
+
+// ParsePolicy returns a policy by attributes, it's nil if there are no policy attributes.
+// Unknown attributes are skipped, so they can be used by authenticators for other purposes.
+func ParsePolicy(attributes map[string]string) (*Policy, error) {
+	var (
+		err   error
+		found bool
+		p     = &Policy{}
+	)
+
+	for key, value := range attributes {
+		switch key {
+		case AttrScope:
+			p.NoDownload, p.NoUpload, err = parseScope(value)
+		case AttrMaxDuration:
+			p.MaxDuration, err = time.ParseDuration(value)
+			if err == nil && p.MaxDuration <= 0 {
+				err = errors.New("must be positive")
+			}
+		case AttrMaxBytes:
+			p.MaxBytes, err = common.ParseSize(value)
+		case AttrDailyQuota:
+			p.DailyQuota, err = common.ParseSize(value)
+		case AttrMonthlyQuota:
+			p.MonthlyQuota, err = common.ParseSize(value)
+		case AttrMaxSessions:
+			p.MaxSessions, err = strconv.Atoi(value)
+			if err == nil && p.MaxSessions < 1 {
+				err = errors.New("must be greater than 0")
+			}
+		case AttrExpires:
+			p.Expires, err = parseExpires(value)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, errors.Join(ErrPolicy, fmt.Errorf("attribute %s=%q: %w", key, value, err))
+		}
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// parseScope returns disabled directions by the scope.
+func parseScope(value string) (bool, bool, error) {
+	switch value {
+	case ScopeAll:
+		return false, false, nil
+	case ScopeDownload:
+		return false, true, nil
+	case ScopeUpload:
+		return true, false, nil
+	}
+
+	return false, false, fmt.Errorf("unknown scope, allowed: %s, %s, %s", ScopeAll, ScopeDownload, ScopeUpload)
+}
+
+// parseExpires parses RFC 3339 time or a date, which is valid until its end.
+func parseExpires(value string) (time.Time, error) {
+	if t, err := time.Parse(expiresDate, value); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// Allowed returns true if the direction is allowed.
+func (p *Policy) Allowed(download bool) bool {
+	if download {
+		return !p.NoDownload
+	}
+
+	return !p.NoUpload
+}
+
+// Expired returns true if the policy has an expiry time and it's not after now.
+func (p *Policy) Expired(now time.Time) bool {
+	return !p.Expires.IsZero() && !now.Before(p.Expires)
+}
+
+// parseAttributes parses space-separated "key=value" attributes.
+func parseAttributes(fields []string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	attributes := make(map[string]string, len(fields))
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" || value == "" {
+			return nil, errors.Join(ErrTokenFormat, fmt.Errorf("invalid attribute %q", field))
+		}
+
+		if _, ok = attributes[key]; ok {
+			return nil, errors.Join(ErrTokenFormat, fmt.Errorf("duplicate attribute %q", key))
+		}
+
+		attributes[key] = value
+	}
+
+	return attributes, nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	testCases := []struct {
+		name       string
+		attributes map[string]string
+		expected   *Policy
+		err        error
+	}{
+		{name: "empty"},
+		{name: "unknown", attributes: map[string]string{"plan": "isp"}},
+		{
+			name: "all",
+			attributes: map[string]string{
+				AttrScope: ScopeDownload, AttrMaxDuration: "30s", AttrMaxBytes: "1GB", AttrDailyQuota: "10GB",
+				AttrMonthlyQuota: "100GB", AttrMaxSessions: "2", AttrExpires: "2030-01-31", "plan": "isp",
+			},
+			expected: &Policy{
+				NoUpload:     true,
+				MaxDuration:  30 * time.Second,
+				MaxBytes:     1 << 30,
+				DailyQuota:   10 << 30,
+				MonthlyQuota: 100 << 30,
+				MaxSessions:  2,
+				Expires:      time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{name: "scope_upload", attributes: map[string]string{AttrScope: ScopeUpload}, expected: &Policy{NoDownload: true}},
+		{name: "scope_all", attributes: map[string]string{AttrScope: ScopeAll}, expected: &Policy{}},
+		{
+			name:       "expires_time",
+			attributes: map[string]string{AttrExpires: "2030-01-31T12:00:00+03:00"},
+			expected:   &Policy{Expires: time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)},
+		},
+		{name: "invalid_scope", attributes: map[string]string{AttrScope: "none"}, err: ErrPolicy},
+		{name: "invalid_duration", attributes: map[string]string{AttrMaxDuration: "-1s"}, err: ErrPolicy},
+		{name: "invalid_bytes", attributes: map[string]string{AttrMaxBytes: "1TB"}, err: ErrPolicy},
+		{name: "invalid_quota", attributes: map[string]string{AttrDailyQuota: "-1GB"}, err: ErrPolicy},
+		{name: "invalid_sessions", attributes: map[string]string{AttrMaxSessions: "0"}, err: ErrPolicy},
+		{name: "invalid_expires", attributes: map[string]string{AttrExpires: "31.01.2030"}, err: ErrPolicy},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParsePolicy(tc.attributes)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.expected == nil {
+				if p != nil {
+					t.Errorf("want nil policy, got %+v", p)
+				}
+				return
+			}
+
+			if p == nil || !p.Expires.Equal(tc.expected.Expires) {
+				t.Fatalf("want %+v, got %+v", tc.expected, p)
+			}
+
+			expected := *tc.expected
+			expected.Expires = p.Expires
+
+			if *p != expected {
+				t.Errorf("want %+v, got %+v", tc.expected, p)
+			}
+		})
+	}
+}
+
+func TestPolicy_Expired(t *testing.T) {
+	var (
+		now = time.Now()
+		p   = &Policy{}
+	)
+
+	if p.Expired(now) {
+		t.Error("policy without expiry time is expired")
+	}
+
+	p.Expires = now.Add(time.Second)
+	if p.Expired(now) {
+		t.Error("policy is expired before its time")
+	}
+
+	if !p.Expired(p.Expires) {
+		t.Error("policy is not expired at its time")
+	}
+
+	if !p.Allowed(true) || !p.Allowed(false) {
+		t.Error("directions are not allowed by default")
+	}
+}
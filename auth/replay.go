@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrReplay is an error for token which was already used.
+var ErrReplay = errors.New("token replay")
+
+// replayKey identifies a verified token.
+type replayKey struct {
+	clientID uint16
+	nonce    [lenSalt]byte
+}
+
+// replayItem is a remembered token and its expiration UNIX time.
+type replayItem struct {
+	key     replayKey
+	expires int64
+}
+
+// ReplayCache remembers verified tokens during their timestamp validity window to reject replays.
+// Its size is limited, if it's full, the oldest token is forgotten even if it's not expired yet.
+type ReplayCache struct {
+	mu    sync.Mutex
+	size  int
+	seen  map[replayKey]struct{}
+	queue []replayItem // in order of addition
+}
+
+// NewReplayCache creates a new cache for size tokens.
+func NewReplayCache(size int) *ReplayCache {
+	return &ReplayCache{size: max(size, 1), seen: make(map[replayKey]struct{}, size)}
+}
+
+// Check returns ErrReplay if the token was already verified, otherwise the token is remembered.
+// Tokens without client's salt (not verified by secret) are skipped.
+func (c *ReplayCache) Check(token *Token) error {
+	if token.nonce == [lenSalt]byte{} {
+		return nil
+	}
+
+	key := replayKey{clientID: token.ClientID, nonce: token.nonce}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().Unix()
+	c.expire(now)
+
+	if _, ok := c.seen[key]; ok {
+		return errors.Join(ErrUnauthorized, ErrReplay, fmt.Errorf("client %d, timestamp %d", token.ClientID, token.timestamp))
+	}
+
+	if len(c.queue) >= c.size {
+		delete(c.seen, c.queue[0].key)
+		c.queue = c.queue[1:]
+	}
+
+	c.seen[key] = struct{}{}
+	c.queue = append(c.queue, replayItem{key: key, expires: replayExpires(token, now)})
+
+	return nil
+}
+
+// expire removes expired tokens from the head of the queue.
+// Clients' clocks differ, so some expired tokens can be kept a bit longer behind not expired ones.
+func (c *ReplayCache) expire(now int64) {
+	var i int
+
+	for ; i < len(c.queue) && c.queue[i].expires < now; i++ {
+		delete(c.seen, c.queue[i].key)
+	}
+
+	c.queue = c.queue[i:]
+}
+
+// replayExpires returns UNIX time when the token can be forgotten.
+// Challenge tokens' timestamps are not checked, so the server's clock is used for them,
+// others are clamped to not keep a token with a far future timestamp and block expiration of the queue.
+func replayExpires(token *Token, now int64) int64 {
+	if token.Version == TokenChallenge {
+		return now + timestampLimit
+	}
+
+	return min(token.timestamp, now+timestampLimit) + timestampLimit
+}
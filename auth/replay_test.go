@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func replayToken(clientID uint16, nonce byte, timestamp int64) *Token {
+	token := &Token{ClientID: clientID, timestamp: timestamp}
+	token.nonce[0] = nonce
+	return token
+}
+
+func TestReplayCache_Check(t *testing.T) {
+	now := time.Now().Unix()
+
+	testCases := []struct {
+		name   string
+		size   int
+		tokens []*Token
+		replay bool
+	}{
+		{
+			name:   "unique",
+			size:   3,
+			tokens: []*Token{replayToken(1, 1, now), replayToken(1, 2, now), replayToken(2, 1, now)},
+		},
+		{
+			name:   "replay",
+			size:   3,
+			tokens: []*Token{replayToken(1, 1, now), replayToken(1, 2, now), replayToken(1, 1, now)},
+			replay: true,
+		},
+		{
+			name:   "evicted",
+			size:   2,
+			tokens: []*Token{replayToken(1, 1, now), replayToken(1, 2, now), replayToken(1, 3, now), replayToken(1, 1, now)},
+		},
+		{
+			name:   "expired",
+			size:   3,
+			tokens: []*Token{replayToken(1, 1, now-2*timestampLimit), replayToken(1, 1, now)},
+		},
+		{
+			name:   "no_nonce",
+			size:   3,
+			tokens: []*Token{{ClientID: 1}, {ClientID: 1}},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				c   = NewReplayCache(tc.size)
+				err error
+			)
+
+			for _, token := range tc.tokens {
+				if err = c.Check(token); err != nil {
+					break
+				}
+			}
+
+			if tc.replay {
+				if !errors.Is(err, ErrReplay) || !errors.Is(err, ErrUnauthorized) {
+					t.Errorf("want %v, got %v", ErrReplay, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if n := len(c.queue); n > tc.size || n != len(c.seen) {
+				t.Errorf("unexpected cache size: queue %d, seen %d", n, len(c.seen))
+			}
+		})
+	}
+}
+
+func TestReplayCache_Expires(t *testing.T) {
+	now := time.Now().Unix()
+
+	testCases := []struct {
+		name    string
+		token   *Token
+		expires int64
+	}{
+		{name: "current", token: &Token{timestamp: now}, expires: now + timestampLimit},
+		{name: "past", token: &Token{timestamp: now - 10}, expires: now - 10 + timestampLimit},
+		{name: "future", token: &Token{timestamp: now + 100*timestampLimit}, expires: now + 2*timestampLimit},
+		{
+			name:    "challenge",
+			token:   &Token{Version: TokenChallenge, timestamp: now + 100*timestampLimit},
+			expires: now + timestampLimit,
+		},
+		{name: "challenge_past", token: &Token{Version: TokenChallenge, timestamp: 1}, expires: now + timestampLimit},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			if expires := replayExpires(tc.token, now); expires != tc.expires {
+				t.Errorf("want %d, got %d", tc.expires, expires)
+			}
+		})
+	}
+}
+
+func TestReplayCache_ExpireChallenge(t *testing.T) {
+	var (
+		c      = NewReplayCache(10)
+		now    = time.Now().Unix()
+		future = replayToken(1, 1, now+100*timestampLimit)
+	)
+
+	future.Version = TokenChallenge
+
+	for _, token := range []*Token{future, replayToken(1, 2, now)} {
+		if err := c.Check(token); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	c.expire(now + 2*timestampLimit)
+
+	if n := len(c.queue); n != 0 || len(c.seen) != 0 {
+		t.Errorf("tokens are not expired: queue %d, seen %d", n, len(c.seen))
+	}
+}
+
+func TestReplayCache_Verified(t *testing.T) {
+	var (
+		c      = NewReplayCache(10)
+		client = &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		tokens = map[uint16]*Token{1: {ClientID: 1, Secret: client.Secret}}
+	)
+
+	header, err := client.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, e := verifyHeader(header, tokens, nil)
+		if e != nil {
+			t.Fatalf("unexpected error: %v", e)
+		}
+
+		if token.nonce != client.salt || token.salt == client.salt {
+			t.Fatal("client's salt is not kept or reply salt is not reset")
+		}
+
+		err = c.Check(token)
+	}
+
+	if !errors.Is(err, ErrReplay) {
+		t.Errorf("want %v, got %v", ErrReplay, err)
+	}
+
+	// the same client with a new token
+	if header, err = client.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := verifyHeader(header, tokens, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = c.Check(token); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
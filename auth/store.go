@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerFileEnv is an environment variable name for server's tokens file, e.g. a Docker secret.
+// It's an alternative of ServerEnv, the file is read by LoadTokens.
+const ServerFileEnv = ServerEnv + "_FILE"
+
+// LoadTokens reads server's tokens from the file with one "clientID:secret" pair per line,
+// it can be followed by policy attributes, e.g. "1:3312a18b scope=download max_sessions=2".
+// Empty lines and comments after "#" are skipped.
+func LoadTokens(name string) (map[uint16]*Token, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("tokens file: %w", err)
+	}
+
+	var (
+		tokens  = make(map[uint16]*Token)
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		token, e := NewToken(line)
+		if e != nil {
+			return nil, errors.Join(e, fmt.Errorf("tokens file %s, line %d", name, n))
+		}
+
+		if _, ok := tokens[token.ClientID]; ok {
+			return nil, errors.Join(ErrTokenFormat, fmt.Errorf("tokens file %s, line %d: duplicate clientID %d", name, n, token.ClientID))
+		}
+
+		tokens[token.ClientID] = token
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("tokens file %s: %w", name, err)
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.Join(ErrAuthRequired, fmt.Errorf("no tokens in file %s", name))
+	}
+
+	return tokens, nil
+}
+
+// TokenStore is an authenticator by shared secrets of clients, which can be replaced at runtime.
+// Removed and changed tokens are retired, they are still verified during the grace period,
+// but returned identities are marked, so the server can allow them only for already opened sessions.
+type TokenStore struct {
+	mu        sync.RWMutex
+	tokens    map[uint16]*Token
+	retired   map[uint16]*Token
+	retiredAt map[uint16]time.Time
+	grace     time.Duration
+}
+
+// NewTokenStore creates a new store with the tokens, retired tokens are verified during the grace period.
+func NewTokenStore(tokens map[uint16]*Token, grace time.Duration) *TokenStore {
+	return &TokenStore{tokens: tokens, grace: grace}
+}
+
+// Authenticate verifies signed token header by current tokens, and by retired ones if it failed.
+func (s *TokenStore) Authenticate(h *Handshake) (*Identity, error) {
+	s.mu.RLock()
+	tokens, retired, retiredAt := s.tokens, s.retired, s.retiredAt
+	s.mu.RUnlock()
+
+	token, err := verifyHeader(h.Header, tokens, h.Challenge)
+	if err == nil {
+		return tokenIdentity(token), nil
+	}
+
+	if len(retired) > 0 {
+		if token, e := verifyHeader(h.Header, retired, h.Challenge); e == nil && time.Since(retiredAt[token.ClientID]) < s.grace {
+			identity := tokenIdentity(token)
+			identity.RetiredAt = retiredAt[token.ClientID]
+			return identity, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Len returns a number of current tokens.
+func (s *TokenStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.tokens)
+}
+
+// Replace sets new tokens and returns sorted client IDs, which were added, removed or got a new secret.
+// Retired tokens are dropped after the grace period or if they are current again.
+func (s *TokenStore) Replace(tokens map[uint16]*Token) ([]uint16, []uint16, []uint16) {
+	var (
+		added, removed, updated []uint16
+		now                     = time.Now()
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	retired := make(map[uint16]*Token, len(s.retired))
+	retiredAt := make(map[uint16]time.Time, len(s.retired))
+
+	for clientID, token := range s.retired {
+		at := s.retiredAt[clientID]
+		if now.Sub(at) >= s.grace {
+			continue
+		}
+
+		if t, ok := tokens[clientID]; !ok || !bytes.Equal(t.Secret, token.Secret) {
+			retired[clientID], retiredAt[clientID] = token, at
+		}
+	}
+
+	for clientID, token := range s.tokens {
+		t, ok := tokens[clientID]
+		switch {
+		case !ok:
+			removed = append(removed, clientID)
+		case !bytes.Equal(t.Secret, token.Secret):
+			updated = append(updated, clientID)
+		default:
+			continue
+		}
+
+		retired[clientID], retiredAt[clientID] = token, now
+	}
+
+	for clientID := range tokens {
+		if _, ok := s.tokens[clientID]; !ok {
+			added = append(added, clientID)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(updated)
+
+	s.tokens, s.retired, s.retiredAt = tokens, retired, retiredAt
+	return added, removed, updated
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadTokens_File(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected map[uint16]*Token
+		err      error
+	}{
+		{
+			name:     "valid",
+			content:  "# clients\n1:3312a18b\n\n  2:666bf6a2  # probe\n",
+			expected: map[uint16]*Token{1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}, 2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}}},
+		},
+		{name: "crlf", content: "1:3312a18b\r\n", expected: map[uint16]*Token{1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}}},
+		{name: "empty", content: "# nothing\n\n", err: ErrAuthRequired},
+		{name: "invalid", content: "1:3312a18b\n2:xyz\n", err: ErrTokenFormat},
+		{name: "duplicate", content: "1:3312a18b\n1:666bf6a2\n", err: ErrTokenFormat},
+		{
+			name:     "policy",
+			content:  "1:3312a18b scope=upload max_bytes=1GB # partner\n",
+			expected: map[uint16]*Token{1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}},
+		},
+		{name: "invalid_policy", content: "1:3312a18b expires=tomorrow\n", err: ErrPolicy},
+		{name: "not_found", err: os.ErrNotExist},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "tokens")
+			if tc.content != "" {
+				if err := os.WriteFile(name, []byte(tc.content), 0o600); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+			}
+
+			tokens, err := LoadTokens(name)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err = compareTokens(tokens, tc.expected); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTokenStore_Replace(t *testing.T) {
+	var (
+		client1 = &Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		client2 = &Token{ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}}
+		client3 = &Token{ClientID: 3, Secret: []byte{0x01, 0x02, 0x03, 0x04}}
+		rotated = &Token{ClientID: 1, Secret: []byte{0x05, 0x06, 0x07, 0x08}}
+		store   = NewTokenStore(map[uint16]*Token{1: client1, 2: client2}, time.Minute)
+	)
+
+	added, removed, updated := store.Replace(map[uint16]*Token{1: rotated, 3: client3})
+	if !slices.Equal(added, []uint16{3}) || !slices.Equal(removed, []uint16{2}) || !slices.Equal(updated, []uint16{1}) {
+		t.Errorf("unexpected changes: added %v, removed %v, updated %v", added, removed, updated)
+	}
+
+	testCases := []struct {
+		name    string
+		client  *Token
+		retired bool
+		err     error
+	}{
+		{name: "added", client: client3},
+		{name: "rotated", client: rotated},
+		{name: "rotated_old", client: client1, retired: true},
+		{name: "removed", client: client2, retired: true},
+		{name: "unknown", client: &Token{ClientID: 4, Secret: client1.Secret}, err: ErrUnknownClient},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := tc.client.Build()
+			if err != nil {
+				t.Fatalf("failed to build token: %v", err)
+			}
+
+			token, err := store.Authenticate(&Handshake{Header: header})
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if token.ClientID != tc.client.ClientID || token.RetiredAt.IsZero() == tc.retired {
+				t.Errorf("unexpected token: %+v", token)
+			}
+		})
+	}
+
+	// client 2 is back, so it's not retired anymore
+	store.Replace(map[uint16]*Token{1: rotated, 2: client2})
+	if _, ok := store.retired[2]; ok {
+		t.Error("re-added client is still retired")
+	}
+
+	if _, ok := store.retired[3]; !ok {
+		t.Error("removed client is not retired")
+	}
+
+	// retired tokens are not verified after the grace period and dropped by the next replacement
+	store.retiredAt[3] = time.Now().Add(-time.Minute)
+
+	header, err := client3.Build()
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	if _, err = store.Authenticate(&Handshake{Header: header}); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("want %v, got %v", ErrUnknownClient, err)
+	}
+
+	store.Replace(map[uint16]*Token{1: rotated, 2: client2})
+	if _, ok := store.retired[3]; ok {
+		t.Error("retired client is kept after the grace period")
+	}
+
+	if _, ok := store.retired[1]; !ok {
+		t.Error("retired client is dropped before the grace period end")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
@@ -13,7 +14,26 @@ import (
 	"time"
 )
 
+// Token format versions.
 const (
+	// TokenLegacy is a format without version field, its signature is sha512(data || secret).
+	TokenLegacy uint8 = 1
+
+	// TokenHMAC is a format with version field and HMAC-SHA256 signature.
+	TokenHMAC uint8 = 2
+
+	// TokenChallenge is TokenHMAC format with signed challenge instead of timestamp checking.
+	TokenChallenge uint8 = 3
+
+	// TokenVersion is the newest supported format version.
+	TokenVersion = TokenChallenge
+
+	// MaxClockSkew is the allowed time difference between clients and servers for not challenge tokens.
+	MaxClockSkew = timestampLimit * time.Second
+)
+
+const (
+	lenVersion  = 1
 	lenAction   = 1
 	lenClientID = 2
 	lenIP       = 16
@@ -22,6 +42,10 @@ const (
 	lenSign     = sha512.Size
 	lenToken    = lenAction + lenClientID + lenIP + lenSalt + lenTime + lenSign
 
+	lenSignHMAC  = sha256.Size
+	lenTokenHMAC = lenVersion + endTime + lenSignHMAC
+
+	// offsets of token data, it follows the version field in TokenHMAC format
 	endClient = lenAction + lenClientID
 	endIP     = endClient + lenIP
 	endSalt   = endIP + lenSalt
@@ -31,15 +55,31 @@ const (
 	timestampLimit = 30 // seconds
 )
 
-// Token is a client's token.
+// Token is a client's token, zero Version means TokenHMAC format, others are set by negotiation.
+// Challenge is a random value of the other side which is signed by TokenChallenge format.
+// Attributes and Policy are optional server's settings of the client.
 type Token struct {
-	ClientID  uint16
-	Secret    []byte
-	Download  bool // false - upload, true - download
-	IP        net.IP
-	salt      [lenSalt]byte
-	timestamp int64
-	signature [sha512.Size]byte
+	ClientID   uint16
+	Secret     []byte
+	Download   bool // false - upload, true - download
+	IP         net.IP
+	Version    uint8
+	Challenge  []byte
+	Attributes map[string]string
+	Policy     *Policy
+	salt       [lenSalt]byte
+	nonce      [lenSalt]byte // client's salt of verified token
+	timestamp  int64
+	signature  []byte
+}
+
+// format returns token's format version.
+func (t *Token) format() uint8 {
+	if t.Version == 0 {
+		return TokenHMAC
+	}
+
+	return t.Version
 }
 
 // init sets random salt and current timestamp.
@@ -58,33 +98,44 @@ func (t *Token) init() error {
 
 // Sign builds token, calculates its signature and returns it with data as common byte slice.
 func (t *Token) Sign() []byte {
-	buf := make([]byte, lenToken)
+	data := make([]byte, endTime)
 
 	if !t.Download {
-		buf[0] = 1
+		data[0] = 1
 	}
 
-	binary.BigEndian.PutUint16(buf[lenAction:], t.ClientID)
-	copy(buf[endClient:], t.IP.To16())
-	copy(buf[endIP:], t.salt[:])
-	binary.BigEndian.PutUint64(buf[endSalt:], uint64(t.timestamp))
+	binary.BigEndian.PutUint16(data[lenAction:], t.ClientID)
+	copy(data[endClient:], t.IP.To16())
+	copy(data[endIP:], t.salt[:])
+	binary.BigEndian.PutUint64(data[endSalt:], uint64(t.timestamp))
+
+	if t.format() == TokenLegacy {
+		h := sha512.New()
+		h.Write(data)
+		h.Write(t.Secret)
+
+		t.signature = h.Sum(nil)
+		return append(data, t.signature...)
+	}
 
-	prefixPart := buf[:endTime]
+	buf := make([]byte, 0, lenTokenHMAC)
+	buf = append(append(buf, t.format()), data...)
 
-	h := sha512.New()
-	h.Write(prefixPart)
-	h.Write(t.Secret)
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write(buf)
 
-	copy(t.signature[:], h.Sum(nil))
-	copy(buf[endTime:], t.signature[:])
+	if t.format() == TokenChallenge {
+		mac.Write(t.Challenge)
+	}
 
-	return buf
+	t.signature = mac.Sum(nil)
+	return append(buf, t.signature...)
 }
 
 // Verify checks token signature.
 func (t *Token) Verify(signature []byte) bool {
 	t.Sign() // update signature by current token values
-	return hmac.Equal(signature, t.signature[:])
+	return hmac.Equal(signature, t.signature)
 }
 
 // Build resets temporary values and builds new signature.
@@ -98,6 +149,8 @@ func (t *Token) Build() ([]byte, error) {
 }
 
 // Handshake is called by clients to send token to server and receive one back.
+//
+// Deprecated: clients send tokens in the framed protocol handshake, where servers verify them by an Authenticator.
 func (t *Token) Handshake(rw io.ReadWriter) error {
 	if rw == nil {
 		return errors.New("nil reader/writer")
@@ -114,24 +167,34 @@ func (t *Token) Handshake(rw io.ReadWriter) error {
 		return fmt.Errorf("failed to write header data: %w", err)
 	}
 
-	if n != lenToken {
+	if n != len(header) {
 		return errors.New("invalid write token length")
 	}
 
 	// receive reply-token from server
-	header = make([]byte, lenToken)
+	header = make([]byte, len(header))
 	n, err = rw.Read(header)
 
 	if err != nil {
 		return fmt.Errorf("failed to read header data: %w", err)
 	}
 
-	if n != lenToken {
+	if n != len(header) {
 		return errors.New("invalid read token length")
 	}
 
+	return t.VerifyReply(header)
+}
+
+// VerifyReply is called by clients to check server's reply-token, it must have the same format.
+func (t *Token) VerifyReply(header []byte) error {
+	if v := HeaderVersion(header); v != t.format() {
+		return errors.Join(ErrTokenFormat, fmt.Errorf("reply token version %d, expected %d", v, t.format()))
+	}
+
+	// the reply is signed with client's salt as the challenge
 	tokens := map[uint16]*Token{t.ClientID: t}
-	_, err = verifyHeader(header, tokens)
+	_, err := verifyHeader(header, tokens, t.salt[:])
 	return err
 }
 
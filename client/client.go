@@ -2,27 +2,43 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/z0rr0/spts/auth"
 	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+	"github.com/z0rr0/spts/tlsconfig"
 )
 
 type ctxType string
 
 const ctxWriterKey ctxType = "progressWriter"
 
-// ErrConnectionFailed is returned when the connection failed.
-var ErrConnectionFailed = errors.New("connection failed")
+var (
+	// ErrConnectionFailed is returned when the connection failed.
+	ErrConnectionFailed = errors.New("connection failed")
+
+	// ErrRejected is returned when the server rejected client's authorization.
+	ErrRejected = errors.New("server rejected authorization")
+
+	// ErrServerIdentity is returned when the server failed to prove that it has client's secret.
+	ErrServerIdentity = errors.New("server failed to prove identity")
+
+	// ErrForbidden is returned when the server doesn't allow the test by client's policy, e.g. its quota is exhausted.
+	ErrForbidden = errors.New("test is not allowed by the server")
+)
 
 // Client is a client data.
 type Client struct {
 	common.Params
+	tlsConfig *tls.Config
 }
 
 // New creates a new client.
@@ -35,7 +51,50 @@ func New(params *common.Params) (*Client, error) {
 		return nil, errors.New("host address is empty")
 	}
 
-	return &Client{Params: *params}, nil
+	if params.Streams < 1 {
+		return nil, errors.New("streams number must be greater than 0")
+	}
+
+	if params.UDP && params.PacketSize != 0 &&
+		(params.PacketSize < protocol.DatagramHeaderSize || params.PacketSize > protocol.MaxDatagramSize) {
+		return nil, fmt.Errorf(
+			"packet size must be in range [%d, %d]", protocol.DatagramHeaderSize, protocol.MaxDatagramSize,
+		)
+	}
+
+	if params.Format == "" {
+		params.Format = FormatText
+	}
+
+	if _, ok := formats[params.Format]; !ok {
+		return nil, errors.Join(ErrFormat, fmt.Errorf("unknown %q", params.Format))
+	}
+
+	c := &Client{Params: *params}
+	if c.TLS || c.TLSFingerprint != "" || c.TLSCert != "" {
+		cfg, err := tlsconfig.Client(c.Host, c.TLSFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.TLSCert != "" {
+			// client's certificate can be used instead of the token
+			cert, e := tlsconfig.Certificate(c.TLSCert, c.TLSKey)
+			if e != nil {
+				return nil, e
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+
+		c.TLS, c.tlsConfig = true, cfg
+	}
+
+	if c.Format != FormatText {
+		// dot progress would break machine-readable output
+		c.Dot = false
+	}
+
+	return c, nil
 }
 
 // String implements Stringer interface.
@@ -43,50 +102,176 @@ func (c *Client) String() string {
 	return fmt.Sprintf("address: %s, timeout: %s", c.Address(), c.Timeout)
 }
 
-// Start does a client request.
+// Start does a client request and writes its result in the client's format to the output.
+// Machine-readable formats get a result even if the session failed, it contains the error.
 func (c *Client) Start(ctx context.Context) error {
-	var (
-		newLine  = c.NewLine()
-		pgWriter = progressWriter(ctx)
-	)
+	result, err := c.Run(ctx)
+
+	if result == nil {
+		if c.Format == "" || c.Format == FormatText {
+			return err
+		}
+
+		result = c.newResult()
+	}
 
-	token, err := auth.ClientToken()
 	if err != nil {
-		return err
+		result.Error = err.Error()
 	}
 
-	slog.Debug("token", "client", token.ClientID)
+	if c.Dot {
+		// finish the progress line
+		if _, e := fmt.Fprint(progressWriter(ctx), c.NewLine()); e != nil {
+			return errors.Join(err, e)
+		}
+	}
+
+	return errors.Join(err, c.writeResult(ctx, result))
+}
 
-	speed, ip, err := c.run(ctx, pgWriter, token, true)
+// Run does a test and returns its result.
+// The result is not nil if the session was opened, but it can be partial if the error is not nil.
+func (c *Client) Run(ctx context.Context) (*Result, error) {
+	token, err := c.token()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = fmt.Fprintf(pgWriter, "%sIP address:     %s\n", newLine, ip)
+	ss, err := c.open(ctx, token)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = fmt.Fprintf(pgWriter, "%sDownload speed: %s\n", newLine, speed)
+	defer func() {
+		if e := ss.close(); e != nil {
+			slog.Error("session", "close_error", e)
+		}
+	}()
+
+	result := c.newResult()
+	result.IP, result.UDP, result.Version = ss.params.ClientIP, ss.params.UDP, int(ss.version)
+
+	if token != nil {
+		// certificate's client ID is known only by the server
+		result.ClientID = token.ClientID
+	}
+	result.Streams, result.Duration = ss.params.Streams, ss.params.Duration
+
+	samples, err := ss.latency(ctx, idleProbes, c.probeTimeout(ss))
 	if err != nil {
-		return err
+		return result, err
+	}
+
+	result.Latency = common.NewLatency(samples)
+	if ss.params.UDP {
+		return result, c.runUDP(ctx, ss, result)
 	}
 
-	speed, _, err = c.run(ctx, pgWriter, token, false)
+	pgWriter := progressWriter(ctx)
+	for _, download := range []bool{true, false} {
+		if !ss.params.Allowed(download) {
+			slog.Warn("direction is not allowed by the server", "download", download)
+			continue
+		}
+
+		d, latencyErr := c.runLoaded(ctx, pgWriter, ss, token, download)
+		if d == nil {
+			return result, latencyErr
+		}
+
+		if download {
+			result.Download = d
+		} else {
+			result.Upload = d
+		}
+
+		if err = errors.Join(d.Err, latencyErr); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// probeTimeout returns a timeout of one latency probe, it can be long for the loaded connection.
+func (c *Client) probeTimeout(ss *session) time.Duration {
+	return ss.params.Duration + c.Timeout
+}
+
+// runLoaded does parallel tests in one direction and measures latency during them.
+// The direction is nil if no stream started data transfer, then the error is returned separately.
+func (c *Client) runLoaded(ctx context.Context, pgWriter io.Writer, ss *session, token *auth.Token, download bool) (*Direction, error) {
+	type latencyResult struct {
+		samples []time.Duration
+		err     error
+	}
+
+	var results = make(chan latencyResult, 1)
+
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		samples, err := ss.latency(probeCtx, 0, c.probeTimeout(ss))
+		results <- latencyResult{samples: samples, err: err}
+	}()
+
+	streams, err := c.runStreams(ctx, pgWriter, ss, token, download)
+	cancel()
+
+	res := <-results
+	if !started(streams) {
+		return nil, errors.Join(err, res.err)
+	}
+
+	return newDirection(streams, common.NewLatency(res.samples), err), res.err
+}
+
+// started returns true if at least one stream started data transfer.
+func started(streams []*Stream) bool {
+	for _, s := range streams {
+		if s.report != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial connects to the server, the connection deadline is set by the context one.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address())
 	if err != nil {
-		return err
+		return nil, errors.Join(ErrConnectionFailed, fmt.Errorf("dial: %w", err))
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil, errors.Join(ErrConnectionFailed, fmt.Errorf("deadline: %w", err), conn.Close())
+		}
+	}
+
+	if c.tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, errors.Join(ErrConnectionFailed, fmt.Errorf("tls handshake: %w", err), conn.Close())
 	}
 
-	_, err = fmt.Fprintf(pgWriter, "%sUpload speed:   %s\n", newLine, speed)
-	return err
+	return tlsConn, nil
 }
 
-// Upload does a client POST request with body.
-func (c *Client) run(ctx context.Context, pgWriter io.Writer, token *auth.Token, download bool) (string, string, error) {
+// runStreams does parallel tests in one direction and returns receiver side results of every stream.
+// Results can be partial or without report for failed streams if the error is not nil.
+func (c *Client) runStreams(ctx context.Context, pgWriter io.Writer, ss *session, token *auth.Token, download bool) ([]*Stream, error) {
 	var (
-		dialer  net.Dialer
-		count   uint64
-		timeout = c.Timeout
+		wg      sync.WaitGroup
+		streams = make([]*Stream, max(ss.params.Streams, 1))
+		errs    = make([]error, len(streams))
 	)
 
 	if c.Params.Dot {
@@ -94,16 +279,58 @@ func (c *Client) run(ctx context.Context, pgWriter io.Writer, token *auth.Token,
 		defer prg.done()
 	}
 
-	if download {
-		timeout *= common.TimeoutMultiplier
+	for i := range streams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			streams[i] = c.run(ctx, ss, token, download, i)
+			errs[i] = streams[i].Err
+		}(i)
 	}
 
+	wg.Wait()
+	return streams, errors.Join(errs...)
+}
+
+// statsCollector keeps receiver's statistics messages, they can be added from another goroutine.
+type statsCollector struct {
+	mu    sync.Mutex
+	items []*protocol.Stats
+}
+
+// add appends a statistics message.
+func (sc *statsCollector) add(stats *protocol.Stats) {
+	slog.Debug("stats", "count", common.ByteSize(stats.Count))
+
+	sc.mu.Lock()
+	sc.items = append(sc.items, stats)
+	sc.mu.Unlock()
+}
+
+// all returns collected statistics messages.
+func (sc *statsCollector) all() []*protocol.Stats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return append([]*protocol.Stats(nil), sc.items...)
+}
+
+// run does a test of one stream and returns receiver side result.
+// The result has a report if data transfer was started, but it can be partial if the error is not nil.
+func (c *Client) run(ctx context.Context, ss *session, token *auth.Token, download bool, stream int) *Stream {
+	var (
+		report *common.Report
+		stats  = &statsCollector{}
+		// connection timeout is reserved for the handshake and for the result waiting
+		timeout = ss.params.Duration + 2*c.Timeout
+	)
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	conn, err := dialer.DialContext(ctx, "tcp", c.Address())
+	conn, err := c.dial(ctx)
 	if err != nil {
-		return "", "", errors.Join(ErrConnectionFailed, fmt.Errorf("dial: %w", err))
+		return &Stream{Err: err}
 	}
 
 	defer func() {
@@ -112,73 +339,210 @@ func (c *Client) run(ctx context.Context, pgWriter io.Writer, token *auth.Token,
 		}
 	}()
 
-	client, ip, err := c.handshake(conn, token, download)
+	streamParams := &protocol.Params{Session: ss.params.Session, Stream: stream}
+	pc, params, _, err := c.handshake(conn, streamToken(token), download, streamParams)
 	if err != nil {
-		return "", "", err
+		return &Stream{Err: err}
+	}
+
+	if err = pc.ReadMessage(protocol.TypeStart, &protocol.Start{}); err != nil {
+		return &Stream{Err: errors.Join(ErrConnectionFailed, fmt.Errorf("start: %w", err))}
 	}
 
 	slog.Debug(
-		"connection",
-		"address", conn.RemoteAddr().String(), "client", client, "download", download, "timeout", timeout,
+		"stream",
+		"address", conn.RemoteAddr().String(), "download", download, "stream", stream,
+		"duration", params.Duration, "timeout", timeout,
 	)
-	start := time.Now()
 
 	if download {
-		count, err = c.download(ctx, conn)
+		report, err = c.download(ctx, pc, stats.add)
 	} else {
-		count, err = c.upload(ctx, conn)
+		report, err = c.upload(ctx, pc, params.Duration, params.StreamBytes(stream), stats.add)
 	}
 
+	slog.Debug(
+		"stream",
+		"download", download, "stream", stream, "count", common.ByteSize(report.Count),
+		"speed", report.Speed(), "error", err,
+	)
+	return newStream(report, stats.all(), err)
+}
+
+// token returns client's token, without it the server decides to accept the client
+// by its TLS certificate or as an anonymous one.
+func (c *Client) token() (*auth.Token, error) {
+	token, err := auth.ClientToken()
 	if err != nil {
-		return "", "", err
+		if !errors.Is(err, auth.ErrAuthRequired) {
+			return nil, err
+		}
+
+		if c.StrictAuth {
+			return nil, errors.Join(err, errors.New("strict auth requires a token"))
+		}
+
+		if c.tlsConfig != nil && len(c.tlsConfig.Certificates) > 0 {
+			slog.Debug("token", "certificate", c.TLSCert)
+		} else {
+			slog.Debug("token", "anonymous", true)
+		}
+		return nil, nil
 	}
 
-	slog.Debug("connection", "download", download, "ip", ip, "count", common.ByteSize(count))
-	return common.Speed(time.Since(start), count, common.SpeedSeconds), ip, nil
+	slog.Debug("token", "client", token.ClientID)
+	return token, nil
 }
 
-// handshake does a client handshake, sends token and receives one back.
-func (c *Client) handshake(conn net.Conn, token *auth.Token, download bool) (uint16, string, error) {
-	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		return 0, "", common.ErrIPAddress
+// streamToken returns a copy of the token, because the handshake changes its temporary values.
+func streamToken(token *auth.Token) *auth.Token {
+	if token == nil {
+		return nil
+	}
+
+	t := *token
+	return &t
+}
+
+// handshake does a client handshake: checks protocol version, sends token and receives one back,
+// then sends requested test parameters and returns negotiated ones with the protocol version used by the server.
+// Clients need sessions, so servers must use at least protocol.VersionStreams.
+func (c *Client) handshake(conn net.Conn, token *auth.Token, download bool, params *protocol.Params) (*protocol.Conn, *protocol.Params, uint8, error) {
+	var (
+		hello  = &protocol.Hello{}
+		header []byte
+		err    error
+	)
+
+	pc := protocol.NewConn(conn)
+	if err = pc.WritePreamble(protocol.Version); err != nil {
+		return nil, nil, 0, errors.Join(ErrConnectionFailed, err)
+	}
+
+	if err = pc.ReadMessage(protocol.TypeHello, hello); err != nil {
+		if errors.Is(err, io.EOF) {
+			// old servers close connection after invalid token reading
+			err = errors.Join(protocol.ErrUnsupportedVersion, err)
+		}
+		return nil, nil, 0, errors.Join(ErrConnectionFailed, fmt.Errorf("hello: %w", err))
+	}
+
+	if hello.Version < protocol.VersionStreams || hello.Version > protocol.Version {
+		err = fmt.Errorf("%w: %d", protocol.ErrUnsupportedVersion, hello.Version)
+		return nil, nil, 0, errors.Join(ErrConnectionFailed, fmt.Errorf("hello: %w", err))
 	}
 
-	ip := remoteAddr.IP
 	if token == nil {
-		return 0, ip.String(), nil // no token, no handshake
+		// no token, no signature, server decides to accept it or not by other methods
+		header = auth.ActionHeader(download)
+	} else {
+		remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, nil, 0, common.ErrIPAddress
+		}
+
+		token.IP = remoteAddr.IP
+		token.Download = download
+		token.Version = auth.Negotiate(hello.Token, hello.Challenge)
+		token.Challenge = hello.Challenge
+
+		if c.StrictAuth && token.Version != auth.TokenChallenge {
+			// the token is not sent, because the server can't prove its identity for this connection
+			return nil, nil, 0, errors.Join(
+				ErrServerIdentity, fmt.Errorf("no challenge-response support, token version %d", token.Version),
+			)
+		}
+
+		if params.Session == 0 {
+			// only once for the session control connection
+			checkClock(hello, token.Version)
+		}
+
+		if header, err = token.Build(); err != nil {
+			return nil, nil, 0, err
+		}
 	}
 
-	token.IP = ip
-	token.Download = download
+	if err = pc.WriteFrame(protocol.TypeAuth, header); err != nil {
+		return nil, nil, 0, errors.Join(ErrConnectionFailed, err)
+	}
 
-	if err := token.Handshake(conn); err != nil {
-		return 0, "", err
+	if header, err = pc.ReadFrame(protocol.TypeAuth); err != nil {
+		return nil, nil, 0, authError("auth", err)
 	}
 
-	return token.ClientID, ip.String(), nil
+	if token != nil {
+		if err = token.VerifyReply(header); err != nil {
+			return nil, nil, 0, errors.Join(ErrServerIdentity, err)
+		}
+		slog.Debug("handshake", "client", token.ClientID, "version", hello.Version, "token", token.Version)
+	}
+
+	if err = pc.WriteMessage(protocol.TypeParams, params); err != nil {
+		return nil, nil, 0, errors.Join(ErrConnectionFailed, err)
+	}
+
+	// false values are omitted by the server, so the reply is not merged with the request
+	params = &protocol.Params{}
+	if err = pc.ReadMessage(protocol.TypeParams, params); err != nil {
+		// the server can reject removed clients after the token check
+		return nil, nil, 0, authError("params", err)
+	}
+
+	return pc, params, hello.Version, nil
+}
+
+// authError separates server's rejection of client's authorization or test from transport errors of the handshake stage.
+func authError(stage string, err error) error {
+	var remote *protocol.Error
+
+	if errors.As(err, &remote) {
+		switch remote.Code {
+		case protocol.CodeUnauthorized:
+			return errors.Join(ErrRejected, err)
+		case protocol.CodeForbidden:
+			return errors.Join(ErrForbidden, err)
+		}
+	}
+
+	return errors.Join(ErrConnectionFailed, fmt.Errorf("%s: %w", stage, err))
 }
 
-// download gets data from server.
-func (c *Client) download(ctx context.Context, conn io.Reader) (uint64, error) {
-	w := common.NewWriter(ctx)
-	n, err := io.Copy(w, conn) // successful Copy returns err == nil, not err == io.EOF
+// checkClock warns about clock skew with the server,
+// it breaks authorization only if the token version is not TokenChallenge.
+func checkClock(hello *protocol.Hello, version uint8) {
+	if hello.Time.IsZero() {
+		return
+	}
 
-	if err != nil && !errors.Is(err, common.ErrWriterTimeout) {
-		return 0, errors.Join(ErrConnectionFailed, fmt.Errorf("download read/write: %w", err))
+	if skew := time.Since(hello.Time); skew.Abs() > auth.MaxClockSkew {
+		slog.Warn(
+			"clock skew", "server_time", hello.Time, "skew", skew.Round(time.Second),
+			"token", version, "challenge", version == auth.TokenChallenge,
+		)
 	}
+}
 
-	return uint64(n), nil
+// download gets data from server until its end message and sends back a report about received data.
+// Function f is called for every sent statistics message.
+func (c *Client) download(ctx context.Context, pc *protocol.Conn, f func(*protocol.Stats)) (*common.Report, error) {
+	report, err := pc.Receive(ctx, 0, f)
+	if err != nil {
+		return report, errors.Join(ErrConnectionFailed, fmt.Errorf("download: %w", err))
+	}
+
+	return report, nil
 }
 
-// upload sends data to server.
-func (c *Client) upload(ctx context.Context, conn io.Writer) (uint64, error) {
-	r := common.NewReader(ctx)
-	n, err := io.Copy(conn, r)
+// upload sends data to server during the test duration or until size bytes are sent,
+// then it returns server's report about received data.
+// Function f is called for every server's statistics message.
+func (c *Client) upload(ctx context.Context, pc *protocol.Conn, duration time.Duration, size uint64, f func(*protocol.Stats)) (*common.Report, error) {
+	report, err := pc.Send(ctx, duration, size, f)
 
-	if err = common.SkipError(err); err != nil {
-		return 0, errors.Join(ErrConnectionFailed, fmt.Errorf("upload read/write: %w", err))
+	if err != nil {
+		return report, errors.Join(ErrConnectionFailed, fmt.Errorf("upload: %w", err))
 	}
 
-	return uint64(n), nil
+	return report, nil
 }
@@ -3,27 +3,41 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/z0rr0/spts/auth"
 	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
 )
 
 const (
 	testEnv        = "1:3312a18b"
 	testAccTimeout = 20 * time.Millisecond
+	mb             = uint64(common.MB)
+	testClientIP   = "192.0.2.10" // client's IP address as the test server sees it
 )
 
 var (
-	outRe = regexp.MustCompile(`^IP address:\s{5}.*\nDownload speed: .*\nUpload speed:\s{3}.*\n$`)
+	outRe = regexp.MustCompile(
+		`^IP address:\s{5}192\.0\.2\.10\nIdle latency:\s{3}min .*\nDownload speed: .*\n\s{2}latency\s{7}min .*\n` +
+			`Upload speed:\s{3}.*\n\s{2}latency\s{7}min .*\n$`,
+	)
+	outStreamsRe = regexp.MustCompile(
+		`^IP address:\s{5}192\.0\.2\.10\nIdle latency:\s{3}min .*\nDownload speed: .*\n(\s{2}stream \d\s{6}.*\n){3}` +
+			`\s{2}latency\s{7}min .*\nUpload speed:\s{3}.*\n(\s{2}stream \d\s{6}.*\n){3}\s{2}latency\s{7}min .*\n$`,
+	)
+	outJSONRe = regexp.MustCompile(`^\{"schema":1,"version":\d+,.*"ip":"192\.0\.2\.10",.*"streams":2,.*"download":\{.*"upload":\{.*\}\n$`)
 )
 
 type testServer struct {
@@ -50,7 +64,10 @@ func createServer(t *testing.T, f func(conn net.Conn) error) (*testServer, error
 	srv := &testServer{listener: listener, stop: stop, wait: wait}
 
 	go func() {
+		var wg sync.WaitGroup
+
 		defer func() {
+			wg.Wait()
 			if e := listener.Close(); e != nil {
 				t.Errorf("failed to close listener: %v", e)
 			}
@@ -75,18 +92,25 @@ func createServer(t *testing.T, f func(conn net.Conn) error) (*testServer, error
 					continue
 				}
 
-				if e = conn.SetDeadline(time.Now().Add(testAccTimeout * 5)); e != nil {
+				// session control connection is held during idle and loaded latency probes
+				if e = conn.SetDeadline(time.Now().Add(time.Second)); e != nil {
 					t.Errorf("failed to set deadline: %v", e)
 					continue
 				}
 
-				if e = f(conn); err != nil {
-					t.Errorf("failed to handle connection: %v", e)
-				}
+				// connections are handled concurrently, because session control connection is open during the test
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
 
-				if e = conn.Close(); e != nil {
-					t.Errorf("failed to close connection: %v", e)
-				}
+					if e := f(conn); err != nil {
+						t.Errorf("failed to handle connection: %v", e)
+					}
+
+					if e := conn.Close(); e != nil {
+						t.Errorf("failed to close connection: %v", e)
+					}
+				}()
 			}
 		}
 	}()
@@ -94,24 +118,115 @@ func createServer(t *testing.T, f func(conn net.Conn) error) (*testServer, error
 	return srv, nil
 }
 
+// serverHandshake does a server side handshake and returns client's requested parameters.
+func serverHandshake(conn net.Conn, tokens map[uint16]*auth.Token) (*protocol.Conn, *auth.Token, *protocol.Params, error) {
+	pc := protocol.NewConn(conn)
+
+	if _, err := pc.ReadPreamble(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := pc.WriteMessage(protocol.TypeHello, &protocol.Hello{Version: protocol.Version}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	header, err := pc.ReadFrame(protocol.TypeAuth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	identity, err := auth.Tokens(tokens).Authenticate(&auth.Handshake{Header: header})
+	if err != nil {
+		return nil, nil, nil, errors.Join(err, pc.WriteError(protocol.CodeUnauthorized, ""))
+	}
+	token := identity.Token
+
+	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, nil, nil, common.ErrIPAddress
+	}
+	token.IP = remoteAddr.IP
+
+	// write handshake reply
+	if err = pc.WriteFrame(protocol.TypeAuth, token.Sign()); err != nil {
+		return nil, nil, nil, fmt.Errorf("write header: %w", err)
+	}
+
+	params := &protocol.Params{}
+	if err = pc.ReadMessage(protocol.TypeParams, params); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return pc, token, params, nil
+}
+
+// serverSession handles a session control connection or starts a data stream.
+// It returns true if the connection was a control one, and it's already finished.
+func serverSession(pc *protocol.Conn, params *protocol.Params) (bool, error) {
+	if params.Session != 0 {
+		params.Duration = testAccTimeout / 2
+		if err := pc.WriteMessage(protocol.TypeParams, params); err != nil {
+			return false, err
+		}
+
+		return false, pc.WriteMessage(protocol.TypeStart, &protocol.Start{Time: time.Now()})
+	}
+
+	params.Session, params.ClientIP = 1, testClientIP
+	if err := pc.WriteMessage(protocol.TypeParams, params); err != nil {
+		return true, err
+	}
+
+	_, err := pc.Echo(nil)
+	return true, err
+}
+
 func TestNew(t *testing.T) {
 	testCases := []struct {
 		name      string
 		host      string
 		port      uint16
+		streams   int
+		udp       bool
+		size      int
+		format    string
+		tls       string
+		cert      string
 		client    string
 		errSubstr string
 	}{
-		{name: "valid", host: "localhost", port: 28082, client: "address: localhost:28082, timeout: 20ms"},
-		{name: "invalid_port", host: "localhost", errSubstr: "invalid port"},
-		{name: "empty_host", port: 28082, errSubstr: "host address is empty"},
+		{name: "valid", host: "localhost", port: 28082, streams: 1, client: "address: localhost:28082, timeout: 20ms"},
+		{name: "invalid_port", host: "localhost", streams: 1, errSubstr: "invalid port"},
+		{name: "empty_host", port: 28082, streams: 1, errSubstr: "host address is empty"},
+		{name: "invalid_streams", host: "localhost", port: 28082, errSubstr: "streams number"},
+		{name: "udp", host: "localhost", port: 28082, streams: 1, udp: true, size: 1000, client: "address: localhost:28082, timeout: 20ms"},
+		{name: "invalid_packet_size", host: "localhost", port: 28082, streams: 1, udp: true, size: 10, errSubstr: "packet size"},
+		{name: "json", host: "localhost", port: 28082, streams: 1, format: FormatJSON, client: "address: localhost:28082, timeout: 20ms"},
+		{name: "csv", host: "localhost", port: 28082, streams: 1, format: FormatCSV, client: "address: localhost:28082, timeout: 20ms"},
+		{name: "invalid_format", host: "localhost", port: 28082, streams: 1, format: "xml", errSubstr: "invalid output format"},
+		{name: "tls", host: "localhost", port: 28082, streams: 1, tls: strings.Repeat("AB", 32), client: "address: localhost:28082, timeout: 20ms"},
+		{name: "invalid_fingerprint", host: "localhost", port: 28082, streams: 1, tls: "AB:CD", errSubstr: "certificate fingerprint"},
+		{name: "no_certificate_key", host: "localhost", port: 28082, streams: 1, tls: strings.Repeat("AB", 32), cert: "cert.pem", errSubstr: "invalid certificate"},
 	}
 
 	for i := range testCases {
 		tc := testCases[i]
 
 		t.Run(tc.name, func(t *testing.T) {
-			client, err := New(&common.Params{Host: tc.host, Port: tc.port, Timeout: 20 * time.Millisecond, Dot: true})
+			params := &common.Params{
+				Host:       tc.host,
+				Port:       tc.port,
+				Timeout:    20 * time.Millisecond,
+				Streams:    tc.streams,
+				Dot:        true,
+				UDP:        tc.udp,
+				PacketSize: tc.size,
+				Format:     tc.format,
+
+				TLSFingerprint: tc.tls,
+				TLSCert:        tc.cert,
+			}
+			client, err := New(params)
 
 			if err != nil {
 				if tc.errSubstr == "" {
@@ -127,6 +242,14 @@ func TestNew(t *testing.T) {
 			if s := client.String(); s != tc.client {
 				t.Errorf("want %q, got %q", tc.client, s)
 			}
+
+			if tlsOn := tc.tls != ""; client.TLS != tlsOn || (client.tlsConfig != nil) != tlsOn {
+				t.Errorf("want tls %v, got %v", tlsOn, client.TLS)
+			}
+
+			if dot := client.Format == FormatText; client.Dot != dot {
+				t.Errorf("want dot %v, got %v", dot, client.Dot)
+			}
 		})
 	}
 }
@@ -135,10 +258,11 @@ func TestClient_Download(t *testing.T) {
 	const size = int64(128 * common.KB)
 
 	srv, err := createServer(t, func(conn net.Conn) error {
+		pc := protocol.NewConn(conn)
 		data := make([]byte, size)
 		buffer := bytes.NewReader(data)
 
-		n, err := io.Copy(conn, buffer)
+		n, err := io.Copy(pc.Writer(), buffer)
 
 		if err != nil {
 			return err
@@ -148,7 +272,12 @@ func TestClient_Download(t *testing.T) {
 			return fmt.Errorf("failed to write buffer: %d != %d", n, size)
 		}
 
-		return nil
+		if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Count: uint64(n), Reason: protocol.ReasonDuration}); err != nil {
+			return err
+		}
+
+		_, err = pc.ReadResult(nil)
+		return err
 	})
 
 	if err != nil {
@@ -172,37 +301,42 @@ func TestClient_Download(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
 
-	count, err := client.download(ctx, conn)
+	report, err := client.download(ctx, protocol.NewConn(conn), nil)
 	if err != nil {
-		t.Errorf("failed download: %v", err)
+		t.Fatalf("failed download: %v", err)
 	}
 
 	if err = conn.Close(); err != nil {
 		t.Errorf("failed to close connection: %v", err)
 	}
 
-	if count != uint64(size) {
-		t.Errorf("want %d, got %d", size, count)
+	if report.Count != uint64(size) {
+		t.Errorf("want %d, got %d", size, report.Count)
 	}
-
 }
 
 func TestClient_Upload(t *testing.T) {
 	var (
 		total   uint64
+		sent    uint64
 		stopped = make(chan struct{})
 	)
 
 	srv, err := createServer(t, func(conn net.Conn) error {
 		defer close(stopped)
-		n, err := io.Copy(io.Discard, conn)
 
+		pc := protocol.NewConn(conn)
+		w := common.NewCounter(io.Discard)
+
+		end, err := pc.ReadData(w)
 		if err != nil {
 			return err
 		}
 
-		total = uint64(n)
-		return nil
+		report := w.Report()
+		total, sent = report.Count, end.Count
+
+		return pc.WriteMessage(protocol.TypeResult, report)
 	})
 
 	if err != nil {
@@ -223,12 +357,9 @@ func TestClient_Upload(t *testing.T) {
 		t.Fatalf("failed to connect: %v", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testAccTimeout)
-	defer cancel()
-
-	count, err := client.upload(ctx, conn)
+	report, err := client.upload(context.Background(), protocol.NewConn(conn), testAccTimeout, 0, nil)
 	if err != nil {
-		t.Errorf("failed upload: %v", err)
+		t.Fatalf("failed upload: %v", err)
 	}
 
 	if err = conn.Close(); err != nil {
@@ -236,13 +367,17 @@ func TestClient_Upload(t *testing.T) {
 	}
 
 	<-stopped
-	if count != total {
-		t.Errorf("want %d, got %d", total, count)
+	if report.Count != total {
+		t.Errorf("want %d, got %d", total, report.Count)
+	}
+
+	if sent != total {
+		t.Errorf("want sent %d, got %d", total, sent)
 	}
 }
 
 func TestClient_String(t *testing.T) {
-	params := &common.Params{Host: "localhost", Port: 8080, Timeout: 100 * time.Millisecond, Dot: true}
+	params := &common.Params{Host: "localhost", Port: 8080, Timeout: 100 * time.Millisecond, Streams: 1, Dot: true}
 	client, err := New(params)
 
 	if err != nil {
@@ -267,25 +402,12 @@ func TestClient_Handshake(t *testing.T) {
 	}
 
 	srv, err := createServer(t, func(conn net.Conn) error {
-		// read handshake
-		token, err := auth.Verify(conn, tokens)
+		pc, _, params, err := serverHandshake(conn, tokens)
 		if err != nil {
 			return err
 		}
 
-		remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-		if !ok {
-			return common.ErrIPAddress
-		}
-		token.IP = remoteAddr.IP
-
-		// write handshake reply
-		header := token.Sign()
-		if _, err = conn.Write(header); err != nil {
-			return fmt.Errorf("write header: %w", err)
-		}
-
-		return nil
+		return pc.WriteMessage(protocol.TypeParams, params)
 	})
 
 	if err != nil {
@@ -299,21 +421,21 @@ func TestClient_Handshake(t *testing.T) {
 		t.Fatal("failed to get listener address")
 	}
 
-	client := Client{Params: common.Params{Host: addr.IP.String(), Port: uint16(addr.Port)}}
+	client := Client{Params: common.Params{Host: addr.IP.String(), Port: uint16(addr.Port), Timeout: testAccTimeout}}
 	conn, err := net.Dial(addr.Network(), addr.String())
 
 	if err != nil {
 		t.Fatalf("failed to connect: %v", err)
 	}
 
-	clientID, _, err := client.handshake(conn, tokens[1], true)
+	_, params, _, err := client.handshake(conn, tokens[1], true, &protocol.Params{Duration: client.Timeout})
 
 	if err != nil {
 		t.Fatalf("failed handshake: %v", err)
 	}
 
-	if clientID != 1 {
-		t.Errorf("want %d, got %d", 1, clientID)
+	if params.Duration != client.Timeout {
+		t.Errorf("want %v, got %v", client.Timeout, params.Duration)
 	}
 
 	if err = conn.Close(); err != nil {
@@ -326,10 +448,10 @@ func TestClient_Handshake(t *testing.T) {
 	}
 
 	token := &auth.Token{ClientID: 3, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
-	_, _, err = client.handshake(conn, token, true)
+	_, _, _, err = client.handshake(conn, token, true, &protocol.Params{Duration: client.Timeout})
 
-	if err == nil {
-		t.Errorf("error expected")
+	if !errors.Is(err, protocol.ErrRejected) || !errors.Is(err, ErrRejected) {
+		t.Errorf("want %v, got %v", protocol.ErrRejected, err)
 	}
 
 	if err = conn.Close(); err != nil {
@@ -337,101 +459,585 @@ func TestClient_Handshake(t *testing.T) {
 	}
 }
 
-func TestClient_Start(t *testing.T) {
+func TestClient_HandshakeErrors(t *testing.T) {
 	var (
-		stopped = make(chan struct{})
-		tokens  = map[uint16]*auth.Token{
-			1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
-			2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}},
-		}
+		secret    = []byte{0x33, 0x12, 0xa1, 0x8b}
+		tokens    = auth.Tokens{1: {ClientID: 1, Secret: secret}}
+		challenge = bytes.Repeat([]byte{0x42}, 32)
 	)
 
-	srv, err := createServer(t, func(conn net.Conn) error {
-		// read handshake
-		token, err := auth.Verify(conn, tokens)
+	// signReply verifies client's token and replies with a token signed by the secret,
+	// then it replies to client's params with the same ones or the error of the code.
+	signReply := func(pc *protocol.Conn, header, secret []byte, code string) error {
+		identity, err := tokens.Authenticate(&auth.Handshake{Header: header, Challenge: challenge})
 		if err != nil {
+			return errors.Join(err, pc.WriteError(protocol.CodeUnauthorized, ""))
+		}
+
+		token := identity.Token
+		token.IP = net.IPv4(127, 0, 0, 1)
+		token.Secret = secret
+
+		if err = pc.WriteFrame(protocol.TypeAuth, token.Sign()); err != nil {
 			return err
 		}
 
-		remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-		if !ok {
-			return common.ErrIPAddress
+		params := &protocol.Params{}
+		if err = pc.ReadMessage(protocol.TypeParams, params); err != nil {
+			return err
 		}
-		token.IP = remoteAddr.IP
 
-		// write handshake reply
-		header := token.Sign()
-		if _, err = conn.Write(header); err != nil {
-			return fmt.Errorf("write header: %w", err)
+		if code != "" {
+			return pc.WriteError(code, "daily quota is exhausted")
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), testAccTimeout/2)
-		defer cancel()
+		return pc.WriteMessage(protocol.TypeParams, params)
+	}
+
+	testCases := []struct {
+		name   string
+		hello  *protocol.Hello
+		strict bool
+		reply  func(pc *protocol.Conn, header []byte) error
+		err    error
+	}{
+		{
+			name:  "valid",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(pc *protocol.Conn, header []byte) error { return signReply(pc, header, secret, "") },
+		},
+		{
+			name:   "strict",
+			hello:  &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			strict: true,
+			reply:  func(pc *protocol.Conn, header []byte) error { return signReply(pc, header, secret, "") },
+		},
+		{
+			name:   "strict_no_challenge",
+			hello:  &protocol.Hello{Version: protocol.Version, Token: auth.TokenHMAC},
+			strict: true,
+			reply:  func(pc *protocol.Conn, header []byte) error { return signReply(pc, header, secret, "") },
+			err:    ErrServerIdentity,
+		},
+		{
+			name:  "rejected",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(pc *protocol.Conn, _ []byte) error { return pc.WriteError(protocol.CodeUnauthorized, "") },
+			err:   ErrRejected,
+		},
+		{
+			name:  "forbidden",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(pc *protocol.Conn, header []byte) error {
+				return signReply(pc, header, secret, protocol.CodeForbidden)
+			},
+			err: ErrForbidden,
+		},
+		{
+			name:  "invalid_signature",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(pc *protocol.Conn, header []byte) error { return signReply(pc, header, []byte{0x66, 0x6b}, "") },
+			err:   ErrServerIdentity,
+		},
+		{
+			name:  "empty_reply",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(pc *protocol.Conn, _ []byte) error { return pc.WriteFrame(protocol.TypeAuth, nil) },
+			err:   ErrServerIdentity,
+		},
+		{
+			name:  "transport",
+			hello: &protocol.Hello{Version: protocol.Version, Token: auth.TokenChallenge, Challenge: challenge},
+			reply: func(*protocol.Conn, []byte) error { return nil },
+			err:   ErrConnectionFailed,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			srv, err := createServer(t, func(conn net.Conn) error {
+				pc := protocol.NewConn(conn)
 
-		if token.Download {
-			r := common.NewReader(ctx)
-			n, e := io.Copy(conn, r)
+				if _, e := pc.ReadPreamble(); e != nil {
+					return e
+				}
 
-			if e = common.SkipError(e); e != nil {
-				return e
+				if e := pc.WriteMessage(protocol.TypeHello, tc.hello); e != nil {
+					return e
+				}
+
+				header, e := pc.ReadFrame(protocol.TypeAuth)
+				if e != nil {
+					return e
+				}
+
+				return tc.reply(pc, header)
+			})
+
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+
+			defer srv.Stop()
+
+			addr := srv.listener.Addr()
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+
+			defer func() {
+				if e := conn.Close(); e != nil {
+					t.Errorf("failed to close connection: %v", e)
+				}
+			}()
+
+			client := Client{Params: common.Params{Timeout: testAccTimeout, StrictAuth: tc.strict}}
+			token := &auth.Token{ClientID: 1, Secret: secret}
+
+			_, _, _, err = client.handshake(conn, token, true, &protocol.Params{Duration: client.Timeout})
+			if tc.err == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
 			}
-			t.Logf("downloaded %d bytes", n)
-		} else {
-			defer close(stopped)
 
-			w := common.NewWriter(ctx)
-			n, e := io.Copy(w, conn)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("want %v, got %v", tc.err, err)
+			}
+
+			for _, other := range []error{ErrConnectionFailed, ErrRejected, ErrServerIdentity, ErrForbidden} {
+				if other != tc.err && errors.Is(err, other) {
+					t.Errorf("unexpected error kind %v: %v", other, err)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_Start(t *testing.T) {
+	var tokens = map[uint16]*auth.Token{
+		1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+		2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}},
+	}
+
+	testCases := []struct {
+		name    string
+		streams int
+		format  string
+		re      *regexp.Regexp
+	}{
+		{name: "single", streams: 1, re: outRe},
+		{name: "multiple", streams: 3, re: outStreamsRe},
+		{name: "json", streams: 2, format: FormatJSON, re: outJSONRe},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stopped := make(chan struct{})
 
-			if e != nil && !errors.Is(e, common.ErrWriterTimeout) {
+			srv, err := createServer(t, func(conn net.Conn) error {
+				pc, token, params, err := serverHandshake(conn, tokens)
+				if err != nil {
+					return err
+				}
+
+				control, err := serverSession(pc, params)
+				if control || err != nil {
+					close(stopped)
+					return err
+				}
+
+				if token.Download {
+					report, e := pc.Send(context.Background(), params.Duration, params.StreamBytes(params.Stream), nil)
+					t.Logf("downloaded %d bytes", report.Count)
+					return e
+				}
+
+				report, e := pc.Receive(context.Background(), 0, nil)
+				t.Logf("uploaded %d bytes", report.Count)
 				return e
+			})
+
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+
+			defer srv.Stop()
+
+			addr, ok := srv.listener.Addr().(*net.TCPAddr)
+			if !ok {
+				t.Fatal("failed to get listener address")
+			}
+
+			var expectedWriter = &bytes.Buffer{}
+			ctx := context.WithValue(context.Background(), ctxWriterKey, expectedWriter)
+
+			client := Client{
+				Params: common.Params{
+					Host:     addr.IP.String(),
+					Port:     uint16(addr.Port),
+					Timeout:  testAccTimeout * 2,
+					Duration: testAccTimeout / 2,
+					Streams:  tc.streams,
+					Format:   tc.format,
+				},
 			}
-			t.Logf("uploaded %d bytes", n)
+
+			if err = os.Setenv(auth.ClientEnv, testEnv); err != nil {
+				t.Fatalf("failed to set environment variable: %v", err)
+			}
+
+			defer func() {
+				if err = os.Unsetenv(auth.ClientEnv); err != nil {
+					t.Errorf("failed to unset environment variable: %v", err)
+				}
+			}()
+
+			if err = client.Start(ctx); err != nil {
+				t.Fatalf("failed to start client: %v", err)
+			}
+
+			<-stopped
+			if s := expectedWriter.String(); !tc.re.MatchString(s) {
+				t.Errorf("want %q, got %q", tc.re.String(), s)
+			}
+		})
+	}
+}
+
+func TestNewStream(t *testing.T) {
+	var (
+		start  = time.Now()
+		report = &common.Report{Count: 3 * mb, First: start, Last: start.Add(3 * time.Second)}
+		stats  = []*protocol.Stats{
+			{Time: start.Add(time.Second), Count: mb},
+			{Time: start.Add(2 * time.Second), Count: 2 * mb},
+			{Time: start.Add(4 * time.Second), Count: 3 * mb},
 		}
+	)
 
-		return nil
-	})
+	s := newStream(report, stats, nil)
+	if s.Bytes != report.Count || s.Duration != 3*time.Second {
+		t.Errorf("unexpected stream: %d bytes, %s", s.Bytes, s.Duration)
+	}
 
-	if err != nil {
-		t.Fatalf("failed to create server: %v", err)
+	if s.BitsPerSecond != float64(8*mb) {
+		t.Errorf("want %v bits/s, got %v", float64(8*mb), s.BitsPerSecond)
 	}
 
-	defer srv.Stop()
+	expected := []Sample{
+		{Time: stats[0].Time, Bytes: mb, Duration: protocol.StatsInterval, BitsPerSecond: float64(8 * mb)},
+		{Time: stats[1].Time, Bytes: mb, Duration: time.Second, BitsPerSecond: float64(8 * mb)},
+		{Time: stats[2].Time, Bytes: mb, Duration: 2 * time.Second, BitsPerSecond: float64(4 * mb)},
+	}
 
-	addr, ok := srv.listener.Addr().(*net.TCPAddr)
-	if !ok {
-		t.Fatal("failed to get listener address")
+	if n := len(s.Samples); n != len(expected) {
+		t.Fatalf("want %d samples, got %d", len(expected), n)
+	}
+
+	for i := range expected {
+		if *s.Samples[i] != expected[i] {
+			t.Errorf("sample %d: want %+v, got %+v", i, expected[i], *s.Samples[i])
+		}
+	}
+
+	if s = newStream(nil, nil, ErrConnectionFailed); s.Bytes != 0 || s.report != nil || s.Err == nil {
+		t.Errorf("unexpected failed stream: %+v", s)
+	}
+}
+
+func TestNewDirection(t *testing.T) {
+	var (
+		start   = time.Now()
+		stats   = []*protocol.Stats{{Time: start.Add(time.Second), Count: mb}}
+		streams = []*Stream{
+			newStream(&common.Report{Count: mb, First: start, Last: start.Add(time.Second)}, stats, nil),
+			newStream(&common.Report{Count: mb, First: start, Last: start.Add(2 * time.Second)}, stats, nil),
+			newStream(nil, nil, ErrConnectionFailed),
+		}
+	)
+
+	d := newDirection(streams, nil, ErrConnectionFailed)
+	if d.Bytes != 2*mb || d.Duration != 2*time.Second {
+		t.Errorf("unexpected direction: %d bytes, %s", d.Bytes, d.Duration)
+	}
+
+	if len(d.Samples) != 1 {
+		t.Fatalf("want 1 sample, got %d", len(d.Samples))
 	}
 
-	var expectedWriter = &bytes.Buffer{}
-	ctx := context.WithValue(context.Background(), ctxWriterKey, expectedWriter)
+	if s := d.Samples[0]; s.Bytes != 2*mb || s.BitsPerSecond != float64(16*mb) {
+		t.Errorf("unexpected sample: %+v", *s)
+	}
+}
 
-	client := Client{
-		Params: common.Params{
-			Host:    addr.IP.String(),
-			Port:    uint16(addr.Port),
-			Timeout: testAccTimeout / 2,
+func TestResult_WriteText(t *testing.T) {
+	var (
+		start  = time.Now()
+		report = &common.Report{Count: mb, First: start, Last: start.Add(time.Second)}
+	)
+
+	testCases := []struct {
+		name     string
+		result   *Result
+		expected string
+	}{
+		{
+			name:     "empty",
+			result:   &Result{IP: "127.0.0.1"},
+			expected: "IP address:     127.0.0.1\nIdle latency:   no data\n",
+		},
+		{
+			name: "streams",
+			result: &Result{
+				IP:       "127.0.0.1",
+				Download: newDirection([]*Stream{newStream(report, nil, nil), newStream(nil, nil, ErrConnectionFailed)}, nil, ErrConnectionFailed),
+			},
+			expected: "IP address:     127.0.0.1\nIdle latency:   no data\n" +
+				"Download speed: 8.00 MBits/s (partial)\n  stream 1      8.00 MBits/s\n  stream 2      failed\n" +
+				"  latency       no data\n",
 		},
+		{
+			name: "udp",
+			result: &Result{
+				IP:  "127.0.0.1",
+				UDP: true,
+				Upload: newUDPDirection(
+					&common.UDPReport{Report: *report, Sent: 4, Received: 4}, nil,
+				),
+			},
+			expected: "IP address:     127.0.0.1\nIdle latency:   no data\n" +
+				"Upload speed:   8.00 MBits/s\n  datagrams     loss 0.00% (0/4), out-of-order 0, duplicates 0, jitter 0.00 ms\n",
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if err := tc.result.WriteText(&buf); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			if s := buf.String(); s != tc.expected {
+				t.Errorf("want %q, got %q", tc.expected, s)
+			}
+		})
+	}
+}
+
+func TestResult_WriteJSON(t *testing.T) {
+	var (
+		start  = time.Now()
+		report = &common.Report{Count: mb, First: start, Last: start.Add(time.Second)}
+		result = &Result{
+			Schema:   ResultSchema,
+			Version:  int(protocol.Version),
+			Server:   "localhost:28082",
+			IP:       "127.0.0.1",
+			Time:     start,
+			Streams:  2,
+			Duration: time.Second,
+			Download: newDirection(
+				[]*Stream{newStream(report, nil, nil), newStream(nil, nil, ErrConnectionFailed)}, nil, ErrConnectionFailed,
+			),
+			Error: ErrConnectionFailed.Error(),
+		}
+		buf bytes.Buffer
+	)
+
+	if err := result.WriteJSON(&buf); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("want one line, got %d", n)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+
+	if v := doc["schema"]; v != float64(ResultSchema) {
+		t.Errorf("want schema %d, got %v", ResultSchema, v)
+	}
+
+	if v := doc["version"]; v != float64(protocol.Version) {
+		t.Errorf("want version %d, got %v", protocol.Version, v)
+	}
+
+	if _, ok := doc["upload"]; ok {
+		t.Error("unexpected upload")
 	}
+
+	download, ok := doc["download"].(map[string]any)
+	if !ok {
+		t.Fatalf("no download: %v", doc)
+	}
+
+	if v := download["bits_per_second"]; v != float64(8*mb) {
+		t.Errorf("want %d bits/s, got %v", 8*mb, v)
+	}
+
+	if v := download["error"]; v != ErrConnectionFailed.Error() {
+		t.Errorf("want error %q, got %v", ErrConnectionFailed, v)
+	}
+
+	streams, ok := download["streams"].([]any)
+	if !ok || len(streams) != 2 {
+		t.Fatalf("unexpected streams: %v", download["streams"])
+	}
+
+	if s := streams[0].(map[string]any); s["error"] != nil || s["duration"] != float64(time.Second) {
+		t.Errorf("unexpected stream: %v", s)
+	}
+}
+
+func testResult(t *testing.T) *Result {
+	start, err := time.Parse(time.RFC3339, "2024-03-01T10:00:00Z")
 	if err != nil {
-		t.Fatalf("failed to connect: %v", err)
+		t.Fatalf("failed to parse time: %v", err)
+	}
+
+	report := &common.Report{Count: mb, First: start, Last: start.Add(time.Second)}
+	return &Result{
+		Server:   "local host:28082",
+		ClientID: 1,
+		IP:       "127.0.0.1",
+		Time:     start,
+		Streams:  1,
+		Latency:  &common.Latency{Count: 1, Median: time.Millisecond},
+		Download: newDirection([]*Stream{newStream(report, nil, nil)}, &common.Latency{Count: 1, Median: time.Millisecond}, nil),
+		Upload:   newDirection([]*Stream{newStream(nil, nil, errors.New("broken \"pipe\"\nreset"))}, nil, ErrConnectionFailed),
+	}
+}
+
+func TestResult_WriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+
+	result := testResult(t)
+	for _, header := range []bool{true, false} {
+		if err := result.WriteCSV(&buf, header); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	expected := strings.Join(csvHeader, ",") + "\n" +
+		"2024-03-01T10:00:00Z,local host:28082,1,127.0.0.1,download,false,1,1048576,1000000000,8388608.00,1000000,1000000,0,0,,,,,,\n" +
+		"2024-03-01T10:00:00Z,local host:28082,1,127.0.0.1,upload,false,1,0,0,0.00,1000000,,,,,,,,,connection failed\n"
+	expected += strings.Join(strings.Split(expected, "\n")[1:], "\n")
+
+	if s := buf.String(); s != expected {
+		t.Errorf("want %q, got %q", expected, s)
+	}
+
+	buf.Reset()
+	if err := (&Result{Error: "failed"}).WriteCSV(&buf, false); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if s := buf.String(); !strings.HasSuffix(s, ",,failed\n") {
+		t.Errorf("unexpected empty result: %q", s)
+	}
+}
+
+func TestResult_WriteInflux(t *testing.T) {
+	var buf bytes.Buffer
+
+	result := testResult(t)
+	result.Upload.Error = "broken \"pipe\"\nreset"
+
+	if err := result.WriteInflux(&buf); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	expected := `spts,server=local\ host:28082,client_id=1,direction=download udp=false,streams=1i,bytes=1048576i,` +
+		`duration=1000000000i,bits_per_second=8388608.00,idle_latency_median=1000000i,latency_median=1000000i,` +
+		`latency_p95=0i,latency_jitter=0i 1709287200000000000` + "\n" +
+		`spts,server=local\ host:28082,client_id=1,direction=upload udp=false,streams=1i,bytes=0i,` +
+		`duration=0i,bits_per_second=0.00,idle_latency_median=1000000i,error="broken \"pipe\"; reset" 1709287200000000000` + "\n"
+
+	if s := buf.String(); s != expected {
+		t.Errorf("want %q, got %q", expected, s)
+	}
+}
+
+func TestClient_WriteResult(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "result.csv")
+	client := &Client{Params: common.Params{Format: FormatCSV, Output: output}}
+	result := testResult(t)
+
+	for i := 0; i < 2; i++ {
+		if err := client.writeResult(context.Background(), result); err != nil {
+			t.Fatalf("failed to write result: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if n := len(lines); n != 5 {
+		t.Fatalf("want 5 lines, got %d", n)
 	}
 
-	if err = os.Setenv(auth.ClientEnv, testEnv); err != nil {
-		t.Fatalf("failed to set environment variable: %v", err)
+	if lines[0] != strings.Join(csvHeader, ",") {
+		t.Errorf("unexpected header: %q", lines[0])
 	}
 
+	if h := strings.Count(string(data), "time,server"); h != 1 {
+		t.Errorf("want one header, got %d", h)
+	}
+}
+
+func TestClient_WriteResultStdout(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		client = &Client{Params: common.Params{Format: FormatCSV}}
+		result = testResult(t)
+	)
+
+	// not a file writer always gets the header
+	if err := client.writeResult(WithWriter(context.Background(), &buf), result); err != nil {
+		t.Fatalf("failed to write result: %v", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), strings.Join(csvHeader, ",")) {
+		t.Errorf("no header: %q", buf.String())
+	}
+
+	// stdout redirected to a file by ">>"
+	f, err := os.OpenFile(filepath.Join(t.TempDir(), "result.csv"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open output: %v", err)
+	}
 	defer func() {
-		if err = os.Unsetenv(auth.ClientEnv); err != nil {
-			t.Errorf("failed to unset environment variable: %v", err)
+		if e := f.Close(); e != nil {
+			t.Errorf("failed to close output: %v", e)
 		}
 	}()
 
-	if err = client.Start(ctx); err != nil {
-		t.Fatalf("failed to start client: %v", err)
+	ctx := WithWriter(context.Background(), f)
+	for i := 0; i < 2; i++ {
+		if err = client.writeResult(ctx, result); err != nil {
+			t.Fatalf("failed to write result: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
 	}
 
-	<-stopped
-	if s := expectedWriter.String(); !outRe.MatchString(s) {
-		t.Errorf("want %q, got %q", outRe.String(), s)
+	if h := strings.Count(string(data), "time,server"); h != 1 {
+		t.Errorf("want one header, got %d", h)
 	}
 }
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats of the client's result.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatInflux = "influx"
+)
+
+// Measurement is a measurement name of InfluxDB line protocol output.
+const Measurement = "spts"
+
+// ErrFormat is returned for unknown output format.
+var ErrFormat = errors.New("invalid output format")
+
+// formats are result writers by output format names,
+// header is true if the output is empty, then CSV writer adds its header.
+var formats = map[string]func(r *Result, w io.Writer, header bool) error{
+	FormatText:   func(r *Result, w io.Writer, _ bool) error { return r.WriteText(w) },
+	FormatJSON:   func(r *Result, w io.Writer, _ bool) error { return r.WriteJSON(w) },
+	FormatCSV:    (*Result).WriteCSV,
+	FormatInflux: func(r *Result, w io.Writer, _ bool) error { return r.WriteInflux(w) },
+}
+
+// csvHeader is a header of CSV output, one row is written for every direction.
+var csvHeader = []string{
+	"time", "server", "client_id", "ip", "direction", "udp", "streams", "bytes", "duration_ns", "bits_per_second",
+	"idle_latency_median_ns", "latency_median_ns", "latency_p95_ns", "latency_jitter_ns",
+	"sent", "lost", "out_of_order", "duplicates", "jitter_ns", "error",
+}
+
+// WithWriter returns a context with the writer of client's output.
+// It's used instead of stdout if the client has no output file.
+func WithWriter(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, ctxWriterKey, w)
+}
+
+// writeResult writes the result in the client's format to the output file in append mode
+// or to the context writer if the file is not set.
+func (c *Client) writeResult(ctx context.Context, result *Result) error {
+	write, ok := formats[c.Format]
+	if !ok {
+		write = formats[FormatText]
+	}
+
+	if c.Output == "" {
+		w := progressWriter(ctx)
+		return write(result, w, emptyOutput(w))
+	}
+
+	f, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open output: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Join(fmt.Errorf("stat output: %w", err), f.Close())
+	}
+
+	return errors.Join(write(result, f, info.Size() == 0), f.Close())
+}
+
+// emptyOutput returns false if the writer is a not empty regular file,
+// e.g. stdout is redirected by ">>" to a file with previous results.
+func emptyOutput(w io.Writer) bool {
+	f, ok := w.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return true
+	}
+
+	info, err := f.Stat()
+	return err != nil || !info.Mode().IsRegular() || info.Size() == 0
+}
+
+// directions returns not nil directions of the result by their names.
+func (r *Result) directions() ([]string, []*Direction) {
+	var (
+		names      []string
+		directions []*Direction
+	)
+
+	if r.Download != nil {
+		names, directions = append(names, "download"), append(directions, r.Download)
+	}
+
+	if r.Upload != nil {
+		names, directions = append(names, "upload"), append(directions, r.Upload)
+	}
+
+	return names, directions
+}
+
+// WriteCSV writes a row for every direction of the result, the header is written before them if it's true.
+// The result without directions is written as one row with an empty direction and the error.
+func (r *Result) WriteCSV(w io.Writer, header bool) error {
+	cw := csv.NewWriter(w)
+
+	if header {
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	names, directions := r.directions()
+	if len(directions) == 0 {
+		names, directions = []string{""}, []*Direction{{Error: r.Error}}
+	}
+
+	for i, d := range directions {
+		var (
+			latency = d.Latency
+			udp     = d.Datagrams
+			row     = []string{
+				r.Time.Format(time.RFC3339Nano), r.Server, strconv.Itoa(int(r.ClientID)), r.IP, names[i],
+				strconv.FormatBool(r.UDP), strconv.Itoa(r.Streams), strconv.FormatUint(d.Bytes, 10),
+				strconv.FormatInt(int64(d.Duration), 10), strconv.FormatFloat(d.BitsPerSecond, 'f', 2, 64),
+			}
+		)
+
+		if r.Latency != nil {
+			row = append(row, strconv.FormatInt(int64(r.Latency.Median), 10))
+		} else {
+			row = append(row, "")
+		}
+
+		if latency != nil {
+			row = append(row,
+				strconv.FormatInt(int64(latency.Median), 10), strconv.FormatInt(int64(latency.P95), 10),
+				strconv.FormatInt(int64(latency.Jitter), 10),
+			)
+		} else {
+			row = append(row, "", "", "")
+		}
+
+		if udp != nil {
+			row = append(row,
+				strconv.FormatUint(udp.Sent, 10), strconv.FormatUint(udp.Lost, 10),
+				strconv.FormatUint(udp.OutOfOrder, 10), strconv.FormatUint(udp.Duplicates, 10),
+				strconv.FormatInt(int64(udp.Jitter), 10),
+			)
+		} else {
+			row = append(row, "", "", "", "", "")
+		}
+
+		if err := cw.Write(append(row, d.Error)); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteInflux writes a line of InfluxDB line protocol for every direction of the result
+// with tags server, client_id and direction. The result without directions is written
+// as one line with the error field. Durations are integer nanoseconds.
+func (r *Result) WriteInflux(w io.Writer) error {
+	names, directions := r.directions()
+	if len(directions) == 0 {
+		names, directions = []string{"none"}, []*Direction{{Error: r.Error}}
+	}
+
+	for i, d := range directions {
+		var b strings.Builder
+
+		fmt.Fprintf(
+			&b, "%s,server=%s,client_id=%d,direction=%s udp=%t,streams=%di,bytes=%di,duration=%di,bits_per_second=%.2f",
+			Measurement, influxTag(r.Server), r.ClientID, names[i], r.UDP, r.Streams, d.Bytes, d.Duration, d.BitsPerSecond,
+		)
+
+		if r.Latency != nil {
+			fmt.Fprintf(&b, ",idle_latency_median=%di", r.Latency.Median)
+		}
+
+		if l := d.Latency; l != nil {
+			fmt.Fprintf(&b, ",latency_median=%di,latency_p95=%di,latency_jitter=%di", l.Median, l.P95, l.Jitter)
+		}
+
+		if u := d.Datagrams; u != nil {
+			fmt.Fprintf(
+				&b, ",sent=%di,lost=%di,out_of_order=%di,duplicates=%di,jitter=%di,loss=%.4f",
+				u.Sent, u.Lost, u.OutOfOrder, u.Duplicates, u.Jitter, u.Loss(),
+			)
+		}
+
+		if d.Error != "" {
+			fmt.Fprintf(&b, ",error=%s", influxString(d.Error))
+		}
+
+		fmt.Fprintf(&b, " %d\n", r.Time.UnixNano())
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// influxTag escapes a tag value of InfluxDB line protocol.
+func influxTag(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// influxString quotes a string field value of InfluxDB line protocol, new lines are replaced.
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", "; ").Replace(s) + `"`
+}
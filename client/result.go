@@ -0,0 +1,239 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// ResultSchema is a version of the result JSON schema,
+// it's incremented only for incompatible changes like removed or renamed fields.
+const ResultSchema = 1
+
+// Result is a test result, it can be partial if the test failed.
+// ClientID is the token's client ID, IP is the client's address as the server sees it (empty for old servers),
+// Latency is measured before the test.
+// Durations are in nanoseconds in JSON, Error is a description of the test failure.
+type Result struct {
+	Schema   int             `json:"schema"`
+	Version  int             `json:"version"`
+	Server   string          `json:"server"`
+	ClientID uint16          `json:"client_id"`
+	IP       string          `json:"ip"`
+	Time     time.Time       `json:"time"`
+	UDP      bool            `json:"udp"`
+	Streams  int             `json:"streams"`
+	Duration time.Duration   `json:"duration"`
+	Latency  *common.Latency `json:"latency,omitempty"`
+	Download *Direction      `json:"download,omitempty"`
+	Upload   *Direction      `json:"upload,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Direction is a receiver side result of the test in one direction, it's partial if Err is not nil.
+// Latency is measured during the test, Datagrams are statistics of UDP flow.
+type Direction struct {
+	Bytes         uint64            `json:"bytes"`
+	Duration      time.Duration     `json:"duration"`
+	BitsPerSecond float64           `json:"bits_per_second"`
+	Streams       []*Stream         `json:"streams,omitempty"`
+	Samples       []*Sample         `json:"samples,omitempty"`
+	Latency       *common.Latency   `json:"latency,omitempty"`
+	Datagrams     *common.UDPReport `json:"datagrams,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Err           error             `json:"-"`
+}
+
+// Stream is a receiver side result of one data stream.
+type Stream struct {
+	Bytes         uint64        `json:"bytes"`
+	Duration      time.Duration `json:"duration"`
+	BitsPerSecond float64       `json:"bits_per_second"`
+	Samples       []*Sample     `json:"samples,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	Err           error         `json:"-"`
+	report        *common.Report
+}
+
+// Sample is a receiver side result of one statistics interval.
+type Sample struct {
+	Time          time.Time     `json:"time"`
+	Bytes         uint64        `json:"bytes"`
+	Duration      time.Duration `json:"duration"`
+	BitsPerSecond float64       `json:"bits_per_second"`
+}
+
+// Err returns errors of both directions.
+func (r *Result) Err() error {
+	var errs []error
+
+	for _, d := range []*Direction{r.Download, r.Upload} {
+		if d != nil {
+			errs = append(errs, d.Err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// newResult returns a result without test data.
+func (c *Client) newResult() *Result {
+	return &Result{Schema: ResultSchema, Version: int(protocol.Version), Server: c.Address(), Time: time.Now()}
+}
+
+// errorString returns the error description or an empty string for nil error.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Speed returns the direction speed as a string.
+func (d *Direction) Speed() string {
+	return common.Speed(d.Duration, d.Bytes, common.SpeedSeconds)
+}
+
+// Speed returns the stream speed as a string.
+func (s *Stream) Speed() string {
+	return common.Speed(s.Duration, s.Bytes, common.SpeedSeconds)
+}
+
+// newStream returns a stream result by receiver's report and its cumulative statistics.
+// The report is nil if the stream failed before data transfer.
+func newStream(report *common.Report, stats []*protocol.Stats, err error) *Stream {
+	s := &Stream{Error: errorString(err), Err: err, report: report}
+
+	if report != nil {
+		s.Bytes, s.Duration, s.BitsPerSecond = report.Count, report.Duration(), report.BitsPerSecond()
+	}
+
+	var prev *protocol.Stats
+	for _, st := range stats {
+		sample := &Sample{Time: st.Time, Bytes: st.Count, Duration: protocol.StatsInterval}
+
+		if prev != nil {
+			sample.Bytes -= min(prev.Count, st.Count)
+			sample.Duration = st.Time.Sub(prev.Time)
+		}
+
+		sample.BitsPerSecond = common.BitsPerSecond(sample.Duration, sample.Bytes)
+		s.Samples = append(s.Samples, sample)
+		prev = st
+	}
+
+	return s
+}
+
+// newDirection aggregates results of parallel streams in one direction.
+func newDirection(streams []*Stream, latency *common.Latency, err error) *Direction {
+	reports := make([]*common.Report, len(streams))
+
+	for i, s := range streams {
+		reports[i] = s.report
+	}
+
+	total := common.Aggregate(reports)
+	d := &Direction{
+		Bytes:         total.Count,
+		Duration:      total.Duration(),
+		BitsPerSecond: total.BitsPerSecond(),
+		Streams:       streams,
+		Latency:       latency,
+		Error:         errorString(err),
+		Err:           err,
+	}
+
+	// samples of the same interval are summed up
+	for _, s := range streams {
+		for i, sample := range s.Samples {
+			if i == len(d.Samples) {
+				d.Samples = append(d.Samples, &Sample{Time: sample.Time})
+			}
+
+			ds := d.Samples[i]
+			ds.Bytes += sample.Bytes
+			ds.Duration = max(ds.Duration, sample.Duration)
+			ds.BitsPerSecond += sample.BitsPerSecond
+		}
+	}
+
+	return d
+}
+
+// newUDPDirection returns a result of UDP flow by receiver's report.
+func newUDPDirection(report *common.UDPReport, err error) *Direction {
+	return &Direction{
+		Bytes:         report.Count,
+		Duration:      report.Duration(),
+		BitsPerSecond: report.BitsPerSecond(),
+		Datagrams:     report,
+		Error:         errorString(err),
+		Err:           err,
+	}
+}
+
+// WriteJSON writes the result as one line JSON document.
+func (r *Result) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteText writes the result as a human-readable text.
+func (r *Result) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "IP address:     %s\nIdle latency:   %s\n", r.IP, r.Latency)
+	if err != nil {
+		return err
+	}
+
+	if r.Download != nil {
+		if err = r.Download.writeText(w, "Download speed: ", r.UDP); err != nil {
+			return err
+		}
+	}
+
+	if r.Upload != nil {
+		return r.Upload.writeText(w, "Upload speed:   ", r.UDP)
+	}
+
+	return nil
+}
+
+// writeText writes a speed line and lines for every stream if there are several ones,
+// then latency or datagrams statistics. Partial results of failed tests are marked.
+func (d *Direction) writeText(w io.Writer, prefix string, udp bool) error {
+	var suffix string
+
+	if d.Err != nil {
+		suffix = " (partial)"
+	}
+
+	if _, err := fmt.Fprintf(w, "%s%s%s\n", prefix, d.Speed(), suffix); err != nil {
+		return err
+	}
+
+	if udp {
+		_, err := fmt.Fprintf(w, "  datagrams     %s\n", d.Datagrams)
+		return err
+	}
+
+	if len(d.Streams) > 1 {
+		for i, s := range d.Streams {
+			speed := "failed"
+			if s.report != nil {
+				speed = s.Speed()
+			}
+
+			if _, err := fmt.Fprintf(w, "  stream %-3d    %s\n", i+1, speed); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "  latency       %s\n", d.Latency)
+	return err
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/z0rr0/spts/auth"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// Latency probes parameters.
+const (
+	probeInterval = 50 * time.Millisecond
+	idleProbes    = 10
+)
+
+// session is a test session, it's held by the control connection
+// and all data streams join to it on the server side.
+type session struct {
+	conn    net.Conn
+	pc      *protocol.Conn
+	params  *protocol.Params
+	version uint8
+	seq     uint64
+}
+
+// open connects to the server and opens a new test session.
+func (c *Client) open(ctx context.Context, token *auth.Token) (*session, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &protocol.Params{
+		Duration:   c.Duration,
+		Bytes:      c.Bytes,
+		Streams:    max(c.Streams, 1),
+		UDP:        c.UDP,
+		Bitrate:    c.Bitrate,
+		PacketSize: c.PacketSize,
+	}
+
+	pc, params, version, err := c.handshake(conn, streamToken(token), false, params)
+	if err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+
+	if c.UDP && !params.UDP {
+		return nil, errors.Join(ErrUDPUnsupported, conn.Close())
+	}
+
+	// the session is held until all streams are finished
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, errors.Join(ErrConnectionFailed, fmt.Errorf("deadline: %w", err), conn.Close())
+	}
+
+	slog.Debug(
+		"session",
+		"id", params.Session, "streams", params.Streams, "duration", params.Duration, "bytes", params.Bytes,
+		"udp", params.UDP, "bitrate", params.Bitrate, "packet_size", params.PacketSize,
+	)
+	return &session{conn: conn, pc: pc, params: params, version: version}, nil
+}
+
+// latency sends echo probes over the control connection every probeInterval
+// until count probes are done (zero count means no limit) or the context is done.
+// Every probe must be replied during timeout. Received samples are returned even if the error is not nil.
+// Servers without latency probes support return no samples.
+func (s *session) latency(ctx context.Context, count int, timeout time.Duration) ([]time.Duration, error) {
+	var samples []time.Duration
+
+	if s.version < protocol.VersionLatency {
+		return samples, nil
+	}
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return samples, errors.Join(ErrConnectionFailed, fmt.Errorf("deadline: %w", err))
+		}
+
+		s.seq++
+		rtt, err := s.pc.Ping(s.seq)
+		if err != nil {
+			return samples, errors.Join(ErrConnectionFailed, fmt.Errorf("latency: %w", err))
+		}
+
+		samples = append(samples, rtt)
+		if count > 0 && len(samples) >= count {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return samples, s.conn.SetDeadline(time.Time{})
+		case <-ticker.C:
+		}
+	}
+
+	return samples, s.conn.SetDeadline(time.Time{})
+}
+
+// close finishes the session and closes its control connection.
+func (s *session) close() error {
+	err := s.pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration})
+	return errors.Join(err, s.conn.Close())
+}
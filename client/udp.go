@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// ErrUDPUnsupported is returned when the server didn't accept UDP session.
+var ErrUDPUnsupported = errors.New("server doesn't support UDP")
+
+// runUDP does UDP flows in both directions and sets their results.
+func (c *Client) runUDP(ctx context.Context, ss *session, result *Result) error {
+	var dialer net.Dialer
+
+	// datagrams are sent to the same address as the session control connection
+	conn, err := dialer.DialContext(ctx, "udp", ss.conn.RemoteAddr().String())
+	if err != nil {
+		return errors.Join(ErrConnectionFailed, fmt.Errorf("dial udp: %w", err))
+	}
+
+	defer func() {
+		if e := conn.Close(); e != nil {
+			slog.Error("udp", "close_error", e)
+		}
+	}()
+
+	for _, download := range []bool{true, false} {
+		if !ss.params.Allowed(download) {
+			slog.Warn("direction is not allowed by the server", "download", download)
+			continue
+		}
+
+		report, e := c.udpFlow(ctx, ss, conn, download)
+		if report == nil {
+			return e
+		}
+
+		if download {
+			result.Download = newUDPDirection(report, e)
+		} else {
+			result.Upload = newUDPDirection(report, e)
+		}
+
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// udpFlow does UDP flow in one direction over the session control connection
+// and returns receiver side report. The report can be partial if the error is not nil.
+func (c *Client) udpFlow(ctx context.Context, ss *session, conn net.Conn, download bool) (*common.UDPReport, error) {
+	var (
+		report *common.UDPReport
+		err    error
+	)
+
+	// the control connection is busy until the flow result
+	if err = ss.conn.SetDeadline(time.Now().Add(ss.params.Duration + 2*c.Timeout + protocol.Linger)); err != nil {
+		return nil, errors.Join(ErrConnectionFailed, fmt.Errorf("deadline: %w", err))
+	}
+
+	defer func() {
+		if e := ss.conn.SetDeadline(time.Time{}); e != nil {
+			slog.Error("session", "deadline_error", e)
+		}
+	}()
+
+	if err = ss.pc.WriteMessage(protocol.TypeFlow, &protocol.Flow{Download: download}); err != nil {
+		return nil, errors.Join(ErrConnectionFailed, err)
+	}
+
+	if download {
+		report, err = c.udpReceive(ss, conn)
+	} else {
+		report, err = c.udpSend(ctx, ss, conn)
+	}
+
+	if err != nil {
+		return report, errors.Join(ErrConnectionFailed, fmt.Errorf("udp download=%v: %w", download, err))
+	}
+
+	slog.Debug("udp", "download", download, "count", common.ByteSize(report.Count), "lost", report.Lost)
+	return report, nil
+}
+
+// udpSend sends datagrams to the server and returns its report.
+func (c *Client) udpSend(ctx context.Context, ss *session, conn net.Conn) (*common.UDPReport, error) {
+	if err := ss.pc.ReadMessage(protocol.TypeStart, &protocol.Start{}); err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	return ss.pc.SendFlow(ctx, func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}, ss.params)
+}
+
+// udpReceive registers the client's address and counts the server's datagrams until its end message.
+func (c *Client) udpReceive(ss *session, conn net.Conn) (*common.UDPReport, error) {
+	var (
+		counter  = protocol.NewDatagramCounter(ss.params.FlowDatagrams(), 0)
+		started  = make(chan struct{})
+		readDone = make(chan struct{})
+		regDone  = make(chan struct{})
+	)
+
+	go func() {
+		defer close(readDone)
+		readDatagrams(conn, ss.params.Session, counter)
+	}()
+
+	go func() {
+		defer close(regDone)
+		register(conn, ss.params.Session, started)
+	}()
+
+	defer func() {
+		// stop reading, the connection is used for the next flow
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			slog.Error("udp", "deadline_error", err)
+		}
+		<-readDone
+
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			slog.Error("udp", "deadline_error", err)
+		}
+	}()
+
+	err := ss.pc.ReadMessage(protocol.TypeStart, &protocol.Start{})
+	close(started)
+	<-regDone
+
+	if err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	return ss.pc.ReceiveFlow(counter)
+}
+
+// register sends registration datagrams every protocol.RegisterInterval until the stop channel is closed.
+func register(conn net.Conn, session uint64, stop <-chan struct{}) {
+	var (
+		buf    = make([]byte, protocol.DatagramHeaderSize)
+		ticker = time.NewTicker(protocol.RegisterInterval)
+	)
+	defer ticker.Stop()
+
+	for {
+		d := &protocol.Datagram{Session: session, Time: time.Now()}
+		d.Encode(buf)
+
+		if _, err := conn.Write(buf); err != nil {
+			slog.Debug("udp", "register_error", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readDatagrams counts the session datagrams until the connection reading fails.
+func readDatagrams(conn net.Conn, session uint64, counter *protocol.DatagramCounter) {
+	buf := make([]byte, protocol.MaxDatagramSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // ICMP errors of the connected socket
+		}
+
+		d, err := protocol.DecodeDatagram(buf[:n])
+		if err != nil || d.Session != session {
+			continue
+		}
+
+		counter.Add(d, n, time.Now())
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -31,9 +30,6 @@ const (
 const (
 	// MaxPortNumber is a maximum port number.
 	MaxPortNumber uint64 = 65535
-
-	// TimeoutMultiplier is a multiplier for timeout to read all data.
-	TimeoutMultiplier time.Duration = 5
 )
 
 var (
@@ -42,6 +38,9 @@ var (
 
 	// ErrIPAddress is returned when the remote address is not available.
 	ErrIPAddress = errors.New("failed to get remote address")
+
+	// ErrInvalidSize is returned when the data size is invalid.
+	ErrInvalidSize = errors.New("invalid size")
 )
 
 // Starter is a program start interface.
@@ -63,13 +62,121 @@ func ParsePort(value string) (uint16, error) {
 	return uint16(port), nil
 }
 
+// unit is a value suffix and its multiplier.
+type unit struct {
+	suffix string
+	size   float64
+}
+
+var (
+	sizeUnits    = []unit{{"GB", GB}, {"MB", MB}, {"KB", KB}, {"B", 1}}
+	bitrateUnits = []unit{{"G", GB}, {"M", MB}, {"K", KB}}
+)
+
+// ParseSize parses a data size like "500MB", supported units are B, KB, MB and GB.
+func ParseSize(value string) (uint64, error) {
+	return parseUnits(value, sizeUnits)
+}
+
+// ParseBitrate parses a bitrate in bits per second like "100M", supported units are K, M and G.
+func ParseBitrate(value string) (uint64, error) {
+	return parseUnits(value, bitrateUnits)
+}
+
+// parseUnits parses a non-negative number with an optional unit suffix.
+func parseUnits(value string, units []unit) (uint64, error) {
+	var (
+		multiplier = 1.0
+		upperValue = strings.ToUpper(strings.TrimSpace(value))
+	)
+
+	for _, u := range units {
+		if strings.HasSuffix(upperValue, u.suffix) {
+			multiplier = u.size
+			upperValue = strings.TrimSpace(strings.TrimSuffix(upperValue, u.suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(upperValue, 64)
+	if err != nil {
+		return 0, errors.Join(ErrInvalidSize, fmt.Errorf("parse %q: %w", value, err))
+	}
+
+	if number < 0 {
+		return 0, errors.Join(ErrInvalidSize, fmt.Errorf("negative value: %s", value))
+	}
+
+	return uint64(number * multiplier), nil
+}
+
 // Params is a program parameters.
+// Timeout is used for connection and handshake, Duration is a test duration for every direction,
+// Bytes is an optional data size limit for every direction.
+// UDP mode uses Bitrate (bits per second) and PacketSize (bytes) of datagrams instead of TCP streams,
+// MaxBitrate is a server's limit of clients' bitrates.
+// Format is a client's result output format, Output is an optional file to append results to.
+// Metrics is an optional server's HTTP address of Prometheus metrics, Audit is an optional sessions log file.
+// Admin is an optional server's HTTP address of runtime management, it accepts only loopback clients.
+// Exporter is an HTTP address of the exporter mode, it runs tests every Interval or on scrape (OnScrape),
+// then Interval is a minimum one between tests.
+// TLS enables encrypted transport with the server's certificate files TLSCert and TLSKey
+// (a self-signed one is generated if they are empty) and client's pinned TLSFingerprint.
+// TLSClientCA is a server's CA file to authenticate clients by their certificates TLSCert and TLSKey.
+// RejectLegacy disables server's support of legacy auth tokens.
+// TokensFile is a server's tokens file, it's reloaded by SIGHUP.
+// AuthURL is an HTTP auth service of server's clients secrets, Anonymous allows clients without tokens.
+// Anonymous clients are limited by AnonymousDuration and AnonymousBytes of every direction (zero values - no limits)
+// and AnonymousSessions concurrent sessions.
+// IPRate limits new connections per minute and IPConnections limits concurrent connections of one IP address,
+// BanFailures failed handshakes ban the address for BanDuration (zero values - no limits).
+// Allow and Deny are CIDR ranges of clients' IP addresses, AccessFile is a file of such rules, it's reloaded by SIGHUP.
+// StrictAuth makes the client stop before any test data if the server can't prove client's secret by challenge-response.
 type Params struct {
-	Host    string
-	Port    uint16
-	Timeout time.Duration
-	Clients int
-	Dot     bool
+	Host       string
+	Port       uint16
+	Timeout    time.Duration
+	Duration   time.Duration
+	Bytes      uint64
+	Clients    int
+	Streams    int
+	Dot        bool
+	UDP        bool
+	Bitrate    uint64
+	PacketSize int
+	MaxBitrate uint64
+	Format     string
+	Output     string
+	Metrics    string
+	Admin      string
+	Audit      string
+	Exporter   string
+	Interval   time.Duration
+	OnScrape   bool
+
+	TLS            bool
+	TLSCert        string
+	TLSKey         string
+	TLSFingerprint string
+	TLSClientCA    string
+	RejectLegacy   bool
+	StrictAuth     bool
+	TokensFile     string
+	AuthURL        string
+	Anonymous      bool
+
+	AnonymousDuration time.Duration
+	AnonymousBytes    uint64
+	AnonymousSessions int
+
+	IPRate        int
+	IPConnections int
+	BanFailures   int
+	BanDuration   time.Duration
+
+	Allow      []string
+	Deny       []string
+	AccessFile string
 }
 
 // NewLine returns a new line string by dot flag.
@@ -101,6 +208,15 @@ func ByteSize(size uint64) string {
 	}
 }
 
+// BitsPerSecond returns network speed in bits per second.
+func BitsPerSecond(duration time.Duration, count uint64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+
+	return float64(count*8) / duration.Seconds()
+}
+
 // Speed returns network speed as a string.
 func Speed(duration time.Duration, count uint64, unit SpeedUnit) string {
 	var (
@@ -135,30 +251,3 @@ func Speed(duration time.Duration, count uint64, unit SpeedUnit) string {
 		return fmt.Sprintf("%.2f GBits/%s", speed/GB, name)
 	}
 }
-
-// SkipError skips some errors or returns original one.
-func SkipError(err error) error {
-	var ignoredErrors = [3]string{"connection reset by peer", "broken pipe", "i/o timeout"}
-
-	if err == nil {
-		return nil
-	}
-
-	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
-		return nil
-	}
-
-	var opErr *net.OpError
-	if !errors.As(err, &opErr) {
-		return err
-	}
-
-	errMsg := opErr.Error()
-	for _, ignoredErr := range ignoredErrors {
-		if strings.Contains(errMsg, ignoredErr) {
-			return nil
-		}
-	}
-
-	return err
-}
@@ -1,11 +1,11 @@
 package common
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"testing"
 	"time"
 )
@@ -137,40 +137,71 @@ func TestParsePort(t *testing.T) {
 	}
 }
 
-func TestSkipError(t *testing.T) {
-	var (
-		someError       = errors.New("some error")
-		opError         = &net.OpError{Err: someError}
-		opErrorSkipPeer = &net.OpError{Err: errors.New("oops, connection reset by peer")}
-		opErrorSkipPipe = &net.OpError{Err: errors.New("oops, broken pipe again")}
-	)
-
+func TestParseSize(t *testing.T) {
 	testCases := []struct {
-		name     string
-		err      error
-		expected error
+		name      string
+		value     string
+		want      uint64
+		withError bool
 	}{
-		{name: "nil"},
-		{name: "eof", err: io.EOF},
-		{name: "other", err: someError, expected: someError},
-		{name: "inherit", err: fmt.Errorf("some error: %w", io.EOF)},
-		{name: "skip_net_error_peer", err: opErrorSkipPeer},
-		{name: "skip_net_error_pipe", err: opErrorSkipPipe},
-		{name: "op_error", err: opError, expected: someError},
+		{name: "bytes", value: "100", want: 100},
+		{name: "bytes_suffix", value: "100B", want: 100},
+		{name: "kilobytes", value: "2KB", want: 2048},
+		{name: "megabytes", value: "500MB", want: 500 << 20},
+		{name: "gigabytes_float", value: "1.5GB", want: 3 << 29},
+		{name: "lower_case", value: "10 mb", want: 10 << 20},
+		{name: "negative", value: "-1MB", withError: true},
+		{name: "unknown_unit", value: "1TB", withError: true},
+		{name: "empty", value: "", withError: true},
 	}
 
 	for i := range testCases {
 		tc := testCases[i]
 		t.Run(tc.name, func(t *testing.T) {
-			err := SkipError(tc.err)
-
-			if err != nil && !errors.Is(err, tc.expected) {
-				t.Errorf("expected %v, got %v", tc.expected, err)
+			got, err := ParseSize(tc.value)
+			if err != nil {
+				if !tc.withError {
+					t.Errorf("expected no error, got: %v", err)
+				}
 				return
 			}
 
-			if err == nil && tc.expected != nil {
-				t.Error("expected error, got nil")
+			if tc.withError {
+				t.Fatal("expected error")
+			}
+
+			if got != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		value     string
+		want      uint64
+		withError bool
+	}{
+		{name: "bits", value: "1000", want: 1000},
+		{name: "kilobits", value: "10K", want: 10 << 10},
+		{name: "megabits", value: "100m", want: 100 << 20},
+		{name: "gigabits_float", value: "1.5G", want: 3 << 29},
+		{name: "bytes_unit", value: "10MB", withError: true},
+		{name: "negative", value: "-1M", withError: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseBitrate(tc.value)
+			if (err != nil) != tc.withError {
+				t.Fatalf("want error %v, got %v", tc.withError, err)
+			}
+
+			if got != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, got)
 			}
 		})
 	}
@@ -293,3 +324,178 @@ func TestNewWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestReport(t *testing.T) {
+	var (
+		now   = time.Now()
+		empty = &Report{Count: 1024}
+	)
+
+	report := &Report{Count: 1024, First: now, Last: now.Add(time.Second)}
+	if d := report.Duration(); d != time.Second {
+		t.Errorf("want %v, got %v", time.Second, d)
+	}
+
+	if s := report.Speed(); s != "8.00 KBits/s" {
+		t.Errorf("want %q, got %q", "8.00 KBits/s", s)
+	}
+
+	if d := empty.Duration(); d != 0 {
+		t.Errorf("want zero duration, got %v", d)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(io.Discard)
+
+	for _, size := range []int{10, 0, 20} {
+		n, err := c.Write(make([]byte, size))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if n != size {
+			t.Errorf("want %d bytes written, got %d", size, n)
+		}
+	}
+
+	report := c.Report()
+	if report.Count != 30 {
+		t.Errorf("want 30 bytes, got %d", report.Count)
+	}
+
+	if report.First.IsZero() || report.Last.Before(report.First) {
+		t.Errorf("invalid timestamps: %v - %v", report.First, report.Last)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	now := time.Now()
+	reports := []*Report{
+		{Count: 100, First: now.Add(time.Second), Last: now.Add(2 * time.Second)},
+		nil,
+		{Count: 200, First: now, Last: now.Add(time.Second)},
+		{},
+	}
+
+	total := Aggregate(reports)
+	if total.Count != 300 {
+		t.Errorf("want 300 bytes, got %d", total.Count)
+	}
+
+	if !total.First.Equal(now) || !total.Last.Equal(now.Add(2*time.Second)) {
+		t.Errorf("unexpected interval: %v - %v", total.First, total.Last)
+	}
+
+	if empty := Aggregate(nil); empty.Count != 0 || empty.Duration() != 0 {
+		t.Errorf("want empty report, got %+v", empty)
+	}
+}
+
+func TestNewLatency(t *testing.T) {
+	ms := time.Millisecond
+	testCases := []struct {
+		name    string
+		samples []time.Duration
+		want    *Latency
+	}{
+		{name: "empty"},
+		{
+			name:    "single",
+			samples: []time.Duration{5 * ms},
+			want:    &Latency{Count: 1, Min: 5 * ms, Median: 5 * ms, P95: 5 * ms, Max: 5 * ms},
+		},
+		{
+			name:    "even",
+			samples: []time.Duration{2 * ms, 8 * ms, 4 * ms, 6 * ms},
+			want:    &Latency{Count: 4, Min: 2 * ms, Median: 5 * ms, P95: 8 * ms, Max: 8 * ms, Jitter: 4 * ms},
+		},
+		{
+			name:    "odd",
+			samples: []time.Duration{10 * ms, 10 * ms, 40 * ms},
+			want:    &Latency{Count: 3, Min: 10 * ms, Median: 10 * ms, P95: 40 * ms, Max: 40 * ms, Jitter: 15 * ms},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got := NewLatency(tc.samples)
+			if tc.want == nil {
+				if got != nil {
+					t.Errorf("want nil, got %+v", got)
+				}
+				return
+			}
+
+			if got == nil || *got != *tc.want {
+				t.Errorf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+
+	if s := (*Latency)(nil).String(); s != "no data" {
+		t.Errorf("unexpected empty latency string %q", s)
+	}
+
+	l := &Latency{Min: 1500 * time.Microsecond}
+	if s := l.String(); s != "min 1.50 ms, median 0.00 ms, p95 0.00 ms, max 0.00 ms, jitter 0.00 ms" {
+		t.Errorf("unexpected latency string %q", s)
+	}
+}
+
+func TestUDPReport(t *testing.T) {
+	r := &UDPReport{Sent: 200, Received: 190, Lost: 10, OutOfOrder: 2, Jitter: 250 * time.Microsecond}
+
+	if loss := r.Loss(); loss != 5 {
+		t.Errorf("want 5%% loss, got %v", loss)
+	}
+
+	expected := "loss 5.00% (10/200), out-of-order 2, duplicates 0, jitter 0.25 ms"
+	if s := r.String(); s != expected {
+		t.Errorf("want %q, got %q", expected, s)
+	}
+
+	if loss := (&UDPReport{}).Loss(); loss != 0 {
+		t.Errorf("want zero loss, got %v", loss)
+	}
+}
+
+type failWriter struct {
+	writes int
+}
+
+func (w *failWriter) Write([]byte) (int, error) {
+	w.writes++
+	return 0, io.ErrClosedPipe
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	mw := NewMetricsWriter(&buf)
+	mw.Metric("spts_up", "gauge", "Whether the latest test succeeded.")
+	mw.Printf("spts_up{server=%q} %s\n", "localhost:28082", MetricValue(1))
+	mw.Printf("spts_ratio %s\n", MetricValue(0.25))
+
+	expected := "# HELP spts_up Whether the latest test succeeded.\n# TYPE spts_up gauge\n" +
+		"spts_up{server=\"localhost:28082\"} 1\nspts_ratio 0.25\n"
+
+	if err := mw.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if s := buf.String(); s != expected {
+		t.Errorf("want %q, got %q", expected, s)
+	}
+
+	// writes are skipped after the first error
+	fw := &failWriter{}
+	mw = NewMetricsWriter(fw)
+	mw.Printf("spts_up 1\n")
+	mw.Printf("spts_up 1\n")
+
+	if err := mw.Err(); !errors.Is(err, io.ErrClosedPipe) || fw.writes != 1 {
+		t.Errorf("want %v after 1 write, got %v after %d writes", io.ErrClosedPipe, err, fw.writes)
+	}
+}
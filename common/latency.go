@@ -0,0 +1,78 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Latency is a round-trip time statistics of echo probes.
+// Jitter is a mean absolute difference between consecutive samples.
+type Latency struct {
+	Count  int           `json:"count"`
+	Min    time.Duration `json:"min"`
+	Median time.Duration `json:"median"`
+	P95    time.Duration `json:"p95"`
+	Max    time.Duration `json:"max"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+// NewLatency calculates statistics of samples in the measurement order, it returns nil for empty samples.
+func NewLatency(samples []time.Duration) *Latency {
+	n := len(samples)
+	if n == 0 {
+		return nil
+	}
+
+	var diffs time.Duration
+	for i := 1; i < n; i++ {
+		d := samples[i] - samples[i-1]
+		diffs += max(d, -d)
+	}
+
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	l := &Latency{
+		Count: n,
+		Min:   sorted[0],
+		P95:   percentile(sorted, 95),
+		Max:   sorted[n-1],
+	}
+
+	if n%2 == 0 {
+		l.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	} else {
+		l.Median = sorted[n/2]
+	}
+
+	if n > 1 {
+		l.Jitter = diffs / time.Duration(n-1)
+	}
+
+	return l
+}
+
+// percentile returns nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// String implements Stringer interface.
+func (l *Latency) String() string {
+	if l == nil {
+		return "no data"
+	}
+
+	return fmt.Sprintf(
+		"min %s, median %s, p95 %s, max %s, jitter %s",
+		milliseconds(l.Min), milliseconds(l.Median), milliseconds(l.P95), milliseconds(l.Max), milliseconds(l.Jitter),
+	)
+}
+
+// milliseconds returns a duration as milliseconds string.
+func milliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.2f ms", float64(d)/float64(time.Millisecond))
+}
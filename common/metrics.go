@@ -0,0 +1,41 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MetricsWriter writes metrics in Prometheus text format.
+// It keeps the first write error, next writes are skipped after it.
+type MetricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// NewMetricsWriter returns a new metrics writer to w.
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+// Printf writes formatted string if there was no error.
+func (mw *MetricsWriter) Printf(format string, a ...any) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, a...)
+	}
+}
+
+// Metric writes HELP and TYPE lines of the metric.
+func (mw *MetricsWriter) Metric(name, kind, help string) {
+	mw.Printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Err returns the first write error.
+func (mw *MetricsWriter) Err() error {
+	return mw.err
+}
+
+// MetricValue formats a float metric value.
+func MetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Report is a receiver side transfer report.
+type Report struct {
+	Count uint64    `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// Duration returns time between the first and last received bytes.
+func (r *Report) Duration() time.Duration {
+	if r.First.IsZero() || r.Last.IsZero() {
+		return 0
+	}
+
+	return r.Last.Sub(r.First)
+}
+
+// Speed returns receiver side network speed as a string.
+func (r *Report) Speed() string {
+	return Speed(r.Duration(), r.Count, SpeedSeconds)
+}
+
+// UDPReport is a receiver side report of UDP datagrams transfer.
+// Count is a number of received unique bytes, Sent and Received are datagrams numbers,
+// Jitter is an interarrival jitter calculated as described in RFC 3550.
+type UDPReport struct {
+	Report
+	Sent       uint64        `json:"sent"`
+	Received   uint64        `json:"received"`
+	Lost       uint64        `json:"lost"`
+	OutOfOrder uint64        `json:"out_of_order"`
+	Duplicates uint64        `json:"duplicates"`
+	Jitter     time.Duration `json:"jitter"`
+}
+
+// Loss returns lost datagrams percentage.
+func (r *UDPReport) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+
+	return float64(r.Lost) * 100 / float64(r.Sent)
+}
+
+// String implements Stringer interface.
+func (r *UDPReport) String() string {
+	return fmt.Sprintf(
+		"loss %.2f%% (%d/%d), out-of-order %d, duplicates %d, jitter %s",
+		r.Loss(), r.Lost, r.Sent, r.OutOfOrder, r.Duplicates, milliseconds(r.Jitter),
+	)
+}
+
+// BitsPerSecond returns receiver side network speed in bits per second.
+func (r *Report) BitsPerSecond() float64 {
+	return BitsPerSecond(r.Duration(), r.Count)
+}
+
+// Aggregate returns a common report of parallel transfers:
+// total bytes count between the earliest first and the latest last bytes.
+func Aggregate(reports []*Report) *Report {
+	var total = &Report{}
+
+	for _, r := range reports {
+		if r == nil {
+			continue
+		}
+
+		total.Count += r.Count
+
+		if !r.First.IsZero() && (total.First.IsZero() || r.First.Before(total.First)) {
+			total.First = r.First
+		}
+
+		if r.Last.After(total.Last) {
+			total.Last = r.Last
+		}
+	}
+
+	return total
+}
+
+// Counter is a writer wrapper that counts written bytes and remembers the first and last write times.
+// Its report can be read concurrently with writing.
+type Counter struct {
+	w     io.Writer
+	count atomic.Uint64
+	first atomic.Int64
+	last  atomic.Int64
+}
+
+// NewCounter returns a new Counter for the writer w.
+func NewCounter(w io.Writer) *Counter {
+	return &Counter{w: w}
+}
+
+// Write implements the io.Writer interface.
+func (c *Counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+
+	if n > 0 {
+		now := time.Now().UnixNano()
+
+		c.first.CompareAndSwap(0, now)
+		c.last.Store(now)
+		c.count.Add(uint64(n))
+	}
+
+	return n, err
+}
+
+// Report returns current counter values.
+func (c *Counter) Report() *Report {
+	r := &Report{Count: c.count.Load()}
+
+	if first := c.first.Load(); first > 0 {
+		r.First = time.Unix(0, first)
+	}
+
+	if last := c.last.Load(); last > 0 {
+		r.Last = time.Unix(0, last)
+	}
+
+	return r
+}
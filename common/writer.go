@@ -10,35 +10,20 @@ var ErrWriterTimeout = errors.New("writer timeout")
 
 // Writer is a writer that writes nothing.
 type Writer struct {
-	errChan chan error
+	ctx context.Context
 }
 
+// NewWriter returns a new Writer that discards data until the context is canceled or timed out.
 func NewWriter(ctx context.Context) *Writer {
-	w := &Writer{errChan: make(chan error)}
-
-	go func() {
-		defer close(w.errChan)
-
-		for {
-			select {
-			case <-ctx.Done():
-				if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
-					w.errChan <- ErrWriterTimeout
-				} else {
-					w.errChan <- err
-				}
-				return
-			default:
-				w.errChan <- nil
-			}
-		}
-	}()
-
-	return w
+	return &Writer{ctx: ctx}
 }
 
+// Write implements the io.Writer interface.
 func (w *Writer) Write(p []byte) (int, error) {
-	if err := <-w.errChan; err != nil {
+	if err := w.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, ErrWriterTimeout
+		}
 		return 0, err
 	}
 
@@ -0,0 +1,287 @@
+// Package exporter runs client tests periodically and exposes their latest results as Prometheus metrics.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/client"
+	"github.com/z0rr0/spts/common"
+)
+
+// Exporter is a long-lived client, it runs tests by schedule or on scrape
+// and keeps the latest result.
+type Exporter struct {
+	common.Params
+	client *client.Client
+	run    func(ctx context.Context) (*client.Result, error)
+
+	runMu    sync.Mutex // only one test at a time
+	mu       sync.Mutex
+	result   *client.Result
+	err      error
+	updated  time.Time
+	elapsed  time.Duration
+	runs     uint64
+	failures uint64
+}
+
+// New creates a new exporter, its client is created by the same parameters.
+func New(params *common.Params) (*Exporter, error) {
+	if params.Exporter == "" {
+		return nil, errors.New("exporter address is empty")
+	}
+
+	if params.Interval <= 0 {
+		return nil, errors.New("test interval must be greater than 0")
+	}
+
+	clientParams := *params
+	clientParams.Dot, clientParams.Format, clientParams.Output = false, client.FormatText, ""
+
+	c, err := client.New(&clientParams)
+	if err != nil {
+		return nil, fmt.Errorf("exporter client: %w", err)
+	}
+
+	return &Exporter{Params: *params, client: c, run: c.Run}, nil
+}
+
+// Start serves metrics and runs tests until the context is done.
+func (e *Exporter) Start(ctx context.Context) error {
+	slog.Info(
+		"exporter starting",
+		"address", e.Exporter, "server", e.client.Address(), "interval", e.Interval, "on_scrape", e.OnScrape,
+	)
+	defer slog.Info("exporter stopped")
+
+	listener, err := net.Listen("tcp", e.Exporter)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	if !e.OnScrape {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.schedule(ctx)
+		}()
+	}
+
+	err = e.serve(ctx, listener)
+	wg.Wait()
+
+	return err
+}
+
+// schedule runs tests every interval until the context is done.
+func (e *Exporter) schedule(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.update(ctx, 0)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update runs a test if the latest result is older than the minimum interval.
+func (e *Exporter) update(ctx context.Context, minInterval time.Duration) {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+
+	e.mu.Lock()
+	fresh := !e.updated.IsZero() && time.Since(e.updated) < minInterval
+	e.mu.Unlock()
+
+	if fresh {
+		return
+	}
+
+	start := time.Now()
+	result, err := e.run(ctx)
+	elapsed := time.Since(start)
+
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		return // the exporter is stopping
+	}
+
+	if err != nil {
+		slog.Warn("exporter", "test_error", err, "elapsed", elapsed)
+	} else {
+		slog.Info("exporter", "test", "done", "elapsed", elapsed)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.runs++
+	if err != nil {
+		e.failures++
+	}
+
+	e.result, e.err, e.updated, e.elapsed = result, err, time.Now(), elapsed
+}
+
+// serve runs HTTP server with metrics until the context is done.
+func (e *Exporter) serve(ctx context.Context, listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if e.OnScrape {
+			// concurrent scrapes wait the same test, so only one of them runs it
+			e.update(r.Context(), e.Interval)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := e.write(w); err != nil {
+			slog.Error("exporter", "write_error", err)
+		}
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: e.Timeout}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("exporter", "shutdown_error", err)
+		}
+	}()
+
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("exporter server: %w", err)
+	}
+
+	return nil
+}
+
+// write writes the latest result as Prometheus text format metrics.
+// Results of partially failed tests are written too, "up" metric shows the error.
+func (e *Exporter) write(w io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var (
+		ew     = common.NewMetricsWriter(w)
+		server = e.client.Address()
+		up     = 0
+	)
+
+	if e.result != nil && e.err == nil {
+		up = 1
+	}
+
+	ew.Metric("spts_up", "gauge", "Whether the latest test succeeded.")
+	ew.Printf("spts_up{server=%q} %d\n", server, up)
+
+	ew.Metric("spts_runs_total", "counter", "Number of tests.")
+	ew.Printf("spts_runs_total{server=%q} %d\n", server, e.runs)
+
+	ew.Metric("spts_failures_total", "counter", "Number of failed tests.")
+	ew.Printf("spts_failures_total{server=%q} %d\n", server, e.failures)
+
+	if e.updated.IsZero() {
+		return ew.Err()
+	}
+
+	ew.Metric("spts_last_run_timestamp_seconds", "gauge", "End time of the latest test.")
+	ew.Printf("spts_last_run_timestamp_seconds{server=%q} %d\n", server, e.updated.Unix())
+
+	ew.Metric("spts_run_duration_seconds", "gauge", "Duration of the latest test.")
+	ew.Printf("spts_run_duration_seconds{server=%q} %s\n", server, seconds(e.elapsed))
+
+	if e.result == nil {
+		return ew.Err()
+	}
+
+	e.writeResult(ew, server)
+	return ew.Err()
+}
+
+// writeResult writes metrics of the test result directions and latency.
+func (e *Exporter) writeResult(ew *common.MetricsWriter, server string) {
+	var (
+		r          = e.result
+		names      = []string{"download", "upload"}
+		directions = []*client.Direction{r.Download, r.Upload}
+	)
+
+	ew.Metric("spts_bits_per_second", "gauge", "Throughput of the latest test by direction.")
+	for i, d := range directions {
+		if d != nil {
+			ew.Printf("spts_bits_per_second{server=%q,direction=%q} %s\n", server, names[i], common.MetricValue(d.BitsPerSecond))
+		}
+	}
+
+	ew.Metric("spts_bytes", "gauge", "Received bytes of the latest test by direction.")
+	for i, d := range directions {
+		if d != nil {
+			ew.Printf("spts_bytes{server=%q,direction=%q} %d\n", server, names[i], d.Bytes)
+		}
+	}
+
+	ew.Metric("spts_latency_seconds", "gauge", "Round-trip time statistics of the latest test, idle or under load.")
+	phases, latencies := []string{"idle"}, []*common.Latency{r.Latency}
+	for i, d := range directions {
+		if d != nil {
+			phases, latencies = append(phases, names[i]), append(latencies, d.Latency)
+		}
+	}
+
+	for i, l := range latencies {
+		if l == nil {
+			continue
+		}
+
+		stats := []struct {
+			name  string
+			value time.Duration
+		}{
+			{"min", l.Min}, {"median", l.Median}, {"p95", l.P95}, {"max", l.Max}, {"jitter", l.Jitter},
+		}
+
+		for _, s := range stats {
+			ew.Printf(
+				"spts_latency_seconds{server=%q,phase=%q,stat=%q} %s\n", server, phases[i], s.name, seconds(s.value),
+			)
+		}
+	}
+
+	if !r.UDP {
+		return
+	}
+
+	ew.Metric("spts_datagram_loss_ratio", "gauge", "Lost datagrams ratio of the latest UDP test by direction.")
+	for i, d := range directions {
+		if d != nil && d.Datagrams != nil {
+			ew.Printf("spts_datagram_loss_ratio{server=%q,direction=%q} %s\n", server, names[i], common.MetricValue(d.Datagrams.Loss()/100))
+		}
+	}
+
+	ew.Metric("spts_datagram_jitter_seconds", "gauge", "Interarrival jitter of the latest UDP test by direction.")
+	for i, d := range directions {
+		if d != nil && d.Datagrams != nil {
+			ew.Printf("spts_datagram_jitter_seconds{server=%q,direction=%q} %s\n", server, names[i], seconds(d.Datagrams.Jitter))
+		}
+	}
+}
+
+// seconds formats the duration as seconds number.
+func seconds(d time.Duration) string {
+	return common.MetricValue(d.Seconds())
+}
@@ -0,0 +1,206 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/client"
+	"github.com/z0rr0/spts/common"
+)
+
+func testExporter(t *testing.T, onScrape bool) *Exporter {
+	e, err := New(&common.Params{
+		Host:     "localhost",
+		Port:     28082,
+		Streams:  1,
+		Timeout:  time.Second,
+		Exporter: "127.0.0.1:0",
+		Interval: time.Hour,
+		OnScrape: onScrape,
+	})
+
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+
+	return e
+}
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name      string
+		params    common.Params
+		errSubstr string
+	}{
+		{
+			name:   "valid",
+			params: common.Params{Host: "localhost", Port: 28082, Streams: 1, Exporter: ":9469", Interval: time.Minute},
+		},
+		{
+			name:      "empty_address",
+			params:    common.Params{Host: "localhost", Port: 28082, Streams: 1, Interval: time.Minute},
+			errSubstr: "exporter address is empty",
+		},
+		{
+			name:      "invalid_interval",
+			params:    common.Params{Host: "localhost", Port: 28082, Streams: 1, Exporter: ":9469"},
+			errSubstr: "test interval",
+		},
+		{
+			name:      "invalid_client",
+			params:    common.Params{Port: 28082, Streams: 1, Exporter: ":9469", Interval: time.Minute},
+			errSubstr: "host address is empty",
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(&tc.params)
+
+			if tc.errSubstr == "" {
+				if err != nil {
+					t.Errorf("want nil, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.errSubstr) {
+				t.Errorf("want %q, got %v", tc.errSubstr, err)
+			}
+		})
+	}
+}
+
+func TestExporter_Write(t *testing.T) {
+	e := testExporter(t, false)
+
+	var b strings.Builder
+	if err := e.write(&b); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if s := b.String(); !strings.Contains(s, "spts_up{server=\"localhost:28082\"} 0\n") ||
+		strings.Contains(s, "spts_bits_per_second") {
+		t.Errorf("unexpected metrics without result:\n%s", s)
+	}
+
+	e.run = func(context.Context) (*client.Result, error) {
+		return &client.Result{
+			UDP:     true,
+			Latency: &common.Latency{Count: 1, Min: time.Millisecond, Median: 2 * time.Millisecond},
+			Download: &client.Direction{
+				Bytes:         1000,
+				BitsPerSecond: 8000,
+				Datagrams:     &common.UDPReport{Sent: 4, Received: 3, Lost: 1, Jitter: time.Millisecond},
+			},
+		}, nil
+	}
+
+	e.update(context.Background(), 0)
+	b.Reset()
+
+	if err := e.write(&b); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	expected := []string{
+		"spts_up{server=\"localhost:28082\"} 1\n",
+		"spts_runs_total{server=\"localhost:28082\"} 1\n",
+		"spts_failures_total{server=\"localhost:28082\"} 0\n",
+		"spts_bits_per_second{server=\"localhost:28082\",direction=\"download\"} 8000\n",
+		"spts_bytes{server=\"localhost:28082\",direction=\"download\"} 1000\n",
+		"spts_latency_seconds{server=\"localhost:28082\",phase=\"idle\",stat=\"median\"} 0.002\n",
+		"spts_datagram_loss_ratio{server=\"localhost:28082\",direction=\"download\"} 0.25\n",
+		"spts_datagram_jitter_seconds{server=\"localhost:28082\",direction=\"download\"} 0.001\n",
+		"# TYPE spts_latency_seconds gauge\n",
+	}
+
+	s := b.String()
+	for _, line := range expected {
+		if !strings.Contains(s, line) {
+			t.Errorf("no %q in metrics:\n%s", line, s)
+		}
+	}
+
+	if strings.Contains(s, "direction=\"upload\"") {
+		t.Errorf("unexpected upload metrics:\n%s", s)
+	}
+}
+
+func TestExporter_OnScrape(t *testing.T) {
+	var (
+		runs int32
+		e    = testExporter(t, true)
+	)
+
+	e.run = func(context.Context) (*client.Result, error) {
+		if atomic.AddInt32(&runs, 1) > 1 {
+			return nil, errors.New("connection failed")
+		}
+		return &client.Result{Download: &client.Direction{BitsPerSecond: 8000}}, nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- e.serve(ctx, listener)
+	}()
+
+	scrape := func() string {
+		resp, e := http.Get("http://" + listener.Addr().String() + "/metrics")
+		if e != nil {
+			t.Fatalf("failed to get metrics: %v", e)
+		}
+
+		body, e := io.ReadAll(resp.Body)
+		if e != nil {
+			t.Fatalf("failed to read metrics: %v", e)
+		}
+
+		if e = resp.Body.Close(); e != nil {
+			t.Errorf("failed to close body: %v", e)
+		}
+
+		return string(body)
+	}
+
+	// the second scrape gets the cached result because of the minimum interval
+	for i := 0; i < 2; i++ {
+		if s := scrape(); !strings.Contains(s, "spts_up{server=\"localhost:28082\"} 1\n") {
+			t.Errorf("unexpected metrics of scrape %d:\n%s", i, s)
+		}
+	}
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("want 1 test, got %d", n)
+	}
+
+	// expired result, the next test fails
+	e.mu.Lock()
+	e.updated = time.Now().Add(-2 * e.Interval)
+	e.mu.Unlock()
+
+	if s := scrape(); !strings.Contains(s, "spts_up{server=\"localhost:28082\"} 0\n") ||
+		!strings.Contains(s, "spts_failures_total{server=\"localhost:28082\"} 1\n") {
+		t.Errorf("unexpected metrics of failed test:\n%s", s)
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+// Conn is a framed protocol connection.
+// Frames can be written from different goroutines, but read only from one.
+type Conn struct {
+	rw     io.ReadWriter
+	mu     sync.Mutex
+	header [lenHeader]byte
+}
+
+// NewConn returns a new protocol connection.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{rw: rw}
+}
+
+// WritePreamble sends protocol magic and version.
+func (c *Conn) WritePreamble(version uint8) error {
+	preamble := make([]byte, 0, lenPreamble)
+	preamble = append(preamble, magic[:]...)
+	preamble = append(preamble, version)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.rw.Write(preamble); err != nil {
+		return fmt.Errorf("write preamble: %w", err)
+	}
+
+	return nil
+}
+
+// ReadPreamble reads protocol magic and returns the remote side version.
+func (c *Conn) ReadPreamble() (uint8, error) {
+	var preamble [lenPreamble]byte
+
+	if _, err := io.ReadFull(c.rw, preamble[:]); err != nil {
+		return 0, fmt.Errorf("read preamble: %w", err)
+	}
+
+	if !bytes.Equal(preamble[:lenMagic], magic[:]) {
+		return 0, errors.Join(ErrUnsupportedVersion, errors.New("unknown protocol magic"))
+	}
+
+	return preamble[lenMagic], nil
+}
+
+// WriteFrame sends a frame with the raw payload.
+func (c *Conn) WriteFrame(t Type, payload []byte) error {
+	header := make([]byte, lenHeader)
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	buffers := net.Buffers{header, payload}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := buffers.WriteTo(c.rw); err != nil {
+		return fmt.Errorf("write %s frame: %w", t, err)
+	}
+
+	return nil
+}
+
+// WriteMessage sends a frame with JSON encoded message.
+func (c *Conn) WriteMessage(t Type, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s message: %w", t, err)
+	}
+
+	return c.WriteFrame(t, payload)
+}
+
+// WriteError sends an error message.
+func (c *Conn) WriteError(code, message string) error {
+	return c.WriteMessage(TypeError, &Error{Code: code, Message: message})
+}
+
+// readHeader reads a frame header and returns its type and payload length.
+func (c *Conn) readHeader() (Type, uint32, error) {
+	if _, err := io.ReadFull(c.rw, c.header[:]); err != nil {
+		return 0, 0, fmt.Errorf("read frame header: %w", err)
+	}
+
+	return Type(c.header[0]), binary.BigEndian.Uint32(c.header[1:]), nil
+}
+
+// readPayload reads a control frame payload.
+func (c *Conn) readPayload(t Type, length uint32) ([]byte, error) {
+	if length > MaxPayloadSize {
+		return nil, errors.Join(ErrFrameSize, fmt.Errorf("%s frame length %d", t, length))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return nil, fmt.Errorf("read %s frame: %w", t, err)
+	}
+
+	return payload, nil
+}
+
+// remoteError decodes the error frame payload.
+func remoteError(payload []byte) error {
+	e := &Error{}
+
+	if err := json.Unmarshal(payload, e); err != nil {
+		return errors.Join(ErrRejected, fmt.Errorf("decode error message: %w", err))
+	}
+
+	return e
+}
+
+// ReadFrame reads a control frame of the expected type and returns its payload.
+// If the remote side sent an error frame, it is returned as *Error.
+func (c *Conn) ReadFrame(expected Type) ([]byte, error) {
+	t, length, err := c.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if t != TypeError && t != expected {
+		return nil, errors.Join(ErrUnexpectedFrame, fmt.Errorf("got %s, want %s", t, expected))
+	}
+
+	payload, err := c.readPayload(t, length)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == TypeError {
+		return nil, remoteError(payload)
+	}
+
+	return payload, nil
+}
+
+// ReadMessage reads a frame of the expected type and decodes its JSON payload to v.
+func (c *Conn) ReadMessage(expected Type, v any) error {
+	payload, err := c.ReadFrame(expected)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("decode %s message: %w", expected, err)
+	}
+
+	return nil
+}
+
+// Writer returns a writer that sends all written bytes as data frames.
+func (c *Conn) Writer() io.Writer {
+	return &dataWriter{c: c}
+}
+
+// ReadData reads data frames to w until the end message.
+func (c *Conn) ReadData(w io.Writer) (*End, error) {
+	for {
+		t, length, err := c.readHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		if t != TypeData {
+			payload, e := c.readPayload(t, length)
+			if e != nil {
+				return nil, e
+			}
+
+			switch t {
+			case TypeEnd:
+				end := &End{}
+				if e = json.Unmarshal(payload, end); e != nil {
+					return nil, fmt.Errorf("decode %s message: %w", t, e)
+				}
+				return end, nil
+			case TypeError:
+				return nil, remoteError(payload)
+			default:
+				return nil, errors.Join(ErrUnexpectedFrame, fmt.Errorf("got %s, want %s", t, TypeData))
+			}
+		}
+
+		if length > MaxDataSize {
+			return nil, errors.Join(ErrFrameSize, fmt.Errorf("%s frame length %d", t, length))
+		}
+
+		if _, err = io.CopyN(w, c.rw, int64(length)); err != nil {
+			return nil, fmt.Errorf("read data: %w", err)
+		}
+	}
+}
+
+// ReadResult reads receiver's statistics messages until the result one.
+// Function f is called for every statistics message, it can be nil.
+func (c *Conn) ReadResult(f func(*Stats)) (*common.Report, error) {
+	for {
+		t, length, err := c.readHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := c.readPayload(t, length)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t {
+		case TypeStats:
+			stats := &Stats{}
+			if err = json.Unmarshal(payload, stats); err != nil {
+				return nil, fmt.Errorf("decode %s message: %w", t, err)
+			}
+
+			if f != nil {
+				f(stats)
+			}
+		case TypeResult:
+			report := &common.Report{}
+			if err = json.Unmarshal(payload, report); err != nil {
+				return nil, fmt.Errorf("decode %s message: %w", t, err)
+			}
+			return report, nil
+		case TypeError:
+			return nil, remoteError(payload)
+		default:
+			return nil, errors.Join(ErrUnexpectedFrame, fmt.Errorf("got %s, want %s", t, TypeResult))
+		}
+	}
+}
+
+// StartStats periodically sends statistics messages with counter values,
+// function f is called for every sent message, it can be nil.
+// Returned function stops it, it must be called before the result message sending.
+func (c *Conn) StartStats(counter *common.Counter, interval time.Duration, f func(*Stats)) func() {
+	var (
+		ticker = time.NewTicker(interval)
+		stop   = make(chan struct{})
+		wait   = make(chan struct{})
+	)
+
+	go func() {
+		defer close(wait)
+
+		for {
+			select {
+			case <-stop:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				stats := &Stats{Count: counter.Report().Count, Time: time.Now()}
+
+				if err := c.WriteMessage(TypeStats, stats); err != nil {
+					ticker.Stop()
+					return
+				}
+
+				if f != nil {
+					f(stats)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-wait
+	}
+}
+
+// dataWriter writes data frames.
+type dataWriter struct {
+	c *Conn
+}
+
+// Write implements the io.Writer interface.
+func (w *dataWriter) Write(p []byte) (int, error) {
+	var n int
+
+	for len(p) > 0 {
+		size := min(len(p), MaxDataSize)
+
+		if err := w.c.WriteFrame(TypeData, p[:size]); err != nil {
+			return n, err
+		}
+
+		n += size
+		p = p[size:]
+	}
+
+	return n, nil
+}
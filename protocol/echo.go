@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidPong is returned when the echo reply doesn't match the sent probe.
+var ErrInvalidPong = errors.New("invalid pong")
+
+// Ping sends a latency probe and waits its echo reply, it returns the round-trip time.
+func (c *Conn) Ping(seq uint64) (time.Duration, error) {
+	var pong = &Ping{}
+
+	start := time.Now()
+	if err := c.WriteMessage(TypePing, &Ping{Seq: seq, Time: start}); err != nil {
+		return 0, err
+	}
+
+	if err := c.ReadMessage(TypePong, pong); err != nil {
+		return 0, err
+	}
+
+	rtt := time.Since(start)
+	if pong.Seq != seq {
+		return 0, errors.Join(ErrInvalidPong, fmt.Errorf("got sequence %d, want %d", pong.Seq, seq))
+	}
+
+	return rtt, nil
+}
+
+// Echo replies to latency probes until the end message.
+// Other frames are passed to the handler, they are unexpected if it's nil.
+func (c *Conn) Echo(handler func(t Type, payload []byte) error) (*End, error) {
+	for {
+		t, length, err := c.readHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := c.readPayload(t, length)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t {
+		case TypePing:
+			if err = c.WriteFrame(TypePong, payload); err != nil {
+				return nil, err
+			}
+		case TypeEnd:
+			end := &End{}
+			if err = json.Unmarshal(payload, end); err != nil {
+				return nil, fmt.Errorf("decode %s message: %w", t, err)
+			}
+			return end, nil
+		case TypeError:
+			return nil, remoteError(payload)
+		default:
+			if handler == nil {
+				return nil, errors.Join(ErrUnexpectedFrame, fmt.Errorf("got %s, want %s", t, TypeEnd))
+			}
+
+			if err = handler(t, payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Package protocol implements a framed control protocol between client and server.
+//
+// Every connection starts with a preamble sent by the client:
+// +-------+---------+
+// | magic | version |
+// +-------+---------+
+// |   4   |    1    |
+// +-------+---------+
+//
+// Server replies with Hello frame if the version is supported or with Error frame otherwise.
+// Supported versions are in range MinVersion..Version, Hello contains the version used by the connection,
+// it's the least of the client's and server's ones, so newer frames are sent only if both sides support them.
+// All next messages are frames:
+// +------+--------+---------+
+// | type | length | payload |
+// +------+--------+---------+
+// |   1  |    4   |  length |
+// +------+--------+---------+
+//
+// Auth and Data frames contain raw bytes, other ones are JSON encoded messages,
+// so new optional fields can be added without breaking compatibility.
+//
+// Test session is held by a control connection:
+//  1. client -> server: preamble
+//  2. server -> client: Hello (or Error)
+//  3. client -> server: Auth
+//  4. server -> client: Auth (or Error)
+//  5. client -> server: Params (without session ID)
+//  6. server -> client: Params (negotiated values with new session ID, or Error)
+//  7. client -> server: Ping, server -> client: Pong with the same payload (latency probes, any number)
+//  8. client -> server: End, when all streams are finished
+//
+// Every data stream is a separate connection that joins to the session:
+//
+//	1-4. the same as for the control connection
+//	5. client -> server: Params (session ID and stream index)
+//	6. server -> client: Params (session values, or Error)
+//	7. server -> client: Start
+//	8. sender -> receiver: Data, ..., Data, End
+//	   receiver -> sender: Stats, ..., Stats (periodically, while data is transferred)
+//	9. receiver -> sender: Result
+//
+// Version 1 clients don't use sessions, every direction is tested by one connection:
+// Params have only the duration, then server sends Start and the data transfer is done
+// over the same connection in the direction of client's token.
+//
+// Version 2 clients don't send Ping and Flow frames, their control connection waits only End.
+//
+// UDP flow is done over the control connection of the session with UDP parameter:
+//
+//  1. client -> server: Flow (direction)
+//  2. for download the client sends registration datagrams until Start
+//  3. server -> client: Start
+//  4. sender -> receiver: datagrams, then End over the control connection
+//  5. receiver -> sender: Result with datagrams statistics
+//
+// Any side can send Error frame instead of the expected one to abort the test.
+// If the connection is closed before the end of the test, the transfer is considered truncated.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Protocol versions.
+const (
+	// MinVersion is the oldest supported protocol version, it tests one direction by one connection.
+	MinVersion uint8 = 1
+
+	// VersionStreams adds sessions with parallel data streams.
+	VersionStreams uint8 = 2
+
+	// VersionLatency adds latency probes and UDP flows.
+	VersionLatency uint8 = 3
+
+	// Version is the current protocol version.
+	Version = VersionLatency
+)
+
+// Type is a frame type.
+type Type uint8
+
+// Available frame types.
+const (
+	TypeError Type = iota
+	TypeHello
+	TypeAuth
+	TypeParams
+	TypeStart
+	TypeData
+	TypeStats
+	TypeEnd
+	TypeResult
+	TypePing
+	TypePong
+	TypeFlow
+)
+
+const (
+	lenMagic    = 4
+	lenPreamble = lenMagic + 1
+	lenHeader   = 5
+
+	// MaxPayloadSize is a maximum size of control frame payload.
+	MaxPayloadSize = 64 * 1024
+
+	// MaxDataSize is a maximum size of data frame payload.
+	MaxDataSize = 1024 * 1024
+
+	// StatsInterval is a period of receiver's statistics messages.
+	StatsInterval = time.Second
+)
+
+// magic is a protocol preamble prefix.
+var magic = [lenMagic]byte{'S', 'P', 'T', 'S'}
+
+// Error codes.
+const (
+	CodeVersion      = "unsupported_version"
+	CodeUnauthorized = "unauthorized"
+	CodeParams       = "invalid_params"
+	CodeBusy         = "busy"
+	CodeForbidden    = "forbidden"
+	CodeAborted      = "aborted"
+	CodeInternal     = "internal"
+)
+
+// End reasons.
+const (
+	ReasonDuration = "duration"
+	ReasonBytes    = "bytes"
+	ReasonCanceled = "canceled"
+)
+
+var (
+	// ErrUnsupportedVersion is returned when the protocol version is not supported.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrUnexpectedFrame is returned when the frame type is not expected.
+	ErrUnexpectedFrame = errors.New("unexpected frame")
+
+	// ErrFrameSize is returned when the frame payload is too big.
+	ErrFrameSize = errors.New("invalid frame size")
+
+	// ErrRejected is returned when the remote side rejected the request.
+	ErrRejected = errors.New("rejected")
+
+	// ErrSizeLimit is returned when the sender exceeds the negotiated size limit.
+	ErrSizeLimit = errors.New("size limit is exceeded")
+)
+
+// String implements Stringer interface.
+func (t Type) String() string {
+	switch t {
+	case TypeError:
+		return "error"
+	case TypeHello:
+		return "hello"
+	case TypeAuth:
+		return "auth"
+	case TypeParams:
+		return "params"
+	case TypeStart:
+		return "start"
+	case TypeData:
+		return "data"
+	case TypeStats:
+		return "stats"
+	case TypeEnd:
+		return "end"
+	case TypeResult:
+		return "result"
+	case TypePing:
+		return "ping"
+	case TypePong:
+		return "pong"
+	case TypeFlow:
+		return "flow"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Hello is a server's reply to the client's preamble, Version is the protocol version used by the connection,
+// Token is the newest auth token format version accepted by the server,
+// Challenge is a random value to sign by the client's token.
+type Hello struct {
+	Version   uint8     `json:"version"`
+	Time      time.Time `json:"time"`
+	Token     uint8     `json:"token,omitempty"`
+	Challenge []byte    `json:"challenge,omitempty"`
+}
+
+// Params are test parameters, client sends requested values, server replies with negotiated ones.
+// Session is zero for a new session request, Stream is an index of the data stream in the session.
+// Duration is a test duration for every direction, Bytes is an optional data size limit
+// for every direction, it's shared between all streams.
+// UDP session uses datagrams flows with Bitrate (bits per second) and PacketSize instead of streams,
+// servers without UDP support reply with false UDP value.
+// NoDownload and NoUpload are set by the server if the client is not allowed to test these directions.
+// ClientIP is set by the server, it's the client's IP address as the server sees it.
+type Params struct {
+	Session    uint64        `json:"session,omitempty"`
+	Streams    int           `json:"streams,omitempty"`
+	Stream     int           `json:"stream,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	Bytes      uint64        `json:"bytes,omitempty"`
+	UDP        bool          `json:"udp,omitempty"`
+	Bitrate    uint64        `json:"bitrate,omitempty"`
+	PacketSize int           `json:"packet_size,omitempty"`
+	NoDownload bool          `json:"no_download,omitempty"`
+	NoUpload   bool          `json:"no_upload,omitempty"`
+	ClientIP   string        `json:"client_ip,omitempty"`
+}
+
+// NegotiateVersion returns the protocol version used with the remote side of the version,
+// newer remote versions are downgraded to the current one.
+func NegotiateVersion(version uint8) (uint8, error) {
+	if version < MinVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	return min(version, Version), nil
+}
+
+// Allowed returns true if the direction is allowed in the session.
+func (p *Params) Allowed(download bool) bool {
+	if download {
+		return !p.NoDownload
+	}
+
+	return !p.NoUpload
+}
+
+// StreamBytes returns data size limit of the stream, zero means no limit.
+func (p *Params) StreamBytes(stream int) uint64 {
+	if p.Bytes == 0 {
+		return 0
+	}
+
+	streams := uint64(max(p.Streams, 1))
+	size := p.Bytes / streams
+
+	if uint64(stream) < p.Bytes%streams {
+		size++
+	}
+
+	return size
+}
+
+// FlowDatagrams returns the max number of datagrams of the session's UDP flow.
+func (p *Params) FlowDatagrams() uint64 {
+	return MaxDatagrams(p.Bitrate, p.PacketSize, p.Duration)
+}
+
+// FlowBytes returns the max data size of the session's UDP flow by its bitrate, datagram size and duration.
+func (p *Params) FlowBytes() uint64 {
+	return p.FlowDatagrams() * uint64(max(p.PacketSize, DatagramHeaderSize))
+}
+
+// Start is a test start message.
+type Start struct {
+	Time time.Time `json:"time"`
+}
+
+// Stats is a periodic receiver's statistics message, Count is a total number of received bytes.
+type Stats struct {
+	Count uint64    `json:"count"`
+	Time  time.Time `json:"time"`
+}
+
+// End is a sender's message about the end of data transfer, Count is a total number of sent bytes.
+type End struct {
+	Count  uint64 `json:"count"`
+	Reason string `json:"reason"`
+}
+
+// Ping is a latency probe message, the remote side replies with Pong frame containing the same payload.
+type Ping struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+}
+
+// Error is an error message from the remote side.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements error interface.
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+
+	return e.Code + ": " + e.Message
+}
+
+// Unwrap returns a sentinel error by the error code.
+func (e *Error) Unwrap() error {
+	if e.Code == CodeVersion {
+		return ErrUnsupportedVersion
+	}
+
+	return ErrRejected
+}
@@ -0,0 +1,790 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+func TestType_String(t *testing.T) {
+	testCases := []struct {
+		t    Type
+		want string
+	}{
+		{t: TypeError, want: "error"},
+		{t: TypeHello, want: "hello"},
+		{t: TypeData, want: "data"},
+		{t: TypeResult, want: "result"},
+		{t: TypePong, want: "pong"},
+		{t: Type(200), want: "unknown(200)"},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.t.String(); got != tc.want {
+			t.Errorf("want %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestConn_Preamble(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := NewConn(&buf)
+	if err := c.WritePreamble(Version); err != nil {
+		t.Fatalf("failed to write preamble: %v", err)
+	}
+
+	version, err := c.ReadPreamble()
+	if err != nil {
+		t.Fatalf("failed to read preamble: %v", err)
+	}
+
+	if version != Version {
+		t.Errorf("want %d, got %d", Version, version)
+	}
+
+	// legacy client sends auth token instead of preamble
+	buf.Write([]byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x00})
+	if _, err = c.ReadPreamble(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("want %v, got %v", ErrUnsupportedVersion, err)
+	}
+
+	if _, err = c.ReadPreamble(); err == nil {
+		t.Error("want error for short preamble")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	testCases := []struct {
+		name     string
+		version  uint8
+		expected uint8
+		err      bool
+	}{
+		{name: "zero", version: 0, err: true},
+		{name: "min", version: MinVersion, expected: MinVersion},
+		{name: "streams", version: VersionStreams, expected: VersionStreams},
+		{name: "current", version: Version, expected: Version},
+		{name: "newer", version: Version + 1, expected: Version},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			version, err := NegotiateVersion(tc.version)
+			if tc.err {
+				if !errors.Is(err, ErrUnsupportedVersion) {
+					t.Errorf("want %v, got %v", ErrUnsupportedVersion, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if version != tc.expected {
+				t.Errorf("want %d, got %d", tc.expected, version)
+			}
+		})
+	}
+}
+
+func TestConn_Message(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		params = &Params{Duration: 3 * time.Second}
+		got    = &Params{}
+	)
+
+	c := NewConn(&buf)
+	if err := c.WriteMessage(TypeParams, params); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	if err := c.ReadMessage(TypeParams, got); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	if *got != *params {
+		t.Errorf("want %v, got %v", params, got)
+	}
+
+	if err := c.WriteMessage(TypeStart, &Start{}); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	if err := c.ReadMessage(TypeParams, got); !errors.Is(err, ErrUnexpectedFrame) {
+		t.Errorf("want %v, got %v", ErrUnexpectedFrame, err)
+	}
+}
+
+func TestConn_Error(t *testing.T) {
+	testCases := []struct {
+		name string
+		code string
+		want error
+	}{
+		{name: "version", code: CodeVersion, want: ErrUnsupportedVersion},
+		{name: "unauthorized", code: CodeUnauthorized, want: ErrRejected},
+		{name: "internal", code: CodeInternal, want: ErrRejected},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				buf    bytes.Buffer
+				remote *Error
+			)
+
+			c := NewConn(&buf)
+			if err := c.WriteError(tc.code, "details"); err != nil {
+				t.Fatalf("failed to write error: %v", err)
+			}
+
+			_, err := c.ReadFrame(TypeAuth)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("want %v, got %v", tc.want, err)
+			}
+
+			if !errors.As(err, &remote) {
+				t.Fatalf("want remote error, got %T", err)
+			}
+
+			if s := remote.Error(); s != tc.code+": details" {
+				t.Errorf("unexpected error message %q", s)
+			}
+		})
+	}
+}
+
+func TestConn_FrameSize(t *testing.T) {
+	var buf bytes.Buffer
+
+	header := make([]byte, lenHeader)
+	header[0] = byte(TypeParams)
+	binary.BigEndian.PutUint32(header[1:], MaxPayloadSize+1)
+	buf.Write(header)
+
+	c := NewConn(&buf)
+	if _, err := c.ReadFrame(TypeParams); !errors.Is(err, ErrFrameSize) {
+		t.Errorf("want %v, got %v", ErrFrameSize, err)
+	}
+}
+
+func TestConn_Data(t *testing.T) {
+	const size = 3*MaxDataSize + 100
+
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		result         = make(chan error, 1)
+		stats          int
+	)
+
+	go func() {
+		w := common.NewCounter(io.Discard)
+		stop := receiver.StartStats(w, time.Millisecond, nil)
+		end, err := receiver.ReadData(w)
+
+		// wait some statistics messages
+		time.Sleep(5 * time.Millisecond)
+		stop()
+
+		if err != nil {
+			result <- err
+			return
+		}
+
+		if report := w.Report(); report.Count != end.Count {
+			result <- errors.New("invalid received count")
+			return
+		}
+
+		result <- receiver.WriteMessage(TypeResult, w.Report())
+	}()
+
+	reports := make(chan *common.Report, 1)
+	go func() {
+		report, err := sender.ReadResult(func(*Stats) { stats++ })
+		if err != nil {
+			t.Errorf("failed to read result: %v", err)
+		}
+		reports <- report
+	}()
+
+	n, err := sender.Writer().Write(make([]byte, size))
+	if err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+
+	if n != size {
+		t.Errorf("want %d, got %d", size, n)
+	}
+
+	if err = sender.WriteMessage(TypeEnd, &End{Count: uint64(n), Reason: ReasonDuration}); err != nil {
+		t.Fatalf("failed to write end: %v", err)
+	}
+
+	if err = <-result; err != nil {
+		t.Fatalf("receiver error: %v", err)
+	}
+
+	report := <-reports
+	if report == nil || report.Count != size {
+		t.Errorf("want %d, got %v", size, report)
+	}
+
+	if stats == 0 {
+		t.Error("want statistics messages")
+	}
+
+	if err = errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_SendReceive(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		received       = make(chan *common.Report, 1)
+	)
+
+	go func() {
+		report, err := receiver.Receive(context.Background(), 0, nil)
+		if err != nil {
+			t.Errorf("failed to receive: %v", err)
+		}
+		received <- report
+	}()
+
+	report, err := sender.Send(context.Background(), 10*time.Millisecond, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if r := <-received; r.Count != report.Count || r.Count == 0 {
+		t.Errorf("want %d, got %d", r.Count, report.Count)
+	}
+
+	if err = errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_SendBytes(t *testing.T) {
+	const size = 2*MaxDataSize + 10
+
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		received       = make(chan *common.Report, 1)
+	)
+
+	go func() {
+		report, err := receiver.Receive(context.Background(), 0, nil)
+		if err != nil {
+			t.Errorf("failed to receive: %v", err)
+		}
+		received <- report
+	}()
+
+	report, err := sender.Send(context.Background(), time.Minute, size, nil)
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if report.Count != size {
+		t.Errorf("want %d, got %d", size, report.Count)
+	}
+
+	if r := <-received; r.Count != size {
+		t.Errorf("want received %d, got %d", size, r.Count)
+	}
+
+	if err = errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_Goroutines(t *testing.T) {
+	const transfers = 20
+
+	testCases := []struct {
+		name string
+		size uint64
+	}{
+		{name: "duration"},
+		{name: "bytes", size: 1000},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			for j := 0; j < transfers; j++ {
+				var (
+					client, server = net.Pipe()
+					sender         = NewConn(client)
+					receiver       = NewConn(server)
+					received       = make(chan error, 1)
+				)
+
+				go func() {
+					_, err := receiver.Receive(context.Background(), 0, nil)
+					received <- err
+				}()
+
+				if _, err := sender.Send(context.Background(), 5*time.Millisecond, tc.size, nil); err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+
+				if err := <-received; err != nil {
+					t.Fatalf("failed to receive: %v", err)
+				}
+
+				if err := errors.Join(client.Close(), server.Close()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// finished goroutines can be counted for a while
+			after := runtime.NumGoroutine()
+			for deadline := time.Now().Add(time.Second); after > before && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				after = runtime.NumGoroutine()
+			}
+
+			if after > before {
+				t.Errorf("goroutines leak: %d before transfers, %d after", before, after)
+			}
+		})
+	}
+}
+
+func TestParams_StreamBytes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		params Params
+		stream int
+		want   uint64
+	}{
+		{name: "unlimited", params: Params{Streams: 2}, stream: 0, want: 0},
+		{name: "single", params: Params{Streams: 1, Bytes: 100}, stream: 0, want: 100},
+		{name: "even", params: Params{Streams: 4, Bytes: 100}, stream: 3, want: 25},
+		{name: "remainder_first", params: Params{Streams: 3, Bytes: 100}, stream: 0, want: 34},
+		{name: "remainder_last", params: Params{Streams: 3, Bytes: 100}, stream: 2, want: 33},
+		{name: "zero_streams", params: Params{Bytes: 100}, stream: 0, want: 100},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.params.StreamBytes(tc.stream); got != tc.want {
+				t.Errorf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParams_FlowBytes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		params Params
+		want   uint64
+	}{
+		{name: "paced", params: Params{Bitrate: 8000, PacketSize: 100, Duration: time.Second}, want: 1100},
+		{name: "one_datagram", params: Params{Bitrate: 8000, PacketSize: 100, Duration: time.Millisecond}, want: 100},
+		{name: "min_size", params: Params{Bitrate: 8 * DatagramHeaderSize, Duration: time.Second}, want: 2 * DatagramHeaderSize},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.params.FlowBytes(); got != tc.want {
+				t.Errorf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestConn_Truncated(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+	)
+
+	go func() {
+		if _, err := sender.Writer().Write(make([]byte, 1024)); err != nil {
+			t.Errorf("failed to write data: %v", err)
+		}
+		_ = client.Close() // connection is closed without end message
+	}()
+
+	report, err := receiver.Receive(context.Background(), 0, nil)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("want %v, got %v", ErrTruncated, err)
+	}
+
+	if report.Count != 1024 {
+		t.Errorf("want partial report 1024 bytes, got %d", report.Count)
+	}
+
+	if err = server.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_Aborted(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		receiverErr    = make(chan error, 1)
+	)
+
+	go func() {
+		_, err := receiver.Receive(context.Background(), 0, nil)
+		receiverErr <- err
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := sender.Send(ctx, time.Second, 0, nil); !errors.Is(err, ErrAborted) {
+		t.Errorf("sender want %v, got %v", ErrAborted, err)
+	}
+
+	if err := <-receiverErr; !errors.Is(err, ErrAborted) {
+		t.Errorf("receiver want %v, got %v", ErrAborted, err)
+	}
+
+	if err := errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_ReceiveLimit(t *testing.T) {
+	const size = MaxDataSize + 10
+
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		senderErr      = make(chan error, 1)
+	)
+
+	go func() {
+		// the sender ignores the receiver's size limit
+		_, err := sender.Send(context.Background(), time.Minute, 3*size, nil)
+		senderErr <- err
+	}()
+
+	report, err := receiver.Receive(context.Background(), size, nil)
+	if !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("want %v, got %v", ErrSizeLimit, err)
+	}
+
+	if report.Count != size {
+		t.Errorf("want partial report %d bytes, got %d", size, report.Count)
+	}
+
+	if err = errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+
+	if err = <-senderErr; err == nil {
+		t.Error("want sender error")
+	}
+}
+
+func TestConn_Ping(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		ends           = make(chan *End, 1)
+	)
+
+	go func() {
+		end, err := receiver.Echo(nil)
+		if err != nil {
+			t.Errorf("failed to echo: %v", err)
+		}
+		ends <- end
+	}()
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		rtt, err := sender.Ping(seq)
+		if err != nil {
+			t.Fatalf("failed to ping: %v", err)
+		}
+
+		if rtt <= 0 {
+			t.Errorf("invalid rtt %v", rtt)
+		}
+	}
+
+	if err := sender.WriteMessage(TypeEnd, &End{Reason: ReasonDuration}); err != nil {
+		t.Fatalf("failed to write end: %v", err)
+	}
+
+	if end := <-ends; end == nil || end.Reason != ReasonDuration {
+		t.Errorf("unexpected end message %+v", end)
+	}
+
+	// invalid reply
+	go func() {
+		if _, err := receiver.ReadFrame(TypePing); err != nil {
+			t.Errorf("failed to read ping: %v", err)
+		}
+
+		if err := receiver.WriteMessage(TypePong, &Ping{Seq: 100}); err != nil {
+			t.Errorf("failed to write pong: %v", err)
+		}
+	}()
+
+	if _, err := sender.Ping(1); !errors.Is(err, ErrInvalidPong) {
+		t.Errorf("want %v, got %v", ErrInvalidPong, err)
+	}
+
+	if err := errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	buf := make([]byte, DatagramHeaderSize+10)
+	d := &Datagram{Session: 7, Seq: 42, Time: time.Unix(0, 123456789)}
+	d.Encode(buf)
+
+	got, err := DecodeDatagram(buf)
+	if err != nil {
+		t.Fatalf("failed to decode datagram: %v", err)
+	}
+
+	if got.Session != d.Session || got.Seq != d.Seq || !got.Time.Equal(d.Time) {
+		t.Errorf("want %+v, got %+v", d, got)
+	}
+
+	if _, err = DecodeDatagram(buf[:DatagramHeaderSize-1]); !errors.Is(err, ErrDatagram) {
+		t.Errorf("want %v, got %v", ErrDatagram, err)
+	}
+}
+
+func TestDatagramCounter(t *testing.T) {
+	var (
+		c     = NewDatagramCounter(0, 0)
+		start = time.Now()
+	)
+
+	// datagram 3 is lost, 5 is reordered, 2 is duplicated, registration one is ignored
+	for _, seq := range []uint64{0, 1, 2, 2, 4, 6, 5} {
+		sent := start.Add(time.Duration(seq) * time.Millisecond)
+		c.Add(&Datagram{Session: 1, Seq: seq, Time: sent}, 100, sent.Add(time.Millisecond))
+	}
+
+	r := c.Report(6)
+	if r.Received != 5 || r.Lost != 1 || r.OutOfOrder != 1 || r.Duplicates != 1 || r.Count != 500 {
+		t.Errorf("unexpected report %+v", r)
+	}
+
+	// constant transit time
+	if r.Jitter != 0 {
+		t.Errorf("want zero jitter, got %v", r.Jitter)
+	}
+}
+
+func TestDatagramCounter_Sequence(t *testing.T) {
+	var (
+		c   = NewDatagramCounter(10, 0)
+		now = time.Now()
+	)
+
+	// sequence numbers over the flow's datagrams number don't allocate memory
+	for _, seq := range []uint64{1, 10, 11, maxSequence} {
+		c.Add(&Datagram{Session: 1, Seq: seq, Time: now}, 100, now)
+	}
+
+	if r := c.Report(10); r.Received != 2 || r.Count != 200 {
+		t.Errorf("unexpected report %+v", r)
+	}
+
+	if n := len(c.seen); n != 1 {
+		t.Errorf("want 1 word of seen datagrams, got %d", n)
+	}
+
+	// zero value means the protocol's limit
+	if c = NewDatagramCounter(0, 0); c.datagrams != maxSequence {
+		t.Errorf("want %d datagrams, got %d", maxSequence, c.datagrams)
+	}
+}
+
+func TestDatagramCounter_Size(t *testing.T) {
+	c := NewDatagramCounter(0, 250)
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		select {
+		case <-c.Exceeded():
+			t.Errorf("size limit is exceeded before datagram %d", seq)
+		default:
+		}
+
+		c.Add(&Datagram{Session: 1, Seq: seq, Time: time.Now()}, 100, time.Now())
+	}
+
+	select {
+	case <-c.Exceeded():
+	default:
+		t.Error("size limit is not exceeded")
+	}
+
+	// the datagram over the limit is not counted
+	if r := c.Report(3); r.Received != 2 || r.Count != 200 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
+
+func TestSendDatagrams(t *testing.T) {
+	const (
+		size     = 125
+		duration = 100 * time.Millisecond
+		interval = time.Millisecond
+	)
+
+	var count uint64
+	write := func(b []byte) error {
+		if len(b) != size {
+			return fmt.Errorf("unexpected size %d", len(b))
+		}
+		count++
+		return nil
+	}
+
+	// 1000 datagrams per second
+	start := time.Now()
+	sent, err := SendDatagrams(context.Background(), write, 1, size*8*uint64(time.Second/interval), size, duration)
+	if err != nil {
+		t.Fatalf("failed to send datagrams: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if sent != count {
+		t.Errorf("want %d sent, got %d", count, sent)
+	}
+
+	// the first datagram is sent immediately, the deadline timer can fire a bit later than the duration,
+	// so the pacing is checked by the real elapsed time
+	if limit := uint64(elapsed/interval) + 1; sent < 50 || sent > limit {
+		t.Errorf("unexpected number of datagrams %d, limit %d for %v", sent, limit, elapsed)
+	}
+
+	// the receiver's limit of the flow
+	if limit := MaxDatagrams(size*8*uint64(time.Second/interval), size, duration); sent > limit {
+		t.Errorf("want not more than %d datagrams, got %d", limit, sent)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = SendDatagrams(ctx, write, 1, size*8*1000, size, duration); !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestConn_Flow(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		counter        = NewDatagramCounter(0, 0)
+		received       = make(chan *common.UDPReport, 1)
+		params         = &Params{Session: 1, Duration: 20 * time.Millisecond, Bitrate: 8 * 1000 * 100, PacketSize: 100}
+	)
+
+	go func() {
+		report, err := receiver.ReceiveFlow(counter)
+		if err != nil {
+			t.Errorf("failed to receive flow: %v", err)
+		}
+		received <- report
+	}()
+
+	// every second datagram is lost
+	report, err := sender.SendFlow(context.Background(), func(b []byte) error {
+		d, e := DecodeDatagram(b)
+		if e != nil {
+			return e
+		}
+
+		if d.Seq%2 == 1 {
+			counter.Add(d, len(b), time.Now())
+		}
+		return nil
+	}, params)
+
+	if err != nil {
+		t.Fatalf("failed to send flow: %v", err)
+	}
+
+	if r := <-received; r.Sent != report.Sent || r.Received != report.Received {
+		t.Errorf("want %+v, got %+v", r, report)
+	}
+
+	if report.Sent == 0 || report.Lost != report.Sent/2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	if err = errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConn_FlowSize(t *testing.T) {
+	var (
+		client, server = net.Pipe()
+		sender         = NewConn(client)
+		receiver       = NewConn(server)
+		counter        = NewDatagramCounter(0, 100)
+		received       = make(chan error, 1)
+	)
+
+	go func() {
+		_, err := receiver.ReceiveFlow(counter)
+		received <- err
+	}()
+
+	// the sender exceeds the size limit, so the flow is aborted before its end message
+	for seq := uint64(1); seq <= 2; seq++ {
+		counter.Add(&Datagram{Session: 1, Seq: seq, Time: time.Now()}, 100, time.Now())
+	}
+
+	if err := sender.ReadMessage(TypeResult, &common.UDPReport{}); !errors.Is(err, ErrRejected) {
+		t.Errorf("sender want %v, got %v", ErrRejected, err)
+	}
+
+	if err := <-received; !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("receiver want %v, got %v", ErrSizeLimit, err)
+	}
+
+	if err := errors.Join(client.Close(), server.Close()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+// abortWait is a time to wait the receiver's error message after failed data sending.
+const abortWait = 100 * time.Millisecond
+
+var (
+	// ErrTruncated is returned when data transfer was interrupted before the end of the test.
+	ErrTruncated = errors.New("truncated transfer")
+
+	// ErrAborted is returned when the test was aborted by one of the sides.
+	ErrAborted = errors.New("aborted transfer")
+)
+
+// limitWriter is a writer, which fails if more than left bytes are written.
+type limitWriter struct {
+	w    io.Writer
+	left uint64
+}
+
+// Write implements io.Writer interface, only allowed part of p is written before ErrSizeLimit.
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) <= l.left {
+		n, err := l.w.Write(p)
+		l.left -= uint64(n)
+		return n, err
+	}
+
+	n, err := l.w.Write(p[:l.left])
+	l.left -= uint64(n)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, ErrSizeLimit
+}
+
+type result struct {
+	report *common.Report
+	err    error
+}
+
+// Err returns nil if the test was finished normally or ErrAborted otherwise.
+func (e *End) Err() error {
+	if e.Reason == ReasonDuration || e.Reason == ReasonBytes {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrAborted, e.Reason)
+}
+
+// transferError wraps an error of interrupted data transfer.
+func transferError(err error) error {
+	var remote *Error
+
+	if errors.As(err, &remote) || errors.Is(err, context.Canceled) {
+		return errors.Join(ErrAborted, err)
+	}
+
+	return errors.Join(ErrTruncated, err)
+}
+
+// Send writes data frames during the test duration or until size bytes are sent (zero size means no limit),
+// then it sends the end message and waits the receiver's result.
+// Function f is called for every receiver's statistics message, it can be nil.
+// The returned report is not nil even if the error is not nil, then it contains partial sender's values.
+func (c *Conn) Send(ctx context.Context, duration time.Duration, size uint64, f func(*Stats)) (*common.Report, error) {
+	var (
+		n       int64
+		err     error
+		results = make(chan result, 1)
+	)
+
+	go func() {
+		report, e := c.ReadResult(f)
+		results <- result{report: report, err: e}
+	}()
+
+	dataCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	start := time.Now()
+	r := common.NewReader(dataCtx)
+
+	if size > 0 {
+		n, err = io.CopyN(c.Writer(), r, int64(size))
+		if errors.Is(err, io.EOF) {
+			err = nil // duration is reached before the size limit
+		}
+	} else {
+		n, err = io.Copy(c.Writer(), r)
+	}
+
+	sent := &common.Report{Count: uint64(n), First: start, Last: time.Now()}
+
+	end := &End{Count: uint64(n), Reason: ReasonDuration}
+	switch {
+	case size > 0 && uint64(n) == size:
+		end.Reason = ReasonBytes
+	case errors.Is(err, context.Canceled):
+		end.Reason = ReasonCanceled
+	case err != nil:
+		// the receiver could stop the test and send a reason before connection closing
+		select {
+		case res := <-results:
+			if res.err != nil {
+				err = errors.Join(err, res.err)
+			}
+		case <-time.After(abortWait):
+		}
+		return sent, transferError(err)
+	}
+
+	if err = c.WriteMessage(TypeEnd, end); err != nil {
+		return sent, transferError(err)
+	}
+
+	res := <-results
+	if res.err != nil {
+		return sent, transferError(res.err)
+	}
+
+	return res.report, end.Err()
+}
+
+// Receive reads data frames until the end message, periodically sending statistics messages,
+// then it replies with the result. Positive size aborts the transfer as soon as the sender exceeds it.
+// Function f is called for every sent statistics message, it can be nil.
+// The returned report is not nil even if the error is not nil, then it contains partial received values.
+func (c *Conn) Receive(ctx context.Context, size uint64, f func(*Stats)) (*common.Report, error) {
+	var (
+		w              = common.NewCounter(common.NewWriter(ctx))
+		data io.Writer = w
+	)
+
+	if size > 0 {
+		data = &limitWriter{w: w, left: size}
+	}
+
+	stopStats := c.StartStats(w, StatsInterval, f)
+	end, err := c.ReadData(data)
+	stopStats()
+
+	report := w.Report()
+	if err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			// notify the sender, it's not important if it fails
+			err = errors.Join(err, c.WriteError(CodeAborted, "receiver stopped"))
+		case errors.Is(err, ErrSizeLimit):
+			err = errors.Join(err, c.WriteError(CodeAborted, ErrSizeLimit.Error()))
+		}
+		return report, transferError(err)
+	}
+
+	if err = c.WriteMessage(TypeResult, report); err != nil {
+		return report, transferError(err)
+	}
+
+	return report, end.Err()
+}
@@ -0,0 +1,308 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+// UDP datagram is sent outside the framed connection, it has a header:
+// +---------+----------+------------+---------+
+// | session | sequence | send time  | padding |
+// +---------+----------+------------+---------+
+// |    8    |    8     |     8      |   ...   |
+// +---------+----------+------------+---------+
+//
+// Session ID is known only by the authorized client, so it authorizes the flow.
+// Zero sequence is used by the client to register its address before the server's sending,
+// data datagrams are numbered from 1.
+const (
+	// DatagramHeaderSize is a size of the datagram header.
+	DatagramHeaderSize = 24
+
+	// MaxDatagramSize is a maximum size of UDP datagram payload.
+	MaxDatagramSize = 65507
+
+	// DefaultPacketSize is a default datagram size, it fits into common MTU.
+	DefaultPacketSize = 1400
+
+	// DefaultBitrate is a default UDP flow bitrate in bits per second.
+	DefaultBitrate = 10 * 1024 * 1024
+
+	// DefaultMaxBitrate is a default server's limit of UDP flows bitrate in bits per second.
+	DefaultMaxBitrate = 100 * 1024 * 1024
+
+	// RegisterInterval is a period of client's registration datagrams.
+	RegisterInterval = 100 * time.Millisecond
+
+	// Linger is a time to wait late datagrams after the sender's end message.
+	Linger = 200 * time.Millisecond
+
+	// maxSequence limits memory used to detect duplicates of any flow.
+	maxSequence = 1 << 27
+
+	// maxPacingSleep is a maximum sleep between datagrams of the paced sending.
+	maxPacingSleep = time.Millisecond
+)
+
+// ErrDatagram is returned for invalid datagrams.
+var ErrDatagram = errors.New("invalid datagram")
+
+// Flow is a client's request to start UDP flow in the session.
+type Flow struct {
+	Download bool `json:"download"`
+}
+
+// Datagram is a UDP datagram header.
+type Datagram struct {
+	Session uint64
+	Seq     uint64
+	Time    time.Time
+}
+
+// Encode writes the header to the beginning of b, it must have at least DatagramHeaderSize length.
+func (d *Datagram) Encode(b []byte) {
+	binary.BigEndian.PutUint64(b, d.Session)
+	binary.BigEndian.PutUint64(b[8:], d.Seq)
+	binary.BigEndian.PutUint64(b[16:], uint64(d.Time.UnixNano()))
+}
+
+// DecodeDatagram reads the datagram header.
+func DecodeDatagram(b []byte) (*Datagram, error) {
+	if len(b) < DatagramHeaderSize {
+		return nil, errors.Join(ErrDatagram, fmt.Errorf("size %d", len(b)))
+	}
+
+	d := &Datagram{
+		Session: binary.BigEndian.Uint64(b),
+		Seq:     binary.BigEndian.Uint64(b[8:]),
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(b[16:]))),
+	}
+
+	return d, nil
+}
+
+// datagramInterval returns a sending interval of datagrams of the size with the bitrate.
+func datagramInterval(bitrate uint64, size int) time.Duration {
+	return time.Duration(float64(max(size, DatagramHeaderSize)*8) / float64(max(bitrate, 1)) * float64(time.Second))
+}
+
+// MaxDatagrams returns the max number of datagrams, which SendDatagrams can send with the parameters.
+func MaxDatagrams(bitrate uint64, size int, duration time.Duration) uint64 {
+	return uint64(duration/max(datagramInterval(bitrate, size), 1)) + 1
+}
+
+// SendDatagrams writes numbered datagrams of the size with the bitrate during the duration,
+// it returns the number of sent datagrams, it's not greater than MaxDatagrams even if the timer is late.
+func SendDatagrams(ctx context.Context, write func([]byte) error, session, bitrate uint64, size int, duration time.Duration) (uint64, error) {
+	var (
+		sent     uint64
+		buf      = make([]byte, max(size, DatagramHeaderSize))
+		interval = datagramInterval(bitrate, size)
+		limit    = MaxDatagrams(bitrate, size, duration)
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return sent, nil
+			}
+			return sent, ctx.Err()
+		default:
+		}
+
+		// the next datagram should be sent at sent*interval after the start
+		if wait := time.Duration(sent)*interval - time.Since(start); wait > 0 {
+			time.Sleep(min(wait, maxPacingSleep))
+			continue
+		}
+
+		if sent >= limit {
+			return sent, nil
+		}
+
+		d := &Datagram{Session: session, Seq: sent + 1, Time: time.Now()}
+		d.Encode(buf)
+
+		if err := write(buf); err != nil {
+			return sent, fmt.Errorf("write datagram: %w", err)
+		}
+		sent++
+	}
+}
+
+// DatagramCounter collects statistics of received datagrams, it can be used concurrently.
+// Datagrams with sequence numbers over the flow's datagrams number or over the size limit are not counted.
+type DatagramCounter struct {
+	mu          sync.Mutex
+	datagrams   uint64
+	size        uint64
+	exceeded    chan struct{}
+	seen        []uint64
+	maxSeq      uint64
+	received    uint64
+	bytes       uint64
+	outOfOrder  uint64
+	duplicates  uint64
+	jitter      float64
+	lastTransit time.Duration
+	first       time.Time
+	last        time.Time
+}
+
+// NewDatagramCounter returns a new datagrams counter of the flow with the max datagrams number,
+// e.g. by Params.FlowDatagrams, zero value means the protocol's limit. Positive size limits received bytes.
+func NewDatagramCounter(datagrams, size uint64) *DatagramCounter {
+	if datagrams == 0 || datagrams > maxSequence {
+		datagrams = maxSequence
+	}
+
+	return &DatagramCounter{datagrams: datagrams, size: size, exceeded: make(chan struct{})}
+}
+
+// Exceeded returns a channel, which is closed when the sender exceeds the size limit.
+func (c *DatagramCounter) Exceeded() <-chan struct{} {
+	return c.exceeded
+}
+
+// Add counts a data datagram of size bytes received at the arrival time.
+func (c *DatagramCounter) Add(d *Datagram, size int, arrival time.Time) {
+	// memory of duplicates detection is limited by the flow's datagrams number
+	if d.Seq == 0 || d.Seq > c.datagrams {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size > 0 && c.bytes+uint64(size) > c.size {
+		select {
+		case <-c.exceeded:
+		default:
+			close(c.exceeded)
+		}
+		return
+	}
+
+	i, bit := d.Seq/64, uint64(1)<<(d.Seq%64)
+	if i >= uint64(len(c.seen)) {
+		c.seen = append(c.seen, make([]uint64, i-uint64(len(c.seen))+1)...)
+	}
+
+	if c.seen[i]&bit != 0 {
+		c.duplicates++
+		return
+	}
+	c.seen[i] |= bit
+
+	if d.Seq < c.maxSeq {
+		c.outOfOrder++
+	} else {
+		c.maxSeq = d.Seq
+	}
+
+	// RFC 3550, clock offset between sides doesn't matter for the transit times difference
+	transit := arrival.Sub(d.Time)
+	if c.received > 0 {
+		diff := transit - c.lastTransit
+		c.jitter += (float64(max(diff, -diff)) - c.jitter) / 16
+	}
+	c.lastTransit = transit
+
+	if c.first.IsZero() {
+		c.first = arrival
+	}
+
+	c.last = arrival
+	c.received++
+	c.bytes += uint64(size)
+}
+
+// Report returns counter values, sent is a number of datagrams from the sender's end message.
+func (c *DatagramCounter) Report(sent uint64) *common.UDPReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := &common.UDPReport{
+		Report:     common.Report{Count: c.bytes, First: c.first, Last: c.last},
+		Sent:       sent,
+		Received:   c.received,
+		OutOfOrder: c.outOfOrder,
+		Duplicates: c.duplicates,
+		Jitter:     time.Duration(c.jitter),
+	}
+
+	if sent > c.received {
+		r.Lost = sent - c.received
+	}
+
+	return r
+}
+
+// SendFlow writes datagrams by the session parameters, then it sends the end message
+// over the control connection and waits the receiver's result.
+func (c *Conn) SendFlow(ctx context.Context, write func([]byte) error, params *Params) (*common.UDPReport, error) {
+	sent, err := SendDatagrams(ctx, write, params.Session, params.Bitrate, params.PacketSize, params.Duration)
+
+	end := &End{Count: sent, Reason: ReasonDuration}
+	switch {
+	case errors.Is(err, context.Canceled):
+		end.Reason = ReasonCanceled
+	case err != nil:
+		return nil, transferError(err)
+	}
+
+	if err = c.WriteMessage(TypeEnd, end); err != nil {
+		return nil, transferError(err)
+	}
+
+	report := &common.UDPReport{}
+	if err = c.ReadMessage(TypeResult, report); err != nil {
+		return nil, transferError(err)
+	}
+
+	return report, end.Err()
+}
+
+// ReceiveFlow waits the sender's end message over the control connection and late datagrams,
+// then it replies with the counter's result. If the sender exceeds counter's size limit,
+// the flow is aborted without waiting the end message, then the connection must be closed.
+func (c *Conn) ReceiveFlow(counter *DatagramCounter) (*common.UDPReport, error) {
+	var (
+		end  = &End{}
+		ends = make(chan error, 1)
+	)
+
+	go func() {
+		ends <- c.ReadMessage(TypeEnd, end)
+	}()
+
+	select {
+	case err := <-ends:
+		if err != nil {
+			return nil, transferError(err)
+		}
+	case <-counter.Exceeded():
+		err := errors.Join(ErrSizeLimit, c.WriteError(CodeAborted, ErrSizeLimit.Error()))
+		return counter.Report(0), transferError(err)
+	}
+
+	time.Sleep(Linger)
+	report := counter.Report(end.Count)
+
+	if err := c.WriteMessage(TypeResult, report); err != nil {
+		return report, transferError(err)
+	}
+
+	return report, end.Err()
+}
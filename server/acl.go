@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Access rules actions.
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+)
+
+var (
+	// ErrAccessRule is returned when an access rule is invalid.
+	ErrAccessRule = errors.New("invalid access rule")
+
+	// ErrAccessDenied is returned when a connection is rejected by access rules.
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// accessRule is an allowed or denied range of IP addresses.
+type accessRule struct {
+	allow  bool
+	prefix netip.Prefix
+}
+
+// String implements Stringer interface.
+func (r accessRule) String() string {
+	if r.allow {
+		return actionAllow + " " + r.prefix.String()
+	}
+
+	return actionDeny + " " + r.prefix.String()
+}
+
+// parsePrefix parses CIDR range or a single IP address.
+// IPv4-mapped IPv6 addresses and ranges are converted to IPv4 ones as clients' addresses are.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, errors.Join(ErrAccessRule, err)
+		}
+
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, errors.Join(ErrAccessRule, err)
+	}
+
+	prefix = prefix.Masked()
+	if addr := prefix.Addr(); addr.Is4In6() {
+		// a masked range with IPv4-mapped address has at least 96 bits
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix, nil
+}
+
+// parseRules returns allow or deny rules of CIDR ranges.
+func parseRules(allow bool, values []string) ([]accessRule, error) {
+	rules := make([]accessRule, 0, len(values))
+
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, accessRule{allow: allow, prefix: prefix})
+	}
+
+	return rules, nil
+}
+
+// loadRules reads access rules from the file with one "allow CIDR" or "deny CIDR" rule per line.
+// Empty lines and comments after "#" are skipped.
+func loadRules(name string) ([]accessRule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("access file: %w", err)
+	}
+
+	var (
+		rules   []accessRule
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 || (fields[0] != actionAllow && fields[0] != actionDeny) {
+			return nil, errors.Join(ErrAccessRule, fmt.Errorf("access file %s, line %d: want \"allow|deny CIDR\"", name, n))
+		}
+
+		prefix, e := parsePrefix(fields[1])
+		if e != nil {
+			return nil, errors.Join(e, fmt.Errorf("access file %s, line %d", name, n))
+		}
+
+		rules = append(rules, accessRule{allow: fields[0] == actionAllow, prefix: prefix})
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("access file %s: %w", name, err)
+	}
+
+	return rules, nil
+}
+
+// accessList is an immutable list of access rules.
+// Deny rules have priority, if there are allow rules, other addresses are denied.
+type accessList struct {
+	allow []accessRule
+	deny  []accessRule
+}
+
+// newAccessList creates a new access list by the rules.
+func newAccessList(rules []accessRule) *accessList {
+	a := &accessList{}
+
+	for _, r := range rules {
+		if r.allow {
+			a.allow = append(a.allow, r)
+		} else {
+			a.deny = append(a.deny, r)
+		}
+	}
+
+	return a
+}
+
+// check returns true if the address is allowed and a matched rule, it's empty if there are no rules.
+func (a *accessList) check(addr netip.Addr) (bool, string) {
+	if a == nil {
+		return true, ""
+	}
+
+	addr = addr.Unmap()
+
+	for _, r := range a.deny {
+		if r.prefix.Contains(addr) {
+			return false, r.String()
+		}
+	}
+
+	for _, r := range a.allow {
+		if r.prefix.Contains(addr) {
+			return true, r.String()
+		}
+	}
+
+	if len(a.allow) > 0 {
+		return false, "not allowed"
+	}
+
+	return true, ""
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		values   []string
+		expected []string
+		err      bool
+	}{
+		{name: "empty"},
+		{name: "skip_empty", values: []string{"", " "}},
+		{name: "cidr", values: []string{"10.1.2.3/8", "2001:db8::1/32"}, expected: []string{"allow 10.0.0.0/8", "allow 2001:db8::/32"}},
+		{name: "single", values: []string{"192.168.1.1", "::1", "::ffff:10.0.0.1"}, expected: []string{"allow 192.168.1.1/32", "allow ::1/128", "allow 10.0.0.1/32"}},
+		{
+			name:     "mapped_cidr",
+			values:   []string{"::ffff:10.1.2.3/104", "::ffff:192.168.1.1/128", "::ffff:0:0/96"},
+			expected: []string{"allow 10.0.0.0/8", "allow 192.168.1.1/32", "allow 0.0.0.0/0"},
+		},
+		{name: "invalid_ip", values: []string{"10.0.0.256"}, err: true},
+		{name: "invalid_bits", values: []string{"10.0.0.0/33"}, err: true},
+		{name: "hostname", values: []string{"localhost"}, err: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseRules(true, tc.values)
+			if tc.err {
+				if !errors.Is(err, ErrAccessRule) {
+					t.Errorf("want error %v, got %v", ErrAccessRule, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(rules) != len(tc.expected) {
+				t.Fatalf("want %d rules, got %d", len(tc.expected), len(rules))
+			}
+
+			for j, r := range rules {
+				if s := r.String(); s != tc.expected[j] {
+					t.Errorf("want rule %q, got %q", tc.expected[j], s)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected []string
+		err      bool
+	}{
+		{name: "empty"},
+		{
+			name:     "valid",
+			content:  "# customers\nallow 10.0.0.0/8\n\n  deny 10.1.0.0/16 # office\nallow 2001:db8::/32\n",
+			expected: []string{"allow 10.0.0.0/8", "deny 10.1.0.0/16", "allow 2001:db8::/32"},
+		},
+		{name: "unknown_action", content: "permit 10.0.0.0/8\n", err: true},
+		{name: "no_range", content: "allow\n", err: true},
+		{name: "extra_fields", content: "allow 10.0.0.0/8 10.1.0.0/16\n", err: true},
+		{name: "invalid_range", content: "deny 10.0.0.0/40\n", err: true},
+	}
+
+	dir := t.TempDir()
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(name, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("failed to write access file: %v", err)
+			}
+
+			rules, err := loadRules(name)
+			if tc.err {
+				if !errors.Is(err, ErrAccessRule) {
+					t.Errorf("want error %v, got %v", ErrAccessRule, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(rules) != len(tc.expected) {
+				t.Fatalf("want %d rules, got %d", len(tc.expected), len(rules))
+			}
+
+			for j, r := range rules {
+				if s := r.String(); s != tc.expected[j] {
+					t.Errorf("want rule %q, got %q", tc.expected[j], s)
+				}
+			}
+		})
+	}
+
+	if _, err := loadRules(filepath.Join(dir, "not_found")); err == nil {
+		t.Error("want error for not existing file")
+	}
+}
+
+func TestAccessList_Check(t *testing.T) {
+	allow, err := parseRules(true, []string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("failed to parse allow rules: %v", err)
+	}
+
+	deny, err := parseRules(false, []string{"10.1.0.0/16", "::ffff:10.3.0.0/112"})
+	if err != nil {
+		t.Fatalf("failed to parse deny rules: %v", err)
+	}
+
+	var (
+		all      = newAccessList(append(allow, deny...))
+		denyOnly = newAccessList(deny)
+		empty    *accessList
+	)
+
+	testCases := []struct {
+		name    string
+		list    *accessList
+		addr    string
+		allowed bool
+		rule    string
+	}{
+		{name: "nil", list: empty, addr: "192.168.1.1", allowed: true},
+		{name: "allowed", list: all, addr: "10.2.0.1", allowed: true, rule: "allow 10.0.0.0/8"},
+		{name: "allowed_ipv6", list: all, addr: "2001:db8::1", allowed: true, rule: "allow 2001:db8::/32"},
+		{name: "allowed_mapped", list: all, addr: "::ffff:10.2.0.1", allowed: true, rule: "allow 10.0.0.0/8"},
+		{name: "denied", list: all, addr: "10.1.0.1", rule: "deny 10.1.0.0/16"},
+		{name: "denied_mapped_rule", list: all, addr: "10.3.0.1", rule: "deny 10.3.0.0/16"},
+		{name: "not_allowed", list: all, addr: "192.168.1.1", rule: "not allowed"},
+		{name: "deny_only", list: denyOnly, addr: "10.1.2.3", rule: "deny 10.1.0.0/16"},
+		{name: "deny_only_other", list: denyOnly, addr: "192.168.1.1", allowed: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, rule := tc.list.check(netip.MustParseAddr(tc.addr))
+			if allowed != tc.allowed {
+				t.Errorf("want allowed %v, got %v", tc.allowed, allowed)
+			}
+
+			if rule != tc.rule {
+				t.Errorf("want rule %q, got %q", tc.rule, rule)
+			}
+		})
+	}
+}
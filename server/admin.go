@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// adminHandler returns HTTP handler of server's runtime management, it accepts only loopback clients.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", s.handleBans)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			slog.Warn("admin", "address", r.RemoteAddr, "rejected", "not loopback")
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleBans returns active bans of IP addresses as JSON by GET request,
+// DELETE request clears the ban of "ip" query parameter or all bans and returns unbanned addresses.
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	var result any
+
+	switch r.Method {
+	case http.MethodGet:
+		result = s.guard.bans(time.Now())
+	case http.MethodDelete:
+		var ip net.IP
+		if value := r.URL.Query().Get("ip"); value != "" {
+			if ip = net.ParseIP(value); ip == nil {
+				http.Error(w, "invalid ip", http.StatusBadRequest)
+				return
+			}
+		}
+
+		cleared := s.guard.clear(ip, time.Now())
+		slog.Info("bans cleared", "ip", ip, "unbanned", cleared)
+		result = cleared
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("bans", "write_error", err)
+	}
+}
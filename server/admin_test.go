@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+)
+
+func TestServer_ServeAdmin(t *testing.T) {
+	s, err := New(&common.Params{
+		Host: "localhost", Port: 28082, Clients: 1, Duration: time.Second, Timeout: time.Second,
+		BanFailures: 1, BanDuration: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	for _, ip := range []net.IP{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 11)} {
+		s.handshakeFailed(ip)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- s.serveHTTP(ctx, "admin", listener, s.adminHandler())
+	}()
+
+	bansURL := "http://" + listener.Addr().String() + "/bans"
+	bansRequest := func(method, query string) string {
+		req, e := http.NewRequest(method, bansURL+query, nil)
+		if e != nil {
+			t.Fatalf("failed to create request: %v", e)
+		}
+
+		r, e := http.DefaultClient.Do(req)
+		if e != nil {
+			t.Fatalf("failed to request bans: %v", e)
+		}
+
+		defer func() {
+			_ = r.Body.Close()
+		}()
+
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			t.Fatalf("failed to read bans: %v", e)
+		}
+
+		return fmt.Sprintf("%d %s", r.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	testCases := []struct {
+		method   string
+		query    string
+		expected string
+	}{
+		{method: http.MethodGet, expected: `200 [{"ip":"192.168.1.10",`},
+		{method: http.MethodDelete, query: "?ip=192.168.1.10", expected: `200 ["192.168.1.10"]`},
+		{method: http.MethodDelete, query: "?ip=invalid", expected: "400 invalid ip"},
+		{method: http.MethodPost, expected: "405 Method Not Allowed"},
+		{method: http.MethodDelete, expected: `200 ["192.168.1.11"]`},
+		{method: http.MethodGet, expected: "200 []"},
+	}
+
+	for _, tc := range testCases {
+		if result := bansRequest(tc.method, tc.query); !strings.HasPrefix(result, tc.expected) {
+			t.Errorf("%s %s: want %q, got %q", tc.method, tc.query, tc.expected, result)
+		}
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("failed to serve admin: %v", err)
+	}
+}
+
+func TestServer_AdminLoopback(t *testing.T) {
+	s, err := New(&common.Params{Host: "localhost", Port: 28082, Clients: 1, Duration: time.Second, BanFailures: 1, BanDuration: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		remote string
+		status int
+	}{
+		{name: "ipv4", remote: "127.0.0.1:4321", status: http.StatusOK},
+		{name: "ipv6", remote: "[::1]:4321", status: http.StatusOK},
+		{name: "remote", remote: "192.0.2.10:4321", status: http.StatusForbidden},
+		{name: "invalid", remote: "unknown", status: http.StatusForbidden},
+	}
+
+	handler := s.adminHandler()
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/bans", nil)
+			req.RemoteAddr = tc.remote
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Errorf("want status %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
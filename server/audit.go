@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// Termination reasons of sessions and transfers.
+const (
+	reasonCompleted = "completed"
+	reasonCanceled  = "canceled"
+	reasonTruncated = "truncated"
+	reasonAborted   = "aborted"
+	reasonTimeout   = "timeout"
+	reasonError     = "error"
+)
+
+// record is a session's audit record, transfers are by action ("download" or "upload").
+// Bytes and speed are from the receivers' reports.
+type record struct {
+	Session   uint64                     `json:"session"`
+	ClientID  uint16                     `json:"client_id"`
+	IP        string                     `json:"ip"`
+	Address   string                     `json:"address"`
+	UDP       bool                       `json:"udp"`
+	Streams   int                        `json:"streams"`
+	Start     time.Time                  `json:"start"`
+	End       time.Time                  `json:"end"`
+	Transfers map[string]*transferRecord `json:"transfers"`
+	Reason    string                     `json:"reason"`
+	Error     string                     `json:"error,omitempty"`
+}
+
+// transferRecord is a summary of session's data transfers in one direction.
+type transferRecord struct {
+	Bytes         uint64            `json:"bytes"`
+	Streams       int               `json:"streams"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	BitsPerSecond float64           `json:"bits_per_second"`
+	Speed         string            `json:"speed"`
+	Datagrams     *common.UDPReport `json:"datagrams,omitempty"`
+	Reason        string            `json:"reason"`
+	reports       []*common.Report
+}
+
+// add adds a report of the stream or flow, the first failure reason is kept.
+func (t *transferRecord) add(report *common.Report, err error) {
+	t.Streams++
+	if report != nil {
+		t.reports = append(t.reports, report)
+	}
+
+	if t.Reason == "" || t.Reason == reasonCompleted {
+		t.Reason = terminationReason(err)
+	}
+
+	total := common.Aggregate(t.reports)
+	t.Bytes, t.Start, t.End = total.Count, total.First, total.Last
+	t.BitsPerSecond, t.Speed = total.BitsPerSecond(), total.Speed()
+}
+
+// terminationReason returns a reason of finished transfer or session by its error.
+func terminationReason(err error) string {
+	switch {
+	case err == nil:
+		return reasonCompleted
+	case errors.Is(err, context.Canceled):
+		return reasonCanceled
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return reasonTimeout
+	case errors.Is(err, protocol.ErrTruncated):
+		return reasonTruncated
+	case errors.Is(err, protocol.ErrAborted):
+		return reasonAborted
+	}
+
+	return reasonError
+}
+
+// auditLog writes session records as JSON lines, it can be used concurrently.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// newAuditLog opens the audit log file in append mode.
+func newAuditLog(name string) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	return &auditLog{w: f}, nil
+}
+
+// write writes the record as one line.
+func (a *auditLog) write(r *record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("audit record: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("audit write: %w", err)
+	}
+
+	return nil
+}
+
+// close closes the audit log.
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.w.Close()
+}
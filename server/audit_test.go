@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+func TestTerminationReason(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "nil", expected: reasonCompleted},
+		{name: "canceled", err: errors.Join(protocol.ErrTruncated, context.Canceled), expected: reasonCanceled},
+		{name: "timeout", err: fmt.Errorf("read: %w", os.ErrDeadlineExceeded), expected: reasonTimeout},
+		{name: "truncated", err: errors.Join(protocol.ErrTruncated, io.EOF), expected: reasonTruncated},
+		{name: "aborted", err: protocol.ErrAborted, expected: reasonAborted},
+		{name: "other", err: io.ErrUnexpectedEOF, expected: reasonError},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if r := terminationReason(tc.err); r != tc.expected {
+				t.Errorf("want %q, got %q", tc.expected, r)
+			}
+		})
+	}
+}
+
+func TestSession_Record(t *testing.T) {
+	var (
+		s     = newSessions(1)
+		start = time.Now()
+	)
+
+	ss, err := s.open(context.Background(), 1, net.IPv4(127, 0, 0, 1), protocol.Params{Streams: 2}, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+
+	ss.transferred("download", &common.Report{Count: 100, First: start, Last: start.Add(time.Second)}, nil, nil)
+	ss.transferred("download", &common.Report{Count: 50, First: start, Last: start.Add(2 * time.Second)}, nil, protocol.ErrTruncated)
+	ss.transferred("upload", nil, nil, io.EOF)
+	s.close(ss)
+
+	r := ss.record("127.0.0.1:1234", nil)
+	if r.Session != ss.id || r.ClientID != 1 || r.IP != "127.0.0.1" || r.Reason != reasonCompleted || r.Error != "" {
+		t.Errorf("unexpected record: %+v", r)
+	}
+
+	d, ok := r.Transfers["download"]
+	if !ok {
+		t.Fatal("no download transfer")
+	}
+
+	if d.Bytes != 150 || d.Streams != 2 || d.End.Sub(d.Start) != 2*time.Second || d.BitsPerSecond != 600 {
+		t.Errorf("unexpected download transfer: %+v", d)
+	}
+
+	if d.Reason != reasonTruncated {
+		t.Errorf("want %q, got %q", reasonTruncated, d.Reason)
+	}
+
+	if u := r.Transfers["upload"]; u == nil || u.Bytes != 0 || u.Reason != reasonError {
+		t.Errorf("unexpected upload transfer: %+v", u)
+	}
+
+	if r = ss.record("127.0.0.1:1234", context.Canceled); r.Reason != reasonCanceled || r.Error == "" {
+		t.Errorf("unexpected record of failed session: %+v", r)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+
+	for i := 1; i <= 2; i++ {
+		a, err := newAuditLog(name)
+		if err != nil {
+			t.Fatalf("failed to open audit log: %v", err)
+		}
+
+		if err = a.write(&record{Session: uint64(i), Reason: reasonCompleted}); err != nil {
+			t.Errorf("failed to write record: %v", err)
+		}
+
+		if err = a.close(); err != nil {
+			t.Errorf("failed to close audit log: %v", err)
+		}
+	}
+
+	records := readAudit(t, name)
+	if n := len(records); n != 2 {
+		t.Fatalf("want 2 records, got %d", n)
+	}
+
+	for i, r := range records {
+		if r.Session != uint64(i+1) || r.Reason != reasonCompleted {
+			t.Errorf("unexpected record %d: %+v", i, r)
+		}
+	}
+
+	if _, err := newAuditLog(filepath.Join(name, "invalid")); err == nil {
+		t.Error("want error for invalid path")
+	}
+}
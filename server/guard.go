@@ -0,0 +1,232 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// sweepInterval is a period of removing unused IP addresses states.
+const sweepInterval = time.Minute
+
+// Connection rejection reasons of metrics.
+const (
+	limitBanned      = "banned"
+	limitConnections = "connections"
+	limitDenied      = "denied"
+	limitRate        = "rate"
+)
+
+// ErrConnectionLimit is returned when a connection is rejected by limits of its IP address.
+var ErrConnectionLimit = errors.New("connection limit")
+
+// limitMessage returns a description of the connection rejection reason.
+func limitMessage(reason string) string {
+	switch reason {
+	case limitBanned:
+		return "IP address is banned"
+	case limitConnections:
+		return "too many connections from IP address"
+	}
+
+	return "too many new connections from IP address"
+}
+
+// ipState is connections and failed handshakes of one IP address.
+type ipState struct {
+	tokens   float64
+	updated  time.Time
+	active   int
+	failures int
+	failed   time.Time // the first failure of the current ban window
+	banned   time.Time // the end of the ban
+}
+
+// ban is an active ban of IP address.
+type ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// guard limits new connections rate and concurrent connections of IP addresses
+// and bans them after failed handshakes, zero limits are disabled.
+// Rate is a number of new connections per minute, it's also a burst size.
+type guard struct {
+	mu          sync.Mutex
+	rate        int
+	connections int
+	failures    int
+	banDuration time.Duration
+	ips         map[string]*ipState
+	swept       time.Time
+}
+
+// newGuard creates a new guard of IP addresses.
+func newGuard(rate, connections, failures int, banDuration time.Duration) *guard {
+	return &guard{
+		rate:        rate,
+		connections: connections,
+		failures:    failures,
+		banDuration: banDuration,
+		ips:         make(map[string]*ipState),
+	}
+}
+
+// state returns IP address state, it's created if it doesn't exist.
+func (g *guard) state(ip net.IP, now time.Time) *ipState {
+	key := ip.String()
+
+	st, ok := g.ips[key]
+	if !ok {
+		st = &ipState{tokens: float64(g.rate), updated: now}
+		g.ips[key] = st
+	}
+
+	return st
+}
+
+// accept checks limits of a new connection from the IP address and counts it as active,
+// it returns a rejection reason or an empty string if the connection is allowed.
+// Accepted connections must be released.
+func (g *guard) accept(ip net.IP, now time.Time) string {
+	if g.rate == 0 && g.connections == 0 && g.failures == 0 {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.sweep(now)
+	st := g.state(ip, now)
+
+	if now.Before(st.banned) {
+		return limitBanned
+	}
+
+	if g.rate > 0 {
+		st.tokens = min(st.tokens+now.Sub(st.updated).Minutes()*float64(g.rate), float64(g.rate))
+		st.updated = now
+	}
+
+	// connections limit is checked first to not spend rate tokens on rejected connections
+	if g.connections > 0 && st.active >= g.connections {
+		return limitConnections
+	}
+
+	if g.rate > 0 {
+		if st.tokens < 1 {
+			return limitRate
+		}
+		st.tokens--
+	}
+
+	st.active++
+	return ""
+}
+
+// release decrements active connections of the IP address.
+func (g *guard) release(ip net.IP) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if st, ok := g.ips[ip.String()]; ok && st.active > 0 {
+		st.active--
+	}
+}
+
+// failure counts a failed handshake of the IP address,
+// it returns true if the address is banned by this failure.
+func (g *guard) failure(ip net.IP, now time.Time) bool {
+	if g.failures == 0 {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st := g.state(ip, now)
+	if now.Sub(st.failed) > g.banDuration {
+		// failures are counted during the ban duration window
+		st.failed, st.failures = now, 0
+	}
+
+	if st.failures++; st.failures < g.failures {
+		return false
+	}
+
+	st.banned, st.failed, st.failures = now.Add(g.banDuration), time.Time{}, 0
+	return true
+}
+
+// success resets failed handshakes of the IP address.
+func (g *guard) success(ip net.IP) {
+	if g.failures == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if st, ok := g.ips[ip.String()]; ok {
+		st.failed, st.failures = time.Time{}, 0
+	}
+}
+
+// bans returns active bans sorted by IP addresses.
+func (g *guard) bans(now time.Time) []ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	result := make([]ban, 0)
+	for key, st := range g.ips {
+		if now.Before(st.banned) {
+			result = append(result, ban{IP: key, Until: st.banned})
+		}
+	}
+
+	slices.SortFunc(result, func(a, b ban) int { return cmp.Compare(a.IP, b.IP) })
+	return result
+}
+
+// clear removes the ban and failed handshakes of the IP address or all of them if ip is nil,
+// it returns unbanned addresses.
+func (g *guard) clear(ip net.IP, now time.Time) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cleared := make([]string, 0)
+	for key, st := range g.ips {
+		if ip != nil && key != ip.String() {
+			continue
+		}
+
+		if now.Before(st.banned) {
+			cleared = append(cleared, key)
+		}
+		st.banned, st.failed, st.failures = time.Time{}, time.Time{}, 0
+	}
+
+	slices.Sort(cleared)
+	return cleared
+}
+
+// sweep removes states of IP addresses without active connections, bans and failures,
+// whose rate limits are restored. It's done not more often than sweepInterval.
+func (g *guard) sweep(now time.Time) {
+	if now.Sub(g.swept) < sweepInterval {
+		return
+	}
+	g.swept = now
+
+	for key, st := range g.ips {
+		restored := g.rate == 0 || now.Sub(st.updated) >= time.Minute
+		failed := st.failures > 0 && now.Sub(st.failed) <= g.banDuration
+
+		if st.active == 0 && restored && !failed && !now.Before(st.banned) {
+			delete(g.ips, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	var (
+		g     = newGuard(2, 2, 2, time.Minute)
+		now   = time.Now()
+		ip    = net.IPv4(192, 168, 1, 10)
+		other = net.IPv4(192, 168, 1, 11)
+	)
+
+	testCases := []struct {
+		name    string
+		ip      net.IP
+		after   time.Duration
+		release bool
+		failure bool
+		banned  bool
+		reason  string
+	}{
+		{name: "first", ip: ip},
+		{name: "second", ip: ip},
+		{name: "connections", ip: ip, reason: limitConnections},
+		{name: "rate", ip: ip, release: true, reason: limitRate},
+		{name: "other_ip", ip: other},
+		{name: "refilled", ip: ip, after: time.Minute},
+		{name: "released", ip: ip, after: time.Minute, release: true},
+		{name: "failure", ip: other, after: time.Minute, failure: true, release: true},
+		{name: "ban", ip: other, after: time.Minute, failure: true, banned: true, reason: limitBanned},
+		{name: "not_banned", ip: ip, after: 2 * time.Minute, release: true},
+		{name: "ban_expired", ip: other, after: 2*time.Minute + time.Second},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.release {
+				g.release(tc.ip)
+			}
+
+			at := now.Add(tc.after)
+			if tc.failure {
+				if banned := g.failure(tc.ip, at); banned != tc.banned {
+					t.Errorf("want banned %v, got %v", tc.banned, banned)
+				}
+			}
+
+			if reason := g.accept(tc.ip, at); reason != tc.reason {
+				t.Errorf("want reason %q, got %q", tc.reason, reason)
+			}
+		})
+	}
+
+	// a successful handshake resets failures
+	g.failure(ip, now.Add(3*time.Minute))
+	g.success(ip)
+
+	if g.failure(ip, now.Add(3*time.Minute)) {
+		t.Error("unexpected ban after the success")
+	}
+
+	if !g.failure(ip, now.Add(3*time.Minute)) {
+		t.Error("no ban after failures")
+	}
+
+	bans := g.bans(now.Add(3 * time.Minute))
+	if len(bans) != 1 || bans[0].IP != ip.String() {
+		t.Errorf("unexpected bans: %+v", bans)
+	}
+
+	if cleared := g.clear(nil, now.Add(3*time.Minute)); len(cleared) != 1 || cleared[0] != ip.String() {
+		t.Errorf("unexpected cleared bans: %v", cleared)
+	}
+
+	g.release(ip)
+	if reason := g.accept(ip, now.Add(3*time.Minute)); reason != "" {
+		t.Errorf("unexpected rejection after clear: %q", reason)
+	}
+
+	// unused states are removed
+	for _, addr := range []net.IP{ip, ip, other, other} {
+		g.release(addr)
+	}
+	g.accept(net.IPv4(192, 168, 1, 12), now.Add(10*time.Minute))
+
+	if n := len(g.ips); n != 1 {
+		t.Errorf("want 1 IP address state after sweep, got %d", n)
+	}
+}
+
+func TestGuard_ConnectionsRate(t *testing.T) {
+	var (
+		g   = newGuard(2, 1, 0, time.Minute)
+		now = time.Now()
+		ip  = net.IPv4(192, 168, 1, 10)
+	)
+
+	if reason := g.accept(ip, now); reason != "" {
+		t.Fatalf("unexpected rejection: %q", reason)
+	}
+
+	// rejected connections don't spend rate tokens
+	for i := 0; i < 3; i++ {
+		if reason := g.accept(ip, now); reason != limitConnections {
+			t.Fatalf("want reason %q, got %q", limitConnections, reason)
+		}
+	}
+
+	g.release(ip)
+	if reason := g.accept(ip, now); reason != "" {
+		t.Errorf("unexpected rejection after release: %q", reason)
+	}
+
+	g.release(ip)
+	if reason := g.accept(ip, now); reason != limitRate {
+		t.Errorf("want reason %q, got %q", limitRate, reason)
+	}
+}
+
+func TestGuard_Disabled(t *testing.T) {
+	g := newGuard(0, 0, 0, 0)
+	ip := net.IPv4(192, 168, 1, 10)
+
+	for i := 0; i < 10; i++ {
+		if reason := g.accept(ip, time.Now()); reason != "" {
+			t.Fatalf("unexpected rejection: %q", reason)
+		}
+
+		if g.failure(ip, time.Now()) {
+			t.Fatal("unexpected ban")
+		}
+	}
+
+	if n := len(g.ips); n != 0 {
+		t.Errorf("want no IP address states, got %d", n)
+	}
+}
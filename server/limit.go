@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// anonymousGroup is a concurrency group of anonymous clients' sessions.
+const anonymousGroup = "anonymous"
+
+// clientGroup returns a concurrency group of the client's sessions.
+func clientGroup(clientID uint16) string {
+	return fmt.Sprintf("client:%d", clientID)
+}
+
+// concurrency counts active sessions of named groups to limit them.
+type concurrency struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// newConcurrency creates a new concurrency counter.
+func newConcurrency() *concurrency {
+	return &concurrency{active: make(map[string]int)}
+}
+
+// acquire increments active sessions of the group, it returns false if the limit is already reached.
+func (c *concurrency) acquire(group string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active[group] >= limit {
+		return false
+	}
+
+	c.active[group]++
+	return true
+}
+
+// release decrements active sessions of the group.
+func (c *concurrency) release(group string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active[group]--; c.active[group] <= 0 {
+		delete(c.active, group)
+	}
+}
+
+// clientUsage is client's transferred bytes during the current UTC day and month.
+type clientUsage struct {
+	day, month time.Time
+	dayBytes   uint64
+	monthBytes uint64
+}
+
+// periods returns the beginnings of the UTC day and month of the time.
+func periods(t time.Time) (time.Time, time.Time) {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC), time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// update resets counters of finished periods.
+func (c *clientUsage) update(now time.Time) {
+	day, month := periods(now)
+
+	if !c.day.Equal(day) {
+		c.day, c.dayBytes = day, 0
+	}
+
+	if !c.month.Equal(month) {
+		c.month, c.monthBytes = month, 0
+	}
+}
+
+// reservation is client's quota bytes reserved by a session at its admission.
+type reservation struct {
+	size uint64
+	at   time.Time
+}
+
+// usage counts clients' transferred bytes for their quotas, it's kept only in memory.
+type usage struct {
+	mu      sync.Mutex
+	clients map[uint16]*clientUsage
+}
+
+// newUsage creates a new usage counter.
+func newUsage() *usage {
+	return &usage{clients: make(map[uint16]*clientUsage)}
+}
+
+// client returns client's usage updated at the time, it must be called under the lock.
+func (u *usage) client(clientID uint16, now time.Time) *clientUsage {
+	c, ok := u.clients[clientID]
+	if !ok {
+		c = &clientUsage{}
+		u.clients[clientID] = c
+	}
+
+	c.update(now)
+	return c
+}
+
+// add adds client's transferred or reserved bytes at the time.
+func (u *usage) add(clientID uint16, size uint64, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c := u.client(clientID, now)
+	c.dayBytes += size
+	c.monthBytes += size
+}
+
+// settle replaces client's bytes reserved at the time by the transferred ones at now.
+// Reservations of already finished periods are not subtracted, they were reset with them.
+func (u *usage) settle(clientID uint16, reserved, transferred uint64, reservedAt, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var (
+		c          = u.client(clientID, now)
+		day, month = periods(reservedAt)
+	)
+
+	if c.day.Equal(day) {
+		c.dayBytes -= min(reserved, c.dayBytes)
+	}
+
+	if c.month.Equal(month) {
+		c.monthBytes -= min(reserved, c.monthBytes)
+	}
+
+	c.dayBytes += transferred
+	c.monthBytes += transferred
+}
+
+// get returns client's transferred bytes during the day and the month of the time.
+func (u *usage) get(clientID uint16, now time.Time) (uint64, uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.clients[clientID]
+	if !ok {
+		return 0, 0
+	}
+
+	c.update(now)
+	return c.dayBytes, c.monthBytes
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConcurrency(t *testing.T) {
+	c := newConcurrency()
+
+	testCases := []struct {
+		name    string
+		group   string
+		limit   int
+		release bool
+		want    bool
+	}{
+		{name: "first", group: anonymousGroup, limit: 2, want: true},
+		{name: "second", group: anonymousGroup, limit: 2, want: true},
+		{name: "limited", group: anonymousGroup, limit: 2},
+		{name: "other_group", group: clientGroup(1), limit: 1, want: true},
+		{name: "released", group: anonymousGroup, limit: 2, release: true, want: true},
+		{name: "zero_limit", group: clientGroup(2)},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.release {
+				c.release(tc.group)
+			}
+
+			if ok := c.acquire(tc.group, tc.limit); ok != tc.want {
+				t.Errorf("want %v, got %v", tc.want, ok)
+			}
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		c.release(anonymousGroup)
+	}
+	c.release(clientGroup(1))
+
+	if n := len(c.active); n != 0 {
+		t.Errorf("want no active groups, got %d", n)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var (
+		u   = newUsage()
+		now = time.Date(2030, 1, 31, 23, 0, 0, 0, time.UTC)
+	)
+
+	testCases := []struct {
+		name     string
+		clientID uint16
+		size     uint64
+		now      time.Time
+		day      uint64
+		month    uint64
+	}{
+		{name: "first", clientID: 1, size: 100, now: now, day: 100, month: 100},
+		{name: "same_day", clientID: 1, size: 50, now: now.Add(30 * time.Minute), day: 150, month: 150},
+		{name: "other_client", clientID: 2, size: 10, now: now, day: 10, month: 10},
+		{name: "next_month", clientID: 1, size: 20, now: now.Add(2 * time.Hour), day: 20, month: 20},
+		{name: "next_day", clientID: 1, size: 5, now: now.Add(26 * time.Hour), day: 5, month: 25},
+		{name: "empty", clientID: 3, now: now},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.size > 0 {
+				u.add(tc.clientID, tc.size, tc.now)
+			}
+
+			if day, month := u.get(tc.clientID, tc.now); day != tc.day || month != tc.month {
+				t.Errorf("want %d/%d bytes, got %d/%d", tc.day, tc.month, day, month)
+			}
+		})
+	}
+
+	// the day is over, but the month usage is kept
+	if day, month := u.get(1, now.Add(50*time.Hour)); day != 0 || month != 25 {
+		t.Errorf("want 0/25 bytes, got %d/%d", day, month)
+	}
+}
+
+func TestUsage_Settle(t *testing.T) {
+	now := time.Date(2030, 1, 31, 23, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		reserved    uint64
+		transferred uint64
+		settled     time.Time
+		day         uint64
+		month       uint64
+	}{
+		{name: "less", reserved: 100, transferred: 40, settled: now.Add(time.Minute), day: 50, month: 50},
+		{name: "nothing", reserved: 100, settled: now.Add(time.Minute), day: 10, month: 10},
+		{name: "more", reserved: 100, transferred: 120, settled: now.Add(time.Minute), day: 130, month: 130},
+		{name: "next_month", reserved: 100, transferred: 40, settled: now.Add(2 * time.Hour), day: 40, month: 40},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			u := newUsage()
+			// 10 bytes of a finished session and the reservation of the current one
+			u.add(1, 10, now)
+			u.add(1, tc.reserved, now)
+			u.settle(1, tc.reserved, tc.transferred, now, tc.settled)
+
+			if day, month := u.get(1, tc.settled); day != tc.day || month != tc.month {
+				t.Errorf("want %d/%d bytes, got %d/%d", tc.day, tc.month, day, month)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/auth"
+	"github.com/z0rr0/spts/common"
+)
+
+// Authorization failure reasons of metrics.
+const (
+	reasonUnknownClient = "unknown_client"
+	reasonSignature     = "bad_signature"
+	reasonClockSkew     = "clock_skew"
+	reasonLegacy        = "legacy_token"
+	reasonReplay        = "replay"
+	reasonCallback      = "callback"
+	reasonExpired       = "expired"
+	reasonInvalid       = "invalid"
+)
+
+// durationBuckets are upper bounds (seconds) of session duration histogram buckets.
+var durationBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300}
+
+// transferKey is labels of data transfers counter.
+type transferKey struct {
+	action   string
+	clientID uint16
+}
+
+// histogram is a cumulative histogram of observed values.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// observe adds a value to the histogram.
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// metrics are server's counters exposed in Prometheus text format, it can be used concurrently.
+type metrics struct {
+	mu           sync.Mutex
+	sessions     map[uint16]uint64
+	transfers    map[transferKey]uint64
+	bytes        map[string]uint64
+	authFailures map[string]uint64
+	rejections   map[string]uint64
+	bans         uint64
+	durations    histogram
+}
+
+// newMetrics creates empty metrics.
+func newMetrics() *metrics {
+	return &metrics{
+		sessions:     make(map[uint16]uint64),
+		transfers:    make(map[transferKey]uint64),
+		bytes:        make(map[string]uint64),
+		authFailures: make(map[string]uint64),
+		rejections:   make(map[string]uint64),
+		durations:    histogram{buckets: durationBuckets, counts: make([]uint64, len(durationBuckets))},
+	}
+}
+
+// session counts a finished session of the client and its duration.
+func (m *metrics) session(clientID uint16, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[clientID]++
+	m.durations.observe(duration.Seconds())
+}
+
+// transfer counts a data transfer (TCP stream or UDP flow) of the client,
+// action is "download" or "upload", count is a number of bytes from the receiver's report.
+func (m *metrics) transfer(action string, clientID uint16, count uint64) {
+	direction := "received"
+	if action == "download" {
+		direction = "sent"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.transfers[transferKey{action: action, clientID: clientID}]++
+	m.bytes[direction] += count
+}
+
+// authFailure counts a failed authorization by its error.
+func (m *metrics) authFailure(err error) {
+	reason := reasonInvalid
+
+	switch {
+	case errors.Is(err, auth.ErrUnknownClient):
+		reason = reasonUnknownClient
+	case errors.Is(err, auth.ErrTokenSignature):
+		reason = reasonSignature
+	case errors.Is(err, auth.ErrClockSkew):
+		reason = reasonClockSkew
+	case errors.Is(err, auth.ErrLegacyToken):
+		reason = reasonLegacy
+	case errors.Is(err, auth.ErrReplay):
+		reason = reasonReplay
+	case errors.Is(err, auth.ErrCallback):
+		reason = reasonCallback
+	case errors.Is(err, auth.ErrExpired):
+		reason = reasonExpired
+	}
+
+	m.mu.Lock()
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+// connectionRejected counts a connection rejected by limits of its IP address.
+func (m *metrics) connectionRejected(reason string) {
+	m.mu.Lock()
+	m.rejections[reason]++
+	m.mu.Unlock()
+}
+
+// ban counts a ban of IP address.
+func (m *metrics) ban() {
+	m.mu.Lock()
+	m.bans++
+	m.mu.Unlock()
+}
+
+// write writes metrics in Prometheus text format, active and slots are current sessions number
+// and occupied semaphore slots, capacity is the sessions limit, bans is a number of banned IP addresses.
+func (m *metrics) write(w io.Writer, active, slots, capacity, bans int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		ew  = common.NewMetricsWriter(w)
+		ids = sortedKeys(m.sessions)
+	)
+
+	ew.Metric("spts_sessions_active", "gauge", "Number of active test sessions.")
+	ew.Printf("spts_sessions_active %d\n", active)
+
+	ew.Metric("spts_session_slots_used", "gauge", "Occupied session slots.")
+	ew.Printf("spts_session_slots_used %d\n", slots)
+
+	ew.Metric("spts_session_slots", "gauge", "Session slots limit (clients parameter).")
+	ew.Printf("spts_session_slots %d\n", capacity)
+
+	ew.Metric("spts_sessions_total", "counter", "Finished test sessions by client.")
+	for _, id := range ids {
+		ew.Printf("spts_sessions_total{client=\"%d\"} %d\n", id, m.sessions[id])
+	}
+
+	ew.Metric("spts_transfers_total", "counter", "Data transfers by action and client.")
+	keys := make([]transferKey, 0, len(m.transfers))
+	for k := range m.transfers {
+		keys = append(keys, k)
+	}
+
+	slices.SortFunc(keys, func(a, b transferKey) int {
+		if a.action != b.action {
+			return cmp.Compare(a.action, b.action)
+		}
+		return int(a.clientID) - int(b.clientID)
+	})
+
+	for _, k := range keys {
+		ew.Printf("spts_transfers_total{action=%q,client=\"%d\"} %d\n", k.action, k.clientID, m.transfers[k])
+	}
+
+	ew.Metric("spts_bytes_total", "counter", "Data bytes by direction.")
+	for _, direction := range []string{"received", "sent"} {
+		ew.Printf("spts_bytes_total{direction=%q} %d\n", direction, m.bytes[direction])
+	}
+
+	ew.Metric("spts_auth_failures_total", "counter", "Failed authorizations by reason.")
+	for _, reason := range []string{reasonCallback, reasonClockSkew, reasonExpired, reasonInvalid, reasonLegacy, reasonReplay, reasonSignature, reasonUnknownClient} {
+		ew.Printf("spts_auth_failures_total{reason=%q} %d\n", reason, m.authFailures[reason])
+	}
+
+	ew.Metric("spts_connections_rejected_total", "counter", "Connections rejected by IP address limits and access rules.")
+	for _, reason := range []string{limitBanned, limitConnections, limitDenied, limitRate} {
+		ew.Printf("spts_connections_rejected_total{reason=%q} %d\n", reason, m.rejections[reason])
+	}
+
+	ew.Metric("spts_bans_total", "counter", "Bans of IP addresses after failed handshakes.")
+	ew.Printf("spts_bans_total %d\n", m.bans)
+
+	ew.Metric("spts_bans_active", "gauge", "Banned IP addresses.")
+	ew.Printf("spts_bans_active %d\n", bans)
+
+	h := &m.durations
+	ew.Metric("spts_session_duration_seconds", "histogram", "Durations of test sessions.")
+	for i, b := range h.buckets {
+		ew.Printf("spts_session_duration_seconds_bucket{le=%q} %d\n", common.MetricValue(b), h.counts[i])
+	}
+
+	ew.Printf("spts_session_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	ew.Printf("spts_session_duration_seconds_sum %s\n", common.MetricValue(h.sum))
+	ew.Printf("spts_session_duration_seconds_count %d\n", h.count)
+
+	return ew.Err()
+}
+
+// sortedKeys returns sorted client IDs of the map.
+func sortedKeys(m map[uint16]uint64) []uint16 {
+	keys := make([]uint16, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+// startHTTP starts HTTP server of the handler on the address, the name is used in logs,
+// the returned function stops it and waits its end.
+func (s *Server) startHTTP(ctx context.Context, name, address string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %s: %w", name, err)
+	}
+
+	slog.Info(name, "address", listener.Addr().String())
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		if e := s.serveHTTP(ctx, name, listener, handler); e != nil {
+			slog.Error(name, "error", e)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// metricsHandler returns read-only HTTP handler of metrics.
+func (s *Server) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		err := s.metrics.write(w, s.sessions.count(), s.sessions.slots(), s.Clients, len(s.guard.bans(time.Now())))
+		if err != nil {
+			slog.Error("metrics", "write_error", err)
+		}
+	})
+
+	return mux
+}
+
+// serveHTTP runs HTTP server of the handler until the context is done.
+func (s *Server) serveHTTP(ctx context.Context, name string, listener net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: s.Timeout}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error(name, "shutdown_error", err)
+		}
+	}()
+
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s server: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/auth"
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+func TestMetrics_Write(t *testing.T) {
+	m := newMetrics()
+
+	m.session(2, 1500*time.Millisecond)
+	m.session(1, 30*time.Second)
+	m.transfer("download", 1, 100)
+	m.transfer("download", 1, 50)
+	m.transfer("upload", 2, 10)
+	m.authFailure(errors.Join(auth.ErrUnauthorized, auth.ErrUnknownClient))
+	m.authFailure(auth.ErrTokenSignature)
+	m.authFailure(errors.Join(auth.ErrUnauthorized, auth.ErrClockSkew))
+	m.authFailure(errors.Join(auth.ErrUnauthorized, auth.ErrClockSkew))
+	m.authFailure(errors.Join(auth.ErrUnauthorized, auth.ErrCallback))
+	m.authFailure(io.EOF)
+	m.connectionRejected(limitRate)
+	m.connectionRejected(limitRate)
+	m.connectionRejected(limitBanned)
+	m.ban()
+
+	var b strings.Builder
+	if err := m.write(&b, 1, 2, 4, 1); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+
+	expected := []string{
+		"spts_sessions_active 1\n",
+		"spts_session_slots_used 2\n",
+		"spts_session_slots 4\n",
+		"spts_sessions_total{client=\"1\"} 1\nspts_sessions_total{client=\"2\"} 1\n",
+		"spts_transfers_total{action=\"download\",client=\"1\"} 2\nspts_transfers_total{action=\"upload\",client=\"2\"} 1\n",
+		"spts_bytes_total{direction=\"received\"} 10\nspts_bytes_total{direction=\"sent\"} 150\n",
+		"spts_auth_failures_total{reason=\"callback\"} 1\n",
+		"spts_auth_failures_total{reason=\"clock_skew\"} 2\n",
+		"spts_auth_failures_total{reason=\"invalid\"} 1\n",
+		"spts_auth_failures_total{reason=\"bad_signature\"} 1\n",
+		"spts_auth_failures_total{reason=\"unknown_client\"} 1\n",
+		"spts_connections_rejected_total{reason=\"banned\"} 1\n",
+		"spts_connections_rejected_total{reason=\"connections\"} 0\n",
+		"spts_connections_rejected_total{reason=\"denied\"} 0\n",
+		"spts_connections_rejected_total{reason=\"rate\"} 2\n",
+		"spts_bans_total 1\n",
+		"spts_bans_active 1\n",
+		"spts_session_duration_seconds_bucket{le=\"1\"} 0\nspts_session_duration_seconds_bucket{le=\"2\"} 1\n",
+		"spts_session_duration_seconds_bucket{le=\"30\"} 2\n",
+		"spts_session_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"spts_session_duration_seconds_sum 31.5\nspts_session_duration_seconds_count 2\n",
+		"# TYPE spts_session_duration_seconds histogram\n",
+	}
+
+	out := b.String()
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("no %q in metrics:\n%s", e, out)
+		}
+	}
+}
+
+func TestServer_ServeMetrics(t *testing.T) {
+	s, err := New(&common.Params{
+		Host: "localhost", Port: 28082, Clients: 2, Duration: time.Second, Timeout: time.Second,
+		BanFailures: 1, BanDuration: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	for _, ip := range []net.IP{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 11)} {
+		s.handshakeFailed(ip)
+	}
+
+	s.sessions = newSessions(s.Clients)
+	params := protocol.Params{Duration: time.Second, Streams: 1}
+	ss, err := s.sessions.open(context.Background(), 1, net.IPv4(127, 0, 0, 1), params, time.Second)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer s.sessions.close(ss)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- s.serveHTTP(ctx, "metrics", listener, s.metricsHandler())
+	}()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if e := resp.Body.Close(); e != nil {
+		t.Errorf("failed to close body: %v", e)
+	}
+
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	for _, e := range []string{"spts_sessions_active 1\n", "spts_session_slots_used 1\n", "spts_session_slots 2\n", "spts_bans_active 2\n"} {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("no %q in metrics:\n%s", e, body)
+		}
+	}
+
+	// bans are managed only by the admin listener
+	resp, err = http.Get("http://" + listener.Addr().String() + "/bans")
+	if err != nil {
+		t.Fatalf("failed to get bans: %v", err)
+	}
+
+	if e := resp.Body.Close(); e != nil {
+		t.Errorf("failed to close body: %v", e)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("failed to serve metrics: %v", err)
+	}
+}
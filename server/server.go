@@ -2,22 +2,36 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/z0rr0/spts/auth"
 	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+	"github.com/z0rr0/spts/tlsconfig"
 )
 
 const (
 	acceptTimeout = 2 * time.Second
-	acceptAddTime = 100 * time.Millisecond
+
+	// handshakesPerClient is a max number of handshaking connections per allowed session,
+	// a session uses one control connection and max streams of both directions.
+	handshakesPerClient = 1 + 2*maxStreams
+
+	// replayCacheSize is a max number of remembered tokens to detect replays.
+	replayCacheSize = 1 << 16
 )
 
 var (
@@ -29,7 +43,26 @@ var (
 // Server is a server data.
 type Server struct {
 	common.Params
-	addr net.TCPAddr
+	addr     net.TCPAddr
+	sessions *sessions
+	udp      *net.UDPConn
+	metrics  *metrics
+	audit    *auditLog
+	replays  *auth.ReplayCache
+	tokens   *auth.TokenStore
+	custom   auth.Authenticator
+	active   *concurrency
+	usage    *usage
+	admitMu  sync.Mutex
+	guard    *guard
+	rules    []accessRule
+	access   atomic.Pointer[accessList]
+
+	// handshakes limits connections which are not admitted to sessions yet
+	handshakes chan struct{}
+
+	tlsConfig   *tls.Config
+	fingerprint string
 }
 
 // New creates a new server.
@@ -38,13 +71,101 @@ func New(params *common.Params) (*Server, error) {
 		return nil, errors.New("allow clients number must be greater than 0")
 	}
 
+	if params.Duration <= 0 {
+		return nil, errors.New("test duration must be greater than 0")
+	}
+
 	addr := net.TCPAddr{IP: net.ParseIP(params.Host), Port: int(params.Port)}
-	return &Server{Params: *params, addr: addr}, nil
+	s := &Server{
+		Params:  *params,
+		addr:    addr,
+		metrics: newMetrics(),
+		replays: auth.NewReplayCache(replayCacheSize),
+		active:  newConcurrency(),
+		usage:   newUsage(),
+	}
+
+	if s.MaxBitrate == 0 {
+		s.MaxBitrate = protocol.DefaultMaxBitrate
+	}
+
+	if s.Anonymous && s.AnonymousSessions < 1 {
+		return nil, errors.New("anonymous sessions number must be greater than 0")
+	}
+
+	if s.IPRate < 0 || s.IPConnections < 0 || s.BanFailures < 0 {
+		return nil, errors.New("IP address limits can't be negative")
+	}
+
+	if s.BanFailures > 0 && s.BanDuration <= 0 {
+		return nil, errors.New("ban duration must be greater than 0")
+	}
+	s.guard = newGuard(s.IPRate, s.IPConnections, s.BanFailures, s.BanDuration)
+
+	allowRules, err := parseRules(true, s.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyRules, err := parseRules(false, s.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rules = append(allowRules, denyRules...)
+	if err = s.loadAccess(); err != nil {
+		return nil, err
+	}
+
+	if s.TokensFile == "" {
+		s.TokensFile = os.Getenv(auth.ServerFileEnv)
+	}
+
+	sources := 0
+	for _, ok := range []bool{os.Getenv(auth.ServerEnv) != "", s.TokensFile != "", s.AuthURL != ""} {
+		if ok {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return nil, fmt.Errorf("tokens are set by several sources, only one of %s, file or callback URL is allowed", auth.ServerEnv)
+	}
+
+	if s.AuthURL != "" {
+		if u, err := url.Parse(s.AuthURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid auth callback URL %q: %v", s.AuthURL, err)
+		}
+	}
+
+	if params.TLS || params.TLSClientCA != "" {
+		cfg, fingerprint, err := tlsconfig.Server(params.TLSCert, params.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if params.TLSClientCA != "" {
+			if err = tlsconfig.WithClientCA(cfg, params.TLSClientCA); err != nil {
+				return nil, err
+			}
+		}
+
+		s.TLS, s.tlsConfig, s.fingerprint = true, cfg, fingerprint
+	}
+
+	return s, nil
 }
 
 // Start starts the server.
 func (s *Server) Start(ctx context.Context) error {
-	slog.Info("server starting", "PID", os.Getpid(), "address", s.Address(), "timeout", s.Timeout)
+	slog.Info(
+		"server starting",
+		"PID", os.Getpid(), "address", s.Address(), "timeout", s.Timeout, "duration", s.Duration, "tls", s.TLS,
+	)
+
+	if s.tlsConfig != nil {
+		slog.Info("tls", "fingerprint", s.fingerprint)
+	}
 	defer slog.Info("server stopped")
 
 	if err := s.ListenAndServe(ctx); err != nil {
@@ -54,18 +175,33 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
-func (s *Server) connAccept(ctx context.Context, listener *net.TCPListener, semaphore chan struct{}) (net.Conn, error) {
+// rejectConn writes the error to a not TLS connection and closes it, it returns err with closing error.
+func (s *Server) rejectConn(conn *net.TCPConn, code, message string, err error) error {
+	if s.tlsConfig == nil {
+		// a short error instead of the hello, new connection's buffer doesn't block the writing
+		_ = protocol.NewConn(conn).WriteError(code, message)
+	}
+
+	if e := conn.Close(); e != nil {
+		err = errors.Join(err, fmt.Errorf("connection close: %w", e))
+	}
+
+	return err
+}
+
+// connAccept accepts a new connection after taking a handshake slot,
+// it's released by the returned connection's admission or closing.
+func (s *Server) connAccept(ctx context.Context, listener *net.TCPListener) (net.Conn, error) {
 	var (
 		err           error
 		conn          *net.TCPConn
 		opErr         *net.OpError
-		freeSemaphore bool
-		addDuration   = s.Timeout + acceptAddTime
+		freeHandshake bool
 	)
 
 	defer func() {
-		if freeSemaphore {
-			<-semaphore
+		if freeHandshake {
+			<-s.handshakes
 		}
 	}()
 
@@ -75,8 +211,13 @@ func (s *Server) connAccept(ctx context.Context, listener *net.TCPListener, sema
 		return nil, errors.Join(ErrSkipConnection, fmt.Errorf("listener deadline: %w", err))
 	}
 
-	semaphore <- struct{}{}
-	freeSemaphore = true
+	select {
+	case s.handshakes <- struct{}{}:
+		freeHandshake = true
+	case <-ctx.Done():
+		return nil, fmt.Errorf("listener handshakes context error: %w", ctx.Err())
+	}
+
 	conn, err = listener.AcceptTCP()
 
 	if err != nil {
@@ -91,7 +232,25 @@ func (s *Server) connAccept(ctx context.Context, listener *net.TCPListener, sema
 		return nil, errors.Join(ErrSkipConnection, fmt.Errorf("listener accept: %w", err))
 	}
 
-	if err = connSetDeadline(conn, addDuration, common.TimeoutMultiplier); err != nil {
+	// access rules are checked before any reading
+	addr := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	if allowed, rule := s.access.Load().check(addr); !allowed {
+		s.metrics.connectionRejected(limitDenied)
+		err = errors.Join(ErrSkipConnection, ErrAccessDenied, fmt.Errorf("address %s, rule %q", addr.Unmap(), rule))
+		return nil, s.rejectConn(conn, protocol.CodeForbidden, ErrAccessDenied.Error(), err)
+	}
+
+	ip := remoteIP(conn)
+	if reason := s.guard.accept(ip, time.Now()); reason != "" {
+		s.metrics.connectionRejected(reason)
+		message := limitMessage(reason)
+		err = errors.Join(ErrSkipConnection, ErrConnectionLimit, fmt.Errorf("%s: %s", message, ip))
+		return nil, s.rejectConn(conn, protocol.CodeBusy, message, err)
+	}
+
+	// deadline for the handshake, it's updated after that
+	if err = conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		s.guard.release(ip)
 		err = errors.Join(ErrSkipConnection, fmt.Errorf("connection deadline: %w", err))
 
 		// connection was successfully accepted, but deadline failed, so close it and stop handling
@@ -102,22 +261,40 @@ func (s *Server) connAccept(ctx context.Context, listener *net.TCPListener, sema
 		return nil, err
 	}
 
-	// no errors, don't need to release semaphore
-	// it will be released in handleConnection
-	freeSemaphore = false
+	// no errors, the handshake slot is released after the connection admission
+	freeHandshake = false
+
+	if s.tlsConfig != nil {
+		// TLS handshake is done on the first read under the same deadline
+		return tls.Server(conn, s.tlsConfig), nil
+	}
+
 	return conn, nil
 }
 
-func (s *Server) connChan(ctx context.Context, listener *net.TCPListener, semaphore chan struct{}) chan net.Conn {
+// admission returns a function, which releases the handshake slot of an accepted connection only once.
+func (s *Server) admission() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-s.handshakes })
+	}
+}
+
+func (s *Server) connChan(ctx context.Context, listener *net.TCPListener) chan net.Conn {
 	ch := make(chan net.Conn)
 
 	go func() {
 		for {
-			conn, err := s.connAccept(ctx, listener, semaphore)
+			conn, err := s.connAccept(ctx, listener)
 
 			switch {
 			case errors.Is(err, ErrAcceptTimeout):
 				slog.Debug("listener", "accept_timeout", err, "timeout", acceptTimeout)
+			case errors.Is(err, ErrAccessDenied):
+				slog.Info("listener", "denied", err)
+			case errors.Is(err, ErrConnectionLimit):
+				// rejected connections can be flooding, so they are not logged by default
+				slog.Debug("listener", "rejected", err)
 			case errors.Is(err, ErrSkipConnection):
 				slog.Info("listener", "skip_error", err)
 			case err != nil:
@@ -140,39 +317,87 @@ func (s *Server) connChan(ctx context.Context, listener *net.TCPListener, semaph
 }
 
 func (s *Server) ListenAndServe(ctx context.Context) error {
-	tokens, err := auth.ServerTokens()
+	authenticator, err := s.authenticator()
 	if err != nil {
 		return err
 	}
 
-	slog.Info("tokens", "count", len(tokens))
-
 	listener, err := net.ListenTCP("tcp", &s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
+	if s.TokensFile != "" || s.AccessFile != "" {
+		stopReload := s.watchReload(ctx)
+		defer stopReload()
+	}
+
 	defer func() {
 		if e := listener.Close(); e != nil {
 			slog.Error("listener", "close_error", e)
 		}
 	}()
 
+	// UDP flows use the same port number
+	s.udp, err = net.ListenUDP("udp", &net.UDPAddr{IP: s.addr.IP, Port: s.addr.Port})
+	if err != nil {
+		return fmt.Errorf("failed to listen UDP: %w", err)
+	}
+
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, s.Clients) // limit concurrent requests
-	defer close(semaphore)
+	s.sessions = newSessions(s.Clients) // limit concurrent sessions
+	s.handshakes = make(chan struct{}, s.Clients*handshakesPerClient)
+
+	udpDone := make(chan struct{})
+	go func() {
+		s.serveUDP()
+		close(udpDone)
+	}()
 
-	for conn := range s.connChan(ctx, listener, semaphore) {
+	defer func() {
+		if e := s.udp.Close(); e != nil {
+			slog.Error("udp", "close_error", e)
+		}
+		<-udpDone
+	}()
+
+	if s.Metrics != "" {
+		stopMetrics, e := s.startHTTP(ctx, "metrics", s.Metrics, s.metricsHandler())
+		if e != nil {
+			return e
+		}
+		defer stopMetrics()
+	}
+
+	if s.Admin != "" {
+		stopAdmin, e := s.startHTTP(ctx, "admin", s.Admin, s.adminHandler())
+		if e != nil {
+			return e
+		}
+		defer stopAdmin()
+	}
+
+	if s.Audit != "" {
+		if s.audit, err = newAuditLog(s.Audit); err != nil {
+			return err
+		}
+
+		defer func() {
+			if e := s.audit.close(); e != nil {
+				slog.Error("audit", "close_error", e)
+			}
+		}()
+	}
+
+	for conn := range s.connChan(ctx, listener) {
 		wg.Add(1)
 		go func(c net.Conn) {
-			ctxConn, cancel := context.WithTimeout(ctx, s.Timeout)
-
-			if e := handleConnection(ctxConn, c, tokens); e != nil {
+			admitted := s.admission()
+			if e := s.handleConnection(ctx, c, authenticator, admitted); e != nil {
 				slog.Error("connection", "handling_error", e)
 			}
-
-			cancel()
-			<-semaphore // release semaphore for next request
+			admitted()
+			s.guard.release(remoteIP(c))
 			wg.Done()
 		}(conn)
 	}
@@ -181,77 +406,777 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	return nil
 }
 
-func handleConnection(ctx context.Context, conn net.Conn, tokens map[uint16]*auth.Token) error {
+// SetAuthenticator sets a custom authenticator of clients' tokens instead of built-in ones,
+// certificates and anonymous clients are still checked by server's parameters. It must be called before Start.
+func (s *Server) SetAuthenticator(authenticator auth.Authenticator) {
+	s.custom = authenticator
+}
+
+// authenticator returns clients' authenticator by tokens, by certificates if client CA is set,
+// and allows anonymous clients if it's enabled. Tokens are optional in the last two cases.
+func (s *Server) authenticator() (auth.Authenticator, error) {
+	authenticator, err := s.tokensAuthenticator()
+	if err != nil && !(errors.Is(err, auth.ErrAuthRequired) && (s.TLSClientCA != "" || s.Anonymous)) {
+		return nil, err
+	}
+
+	if authenticator == nil && s.TokensFile != "" {
+		// the file can get tokens after reload
+		s.tokens = auth.NewTokenStore(nil, s.sessionLifetime())
+		authenticator = s.tokens
+	}
+
+	if s.TLSClientCA != "" {
+		names, e := auth.ServerCertificates()
+		if e != nil {
+			return nil, e
+		}
+
+		slog.Info("certificates", "count", len(names))
+		authenticator = &auth.Certificates{Names: names, Fallback: authenticator}
+	}
+
+	if s.Anonymous {
+		slog.Info("anonymous clients are allowed")
+		authenticator = &auth.Anonymous{Fallback: authenticator}
+	}
+
+	return authenticator, nil
+}
+
+// tokensAuthenticator returns an authenticator of clients' tokens from one source:
+// custom authenticator, HTTP callback, tokens file or environment variable.
+func (s *Server) tokensAuthenticator() (auth.Authenticator, error) {
+	switch {
+	case s.custom != nil:
+		slog.Info("tokens", "authenticator", fmt.Sprintf("%T", s.custom))
+		return s.custom, nil
+	case s.AuthURL != "":
+		slog.Info("tokens", "callback", s.AuthURL)
+		return auth.NewCallback(s.AuthURL, s.Timeout), nil
+	}
+
+	tokens, err := s.loadTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("tokens", "count", len(tokens), "file", s.TokensFile)
+	s.tokens = auth.NewTokenStore(tokens, s.sessionLifetime())
+
+	return s.tokens, nil
+}
+
+// sessionLifetime returns the longest time of a session: waiting for a free slot,
+// both directions with handshakes, late datagrams and results waiting.
+// Retired tokens are needed only for already opened sessions, so they are dropped after it.
+func (s *Server) sessionLifetime() time.Duration {
+	return 2*s.Timeout + 2*(s.Duration+2*s.Timeout+protocol.Linger)
+}
+
+// loadTokens reads clients' tokens from the file if it's set, otherwise from environment variable.
+func (s *Server) loadTokens() (map[uint16]*auth.Token, error) {
+	if s.TokensFile != "" {
+		return auth.LoadTokens(s.TokensFile)
+	}
+
+	return auth.ServerTokens()
+}
+
+// reloadTokens replaces clients' tokens by the file ones, current tokens are kept if the file is invalid.
+func (s *Server) reloadTokens() error {
+	if s.tokens == nil {
+		return errors.New("no reloadable tokens")
+	}
+
+	tokens, err := auth.LoadTokens(s.TokensFile)
+	if err != nil {
+		return err
+	}
+
+	added, removed, updated := s.tokens.Replace(tokens)
+	slog.Info("tokens reloaded", "count", len(tokens), "added", added, "removed", removed, "updated", updated)
+
+	return nil
+}
+
+// loadAccess sets access rules of parameters and the access file if it's set.
+func (s *Server) loadAccess() error {
+	rules := slices.Clone(s.rules)
+
+	if s.AccessFile != "" {
+		fileRules, err := loadRules(s.AccessFile)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	list := newAccessList(rules)
+	s.access.Store(list)
+
+	slog.Info("access rules", "allow", len(list.allow), "deny", len(list.deny), "file", s.AccessFile)
+	return nil
+}
+
+// watchReload reloads tokens and access rules files on SIGHUP signals
+// until the context is done or returned function is called.
+func (s *Server) watchReload(ctx context.Context) func() {
+	var (
+		sighup = make(chan os.Signal, 1)
+		done   = make(chan struct{})
+		wg     sync.WaitGroup
+	)
+
+	signal.Notify(sighup, syscall.SIGHUP)
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-sighup:
+				if s.TokensFile != "" {
+					if err := s.reloadTokens(); err != nil {
+						slog.Error("tokens reload", "file", s.TokensFile, "error", err)
+					}
+				}
+
+				if s.AccessFile != "" {
+					// current rules are kept if the file is invalid
+					if err := s.loadAccess(); err != nil {
+						slog.Error("access rules reload", "file", s.AccessFile, "error", err)
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sighup)
+		close(done)
+		wg.Wait()
+	}
+}
+
+// handleConnection does a handshake and handles control or data stream connection,
+// admitted is called when the connection gets its session.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, authenticator auth.Authenticator, admitted func()) error {
 	defer func() {
 		if e := conn.Close(); e != nil {
 			slog.Error("connection", "close_error", e)
 		}
 	}()
 
-	// read handshake
-	token, err := auth.Verify(conn, tokens)
+	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return common.ErrIPAddress
+	}
+
+	pc := protocol.NewConn(conn)
+	version, challenge, err := hello(pc)
 	if err != nil {
+		s.handshakeFailed(remoteAddr.IP)
 		return err
 	}
 
-	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		return common.ErrIPAddress
+	identity, err := s.handshake(conn, pc, authenticator, challenge, remoteAddr.IP)
+	if err != nil {
+		s.handshakeFailed(remoteAddr.IP)
+		return err
+	}
+	if identity.RetiredAt.IsZero() {
+		s.guard.success(remoteAddr.IP)
 	}
-	token.IP = remoteAddr.IP
 
-	// write handshake reply,
-	// auth.Verify already updated temporary token's parts
-	header := token.Sign()
-	if _, err = conn.Write(header); err != nil {
-		return fmt.Errorf("write header: %w", err)
+	params := &protocol.Params{}
+	if err = pc.ReadMessage(protocol.TypeParams, params); err != nil {
+		return err
 	}
 
-	slog.Info("connection", "address", remoteAddr.String(), "client", token.ClientID, "action", token.Action())
+	if params.Session == 0 || version < protocol.VersionStreams {
+		if !identity.RetiredAt.IsZero() {
+			// removed or changed tokens only finish already opened sessions
+			err = errors.Join(auth.ErrUnauthorized, auth.ErrUnknownClient, fmt.Errorf("retired clientID: %d", identity.ClientID))
+			s.metrics.authFailure(err)
+			return errors.Join(err, pc.WriteError(protocol.CodeUnauthorized, ""))
+		}
 
-	if token.Download {
-		err = download(ctx, conn)
-	} else {
-		err = upload(ctx, conn)
+		if version < protocol.VersionStreams {
+			return s.single(ctx, conn, pc, identity, remoteAddr.IP, params, admitted)
+		}
+
+		return s.control(ctx, conn, pc, identity, remoteAddr.IP, version, params, admitted)
 	}
 
-	return err
+	return s.stream(conn, pc, identity, params, admitted)
 }
 
-// download writes data to connection.
-// It uses short context timeout.
-func download(ctx context.Context, w io.Writer) error {
-	r := common.NewReader(ctx)
-	n, err := io.Copy(w, r)
+// handshakeFailed counts a failed handshake of the IP address, it's banned after too many ones.
+func (s *Server) handshakeFailed(ip net.IP) {
+	now := time.Now()
+
+	if s.guard.failure(ip, now) {
+		s.metrics.ban()
+		slog.Warn("ip banned", "ip", ip, "failures", s.BanFailures, "until", now.Add(s.BanDuration))
+	}
+}
 
-	if err = common.SkipError(err); err != nil {
-		return errors.Join(ErrDataWriteRead, fmt.Errorf("download copy: %w", err))
+// remoteIP returns IP address of the connection's remote side, it's nil for not TCP connections.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
 	}
 
-	slog.Info("writes", "count", common.ByteSize(uint64(n)))
 	return nil
 }
 
-// upload reads data from connection.
-// It's needed longer context timeout due to network latency.
-func upload(ctx context.Context, r io.Reader) error {
-	w := common.NewWriter(ctx)
-	n, err := io.Copy(w, r)
+// openSession negotiates client's parameters and opens a new session, admitted is called after that anyway,
+// the returned function releases client's concurrent sessions after the session finishing.
+func (s *Server) openSession(ctx context.Context, conn net.Conn, pc *protocol.Conn, identity *auth.Identity, ip net.IP, params *protocol.Params, admitted func()) (*session, func(), error) {
+	defer admitted()
 
-	if err != nil && !errors.Is(err, common.ErrWriterTimeout) {
-		return errors.Join(ErrDataWriteRead, fmt.Errorf("upload copy: %w", err))
+	release, reserved, err := s.admit(pc, identity, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.ClientIP = ip.String()
+
+	cancel := func() {
+		release()
+		s.usage.settle(identity.ClientID, reserved.size, 0, reserved.at, time.Now())
+	}
+
+	// waiting for a free slot is limited by the server timeout
+	if err = conn.SetDeadline(time.Now().Add(2 * s.Timeout)); err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("session deadline: %w", err)
+	}
+
+	ss, err := s.sessions.open(ctx, identity.ClientID, ip, *params, s.Timeout)
+	if err != nil {
+		cancel()
+		if errors.Is(err, ErrBusy) {
+			err = errors.Join(err, pc.WriteError(protocol.CodeBusy, "too many sessions"))
+		}
+		return nil, nil, err
+	}
+
+	ss.reserved = reserved
+	return ss, release, nil
+}
+
+// control opens a new session and holds it until the client finishes it.
+// Latency probes and UDP flows are allowed only since protocol.VersionLatency.
+func (s *Server) control(ctx context.Context, conn net.Conn, pc *protocol.Conn, identity *auth.Identity, ip net.IP, version uint8, params *protocol.Params, admitted func()) (err error) {
+	if version < protocol.VersionLatency {
+		params.UDP = false
+	}
+
+	ss, release, err := s.openSession(ctx, conn, pc, identity, ip, params, admitted)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	defer func() {
+		s.finish(ss, conn.RemoteAddr().String(), err)
+	}()
+
+	if err = pc.WriteMessage(protocol.TypeParams, &ss.params); err != nil {
+		return err
+	}
+
+	slog.Info(
+		"session",
+		"id", ss.id, "address", conn.RemoteAddr().String(), "client", ss.clientID,
+		"streams", ss.params.Streams, "duration", ss.params.Duration, "bytes", ss.params.Bytes,
+		"udp", ss.params.UDP, "anonymous", identity.Anonymous, "sessions", s.sessions.count(),
+	)
+
+	// both directions, every one with handshake, late datagrams and result waiting reserve
+	if err = conn.SetDeadline(time.Now().Add(2 * (ss.params.Duration + 2*s.Timeout + protocol.Linger))); err != nil {
+		return fmt.Errorf("session deadline: %w", err)
+	}
+
+	if version < protocol.VersionLatency {
+		err = pc.ReadMessage(protocol.TypeEnd, &protocol.End{})
+	} else {
+		// only latency probes and UDP flows are expected until the end of the session
+		_, err = pc.Echo(func(t protocol.Type, payload []byte) error { return s.flow(ss, pc, t, payload) })
+	}
+
+	if err != nil {
+		return errors.Join(protocol.ErrAborted, fmt.Errorf("session %d: %w", ss.id, err))
 	}
 
-	slog.Info("reads", "count", common.ByteSize(uint64(n)))
 	return nil
 }
 
-// connSetDeadline sets a deadline for a connection.
-func connSetDeadline(conn net.Conn, timeout time.Duration, multiplier time.Duration) error {
-	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+// single opens a session of one stream and transfers data over the control connection
+// in the direction of client's token, it's used by clients of protocol.MinVersion.
+// Their params have only the duration, so size limits are not known by them,
+// but they are applied by the server too.
+func (s *Server) single(ctx context.Context, conn net.Conn, pc *protocol.Conn, identity *auth.Identity, ip net.IP, params *protocol.Params, admitted func()) (err error) {
+	params = &protocol.Params{Duration: params.Duration}
+
+	ss, release, err := s.openSession(ctx, conn, pc, identity, ip, params, admitted)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	defer func() {
+		s.finish(ss, conn.RemoteAddr().String(), err)
+	}()
+
+	if !ss.params.Allowed(identity.Download) {
+		return reject(pc, ErrForbidden, protocol.CodeForbidden, fmt.Errorf("%s is not allowed", identity.Action()))
+	}
+
+	if _, err = s.sessions.join(ss.id, identity.ClientID, identity.Download); err != nil {
+		return err
+	}
+	defer s.sessions.leave(ss, identity.Download)
+
+	if err = pc.WriteMessage(protocol.TypeParams, &ss.params); err != nil {
+		return err
+	}
+
+	slog.Info(
+		"session",
+		"id", ss.id, "address", conn.RemoteAddr().String(), "client", ss.clientID, "version", protocol.MinVersion,
+		"action", identity.Action(), "duration", ss.params.Duration, "bytes", ss.params.Bytes,
+		"anonymous", identity.Anonymous, "sessions", s.sessions.count(),
+	)
+
+	return s.transfer(conn, pc, ss, identity, &ss.params)
+}
+
+// finish closes the session, then it logs and writes to the audit log its record.
+// Active streams are aborted by the session closing, but their reports are waited for the record.
+func (s *Server) finish(ss *session, address string, err error) {
+	s.sessions.close(ss)
+	if !ss.wait(s.Timeout) {
+		slog.Warn("session", "id", ss.id, "streams_wait", "timeout")
+	}
+
+	r := ss.record(address, err)
+	s.metrics.session(r.ClientID, r.End.Sub(r.Start))
+
+	var transferred uint64
+	for _, t := range r.Transfers {
+		transferred += t.Bytes
+	}
+	s.usage.settle(r.ClientID, ss.reserved.size, transferred, ss.reserved.at, r.End)
+
+	attrs := []any{
+		"id", r.Session, "client", r.ClientID, "address", r.Address, "udp", r.UDP,
+		"duration", r.End.Sub(r.Start), "reason", r.Reason,
+	}
+
+	for _, action := range []string{"download", "upload"} {
+		if t, ok := r.Transfers[action]; ok {
+			attrs = append(attrs, action, common.ByteSize(t.Bytes), action+"_speed", t.Speed, action+"_reason", t.Reason)
+		}
+	}
+
+	slog.Info("session finished", attrs...)
+	if s.audit == nil {
+		return
+	}
+
+	if e := s.audit.write(r); e != nil {
+		slog.Error("audit", "session", r.Session, "error", e)
+	}
+}
+
+// stream joins data stream connection to the session and transfers data.
+func (s *Server) stream(conn net.Conn, pc *protocol.Conn, identity *auth.Identity, params *protocol.Params, admitted func()) error {
+	ss, err := s.sessions.join(params.Session, identity.ClientID, identity.Download)
+	admitted()
+
+	if err != nil {
+		return errors.Join(err, pc.WriteError(protocol.CodeParams, err.Error()))
+	}
+	defer s.sessions.leave(ss, identity.Download)
+
+	if retired := identity.RetiredAt; !retired.IsZero() && !ss.start.Before(retired) {
+		// retired tokens can't join sessions opened by new ones
+		err = errors.Join(ErrUnknownSession, fmt.Errorf("retired clientID %d, session %d", identity.ClientID, ss.id))
+		return errors.Join(err, pc.WriteError(protocol.CodeParams, ErrUnknownSession.Error()))
+	}
+
+	if !ss.params.Allowed(identity.Download) {
+		return reject(pc, ErrForbidden, protocol.CodeForbidden, fmt.Errorf("%s is not allowed", identity.Action()))
+	}
+
+	sessionParams := ss.params
+	sessionParams.Stream = params.Stream
+	params = &sessionParams
+
+	if err = pc.WriteMessage(protocol.TypeParams, params); err != nil {
+		return err
+	}
+
+	slog.Info(
+		"stream",
+		"session", ss.id, "address", conn.RemoteAddr().String(), "client", identity.ClientID,
+		"action", identity.Action(), "stream", params.Stream,
+	)
+
+	return s.transfer(conn, pc, ss, identity, params)
+}
+
+// transfer sends Start message and transfers data of the session's stream in the direction of client's token.
+func (s *Server) transfer(conn net.Conn, pc *protocol.Conn, ss *session, identity *auth.Identity, params *protocol.Params) error {
+	// handshake is finished, so deadlines are set for the test duration and the result waiting
+	if err := conn.SetDeadline(time.Now().Add(params.Duration + s.Timeout)); err != nil {
+		return fmt.Errorf("connection deadline: %w", err)
+	}
+
+	if err := pc.WriteMessage(protocol.TypeStart, &protocol.Start{Time: time.Now()}); err != nil {
 		return err
 	}
 
-	timeout *= multiplier
-	return conn.SetReadDeadline(time.Now().Add(timeout))
+	var (
+		report *common.Report
+		err    error
+	)
+
+	if identity.Download {
+		report, err = download(ss.ctx, pc, params.Duration, params.StreamBytes(params.Stream))
+	} else {
+		report, err = upload(ss.ctx, pc, params.StreamBytes(params.Stream))
+	}
+
+	logReport(
+		identity.Action(), report, err,
+		"session", ss.id, "client", identity.ClientID, "address", conn.RemoteAddr().String(), "stream", params.Stream,
+	)
+	ss.transferred(identity.Action(), report, nil, err)
+	s.metrics.transfer(identity.Action(), identity.ClientID, report.Count)
+
+	return err
+}
+
+// admit checks client's quotas and acquires its concurrent sessions, the returned function releases them.
+// Then it negotiates session params by client's limits and reserves their bytes in client's quotas,
+// so concurrent sessions can't exceed them, the reservation is settled by the session finishing.
+// Rejected clients get the reason.
+func (s *Server) admit(pc *protocol.Conn, identity *auth.Identity, params *protocol.Params) (func(), reservation, error) {
+	var (
+		groups   []string
+		reserved reservation
+	)
+
+	release := func() {
+		for _, group := range groups {
+			s.active.release(group)
+		}
+	}
+
+	if identity.Anonymous {
+		if !s.active.acquire(anonymousGroup, s.AnonymousSessions) {
+			return nil, reserved, reject(pc, ErrBusy, protocol.CodeBusy, errors.New("too many anonymous sessions"))
+		}
+		groups = append(groups, anonymousGroup)
+	}
+
+	// quotas checking and reservation are not interleaved by concurrent sessions
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+
+	var (
+		p    = identity.Policy
+		left uint64
+		err  error
+	)
+
+	if p != nil {
+		if left, err = s.quota(identity.ClientID, p); err != nil {
+			release()
+			return nil, reserved, reject(pc, ErrForbidden, protocol.CodeForbidden, err)
+		}
+
+		if p.MaxSessions > 0 {
+			group := clientGroup(identity.ClientID)
+			if !s.active.acquire(group, p.MaxSessions) {
+				release()
+				err := fmt.Errorf("too many sessions of client %d, limit %d", identity.ClientID, p.MaxSessions)
+				return nil, reserved, reject(pc, ErrForbidden, protocol.CodeForbidden, err)
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	maxDuration, maxBytes := s.limits(identity, left)
+	negotiate(params, maxDuration, maxBytes, s.MaxBitrate)
+
+	// allowed directions are decided only by client's policy
+	params.NoDownload, params.NoUpload = false, false
+	if p == nil {
+		return release, reserved, nil
+	}
+	params.NoDownload, params.NoUpload = p.NoDownload, p.NoUpload
+
+	if left > 0 {
+		// UDP flows are limited by the bitrate instead of the size
+		size := params.Bytes
+		if params.UDP {
+			size = params.FlowBytes()
+		}
+
+		for _, download := range []bool{true, false} {
+			if params.Allowed(download) {
+				reserved.size += size
+			}
+		}
+
+		reserved.at = time.Now()
+		s.usage.add(identity.ClientID, reserved.size, reserved.at)
+	}
+
+	return release, reserved, nil
+}
+
+// limits returns max test duration and size of every direction for the client, zero size is not limited.
+// Anonymous clients and clients with policies have their own limits,
+// but the duration can't be greater than the server's one.
+// Quotas limit the size by left bytes of them, they are shared between allowed directions.
+func (s *Server) limits(identity *auth.Identity, left uint64) (time.Duration, uint64) {
+	var (
+		duration = s.Duration
+		size     uint64
+	)
+
+	if identity.Anonymous {
+		if s.AnonymousDuration > 0 {
+			duration = min(duration, s.AnonymousDuration)
+		}
+		size = s.AnonymousBytes
+	}
+
+	p := identity.Policy
+	if p == nil {
+		return duration, size
+	}
+
+	if p.MaxDuration > 0 {
+		duration = min(duration, p.MaxDuration)
+	}
+	size = minSize(size, p.MaxBytes)
+
+	if left > 0 {
+		if p.Allowed(true) && p.Allowed(false) {
+			left = max(left/2, 1)
+		}
+		size = minSize(size, left)
+	}
+
+	return duration, size
+}
+
+// quota returns client's bytes left by policy's daily and monthly quotas, zero value means no quotas.
+// The error describes an exhausted quota.
+func (s *Server) quota(clientID uint16, p *auth.Policy) (uint64, error) {
+	if p.DailyQuota == 0 && p.MonthlyQuota == 0 {
+		return 0, nil
+	}
+
+	var (
+		left       uint64 = math.MaxUint64
+		day, month        = s.usage.get(clientID, time.Now())
+	)
+
+	quotas := []struct {
+		name        string
+		quota, used uint64
+	}{
+		{name: "daily", quota: p.DailyQuota, used: day},
+		{name: "monthly", quota: p.MonthlyQuota, used: month},
+	}
+
+	for _, q := range quotas {
+		if q.quota == 0 {
+			continue
+		}
+
+		if q.used >= q.quota {
+			return 0, fmt.Errorf("%s quota %s of client %d is exhausted", q.name, common.ByteSize(q.quota), clientID)
+		}
+
+		left = min(left, q.quota-q.used)
+	}
+
+	return left, nil
+}
+
+// minSize returns the least of size limits, zero values are not limited.
+func minSize(a, b uint64) uint64 {
+	switch {
+	case a == 0:
+		return b
+	case b == 0:
+		return a
+	}
+
+	return min(a, b)
+}
+
+// reject writes the reason of client's request rejection with the code and returns it joined with err.
+func reject(pc *protocol.Conn, err error, code string, reason error) error {
+	return errors.Join(err, reason, pc.WriteError(code, reason.Error()))
+}
+
+// authenticate verifies client's handshake, legacy tokens are rejected if they are not allowed.
+// Every token can be used only once.
+func (s *Server) authenticate(authenticator auth.Authenticator, h *auth.Handshake) (*auth.Identity, error) {
+	if s.RejectLegacy && auth.HeaderVersion(h.Header) == auth.TokenLegacy {
+		return nil, errors.Join(auth.ErrUnauthorized, auth.ErrLegacyToken)
+	}
+
+	identity, err := authenticator.Authenticate(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if p := identity.Policy; p != nil && p.Expired(time.Now()) {
+		return nil, errors.Join(
+			auth.ErrUnauthorized, auth.ErrExpired,
+			fmt.Errorf("client %d expired at %s", identity.ClientID, p.Expires.Format(time.RFC3339)),
+		)
+	}
+
+	if identity.Token != nil {
+		if err = s.replays.Check(identity.Token); err != nil {
+			return nil, err
+		}
+	}
+
+	return identity, nil
+}
+
+// hello reads client's preamble and replies with the negotiated protocol version and server time,
+// it returns the version and a random challenge sent to the client.
+func hello(pc *protocol.Conn) (uint8, []byte, error) {
+	version, err := pc.ReadPreamble()
+	if err == nil {
+		version, err = protocol.NegotiateVersion(version)
+	}
+
+	if err != nil {
+		message := fmt.Sprintf("server supports versions %d-%d", protocol.MinVersion, protocol.Version)
+		if e := pc.WriteError(protocol.CodeVersion, message); e != nil {
+			err = errors.Join(err, e)
+		}
+		return 0, nil, err
+	}
+
+	challenge, err := auth.NewChallenge()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	h := &protocol.Hello{Version: version, Time: time.Now(), Token: auth.TokenVersion, Challenge: challenge}
+	return version, challenge, pc.WriteMessage(protocol.TypeHello, h)
+}
+
+// handshake reads client's token and sends reply-token back, authorization failures are counted in metrics.
+// Clients without shared secrets (authenticated by certificates or anonymous) get an empty reply.
+func (s *Server) handshake(conn net.Conn, pc *protocol.Conn, authenticator auth.Authenticator, challenge []byte, ip net.IP) (*auth.Identity, error) {
+	header, err := pc.ReadFrame(protocol.TypeAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &auth.Handshake{Header: header, Challenge: challenge, RemoteAddr: conn.RemoteAddr()}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		h.State = &state
+	}
+
+	identity, err := s.authenticate(authenticator, h)
+	if err != nil {
+		s.metrics.authFailure(err)
+		if errors.Is(err, auth.ErrReplay) {
+			slog.Warn("token replay", "address", conn.RemoteAddr().String(), "error", err)
+		}
+
+		// only the expiry is reported, other reasons can help to guess tokens
+		var reason string
+		if errors.Is(err, auth.ErrExpired) {
+			reason = auth.ErrExpired.Error()
+		}
+
+		if e := pc.WriteError(protocol.CodeUnauthorized, reason); e != nil {
+			err = errors.Join(err, e)
+		}
+		return nil, err
+	}
+
+	var reply []byte
+	if token := identity.Token; token != nil && len(token.Secret) > 0 {
+		// the authenticator already updated temporary token's parts
+		token.IP = ip
+		reply = token.Sign()
+	}
+
+	if err = pc.WriteFrame(protocol.TypeAuth, reply); err != nil {
+		return nil, err
+	}
+
+	slog.Debug(
+		"identity", "client", identity.ClientID, "name", identity.Name, "anonymous", identity.Anonymous,
+		"attributes", identity.Attributes, "address", conn.RemoteAddr().String(),
+	)
+	return identity, nil
+}
+
+// download writes data to connection during the test duration or until size bytes are sent,
+// then it waits and returns client's report about received data.
+func download(ctx context.Context, pc *protocol.Conn, duration time.Duration, size uint64) (*common.Report, error) {
+	report, err := pc.Send(ctx, duration, size, func(stats *protocol.Stats) {
+		slog.Debug("stats", "count", common.ByteSize(stats.Count))
+	})
+
+	if err != nil {
+		return report, errors.Join(ErrDataWriteRead, fmt.Errorf("download: %w", err))
+	}
+
+	return report, nil
+}
+
+// upload reads data from connection until the client's end message,
+// then it sends back and returns a report with received bytes count and timestamps.
+// The connection deadline limits it in case of network problems, positive size aborts it if the client sends more.
+func upload(ctx context.Context, pc *protocol.Conn, size uint64) (*common.Report, error) {
+	report, err := pc.Receive(ctx, size, func(stats *protocol.Stats) {
+		slog.Debug("stats", "count", common.ByteSize(stats.Count))
+	})
+
+	if err != nil {
+		return report, errors.Join(ErrDataWriteRead, fmt.Errorf("upload: %w", err))
+	}
+
+	return report, nil
+}
+
+// logReport logs transfer report with extra attributes, it can be partial if the error is not nil.
+func logReport(msg string, report *common.Report, err error, extra ...any) {
+	attrs := append(
+		extra, "count", common.ByteSize(report.Count), "duration", report.Duration(), "speed", report.Speed(),
+	)
+
+	if err != nil {
+		slog.Warn(msg, append(attrs, "partial", true)...)
+		return
+	}
+
+	slog.Info(msg, attrs...)
 }
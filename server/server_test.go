@@ -1,19 +1,24 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/z0rr0/spts/auth"
 	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
 )
 
 const serverTimeout = 100 * time.Millisecond
@@ -24,11 +29,30 @@ func TestNew(t *testing.T) {
 		host      string
 		port      uint16
 		clients   int
+		duration  time.Duration
+		tls       bool
+		clientCA  string
+		anonymous int
+		failures  int
+		ban       time.Duration
+		allow     []string
+		deny      []string
 		withError bool
 	}{
-		{name: "valid", host: "localhost", port: 28081, clients: 1},
-		{name: "empty_host", port: 28081, clients: 2},
-		{name: "not_clients", port: 28081, withError: true},
+		{name: "valid", host: "localhost", port: 28081, clients: 1, duration: serverTimeout},
+		{name: "tls", host: "localhost", port: 28081, clients: 1, duration: serverTimeout, tls: true},
+		{name: "invalid_client_ca", port: 28081, clients: 1, duration: serverTimeout, clientCA: "ca.pem", withError: true},
+		{name: "empty_host", port: 28081, clients: 2, duration: serverTimeout},
+		{name: "not_clients", port: 28081, duration: serverTimeout, withError: true},
+		{name: "not_duration", port: 28081, clients: 1, withError: true},
+		{name: "anonymous", port: 28081, clients: 1, duration: serverTimeout, anonymous: 1},
+		{name: "no_anonymous_sessions", port: 28081, clients: 1, duration: serverTimeout, anonymous: -1, withError: true},
+		{name: "bans", port: 28081, clients: 1, duration: serverTimeout, failures: 3, ban: time.Minute},
+		{name: "negative_failures", port: 28081, clients: 1, duration: serverTimeout, failures: -1, withError: true},
+		{name: "no_ban_duration", port: 28081, clients: 1, duration: serverTimeout, failures: 3, withError: true},
+		{name: "access", port: 28081, clients: 1, duration: serverTimeout, allow: []string{"10.0.0.0/8", "::1"}, deny: []string{"10.1.0.0/16"}},
+		{name: "invalid_allow", port: 28081, clients: 1, duration: serverTimeout, allow: []string{"10.0.0.0/33"}, withError: true},
+		{name: "invalid_deny", port: 28081, clients: 1, duration: serverTimeout, deny: []string{"localhost"}, withError: true},
 	}
 
 	for i := range testCases {
@@ -36,81 +60,1200 @@ func TestNew(t *testing.T) {
 
 		t.Run(tc.name, func(t *testing.T) {
 			params := &common.Params{
-				Host:    tc.host,
-				Port:    tc.port,
-				Timeout: serverTimeout,
-				Clients: tc.clients,
+				Host:     tc.host,
+				Port:     tc.port,
+				Timeout:  serverTimeout,
+				Duration: tc.duration,
+				Clients:  tc.clients,
+
+				TLS:         tc.tls,
+				TLSClientCA: tc.clientCA,
+
+				Anonymous:         tc.anonymous != 0,
+				AnonymousSessions: max(tc.anonymous, 0),
+
+				BanFailures: tc.failures,
+				BanDuration: tc.ban,
+
+				Allow: tc.allow,
+				Deny:  tc.deny,
+			}
+			s, err := New(params)
+
+			if (err != nil) != tc.withError {
+				t.Errorf("want error %v, got %v", tc.withError, err)
+			}
+
+			if err == nil && s == nil {
+				t.Error("want server, got nil")
+			}
+
+			if err == nil && (s.tlsConfig != nil) != tc.tls {
+				t.Errorf("want tls %v, got %v", tc.tls, s.tlsConfig != nil)
+			}
+		})
+	}
+}
+
+func TestServer_Authenticator(t *testing.T) {
+	testCases := []struct {
+		name      string
+		tokens    string
+		certs     string
+		clientCA  string
+		file      string
+		authURL   string
+		anonymous bool
+		custom    auth.Authenticator
+		fallback  bool
+		err       error
+	}{
+		{name: "tokens", tokens: "1:3312a18b"},
+		{name: "custom", tokens: "1:xyz", custom: auth.Tokens{}},
+		{name: "callback", authURL: "http://127.0.0.1:8080/auth"},
+		{name: "anonymous", anonymous: true},
+		{name: "anonymous_tokens", tokens: "1:3312a18b", anonymous: true, fallback: true},
+		{name: "anonymous_certificates", certs: "1:probe-1", clientCA: "ca.pem", anonymous: true, fallback: true},
+		{name: "file", file: "# clients\n1:3312a18b\n"},
+		{name: "empty_file", file: "# no clients\n", err: auth.ErrAuthRequired},
+		{name: "certificates_empty_file", file: "\n", certs: "1:probe-1", clientCA: "ca.pem", fallback: true},
+		{name: "no_tokens", certs: "1:probe-1", err: auth.ErrAuthRequired},
+		{name: "certificates", certs: "1:probe-1", clientCA: "ca.pem"},
+		{name: "certificates_tokens", tokens: "1:3312a18b", certs: "1:probe-1", clientCA: "ca.pem", fallback: true},
+		{name: "no_certificates", tokens: "1:3312a18b", clientCA: "ca.pem", err: auth.ErrAuthRequired},
+		{name: "invalid_tokens", tokens: "1:xyz", certs: "1:probe-1", clientCA: "ca.pem", err: auth.ErrTokenFormat},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range map[string]string{auth.ServerEnv: tc.tokens, auth.CertEnv: tc.certs} {
+				if err := os.Setenv(name, value); err != nil {
+					t.Fatalf("failed to set environment variable: %v", err)
+				}
+			}
+
+			defer func() {
+				for _, name := range []string{auth.ServerEnv, auth.CertEnv} {
+					if err := os.Unsetenv(name); err != nil {
+						t.Errorf("failed to unset environment variable: %v", err)
+					}
+				}
+			}()
+
+			s := &Server{Params: common.Params{TLSClientCA: tc.clientCA, AuthURL: tc.authURL, Anonymous: tc.anonymous}}
+			s.SetAuthenticator(tc.custom)
+			if tc.file != "" {
+				s.TokensFile = filepath.Join(t.TempDir(), "tokens")
+				if err := os.WriteFile(s.TokensFile, []byte(tc.file), 0o600); err != nil {
+					t.Fatalf("failed to write tokens file: %v", err)
+				}
+			}
+
+			authenticator, err := s.authenticator()
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch a := authenticator.(type) {
+			case auth.Tokens:
+				if tc.custom == nil {
+					t.Error("want built-in authenticator")
+				}
+			case *auth.TokenStore, *auth.Callback:
+				if tc.clientCA != "" || tc.anonymous || tc.custom != nil {
+					t.Errorf("unexpected authenticator %T", a)
+				}
+			case *auth.Anonymous:
+				if !tc.anonymous || (a.Fallback != nil) != tc.fallback {
+					t.Errorf("unexpected anonymous authenticator: %+v", a)
+				}
+			case *auth.Certificates:
+				if tc.clientCA == "" || (a.Fallback != nil) != tc.fallback {
+					t.Errorf("unexpected certificates authenticator: %+v", a)
+				}
+			default:
+				t.Errorf("unexpected authenticator %T", a)
+			}
+		})
+	}
+}
+
+func TestNew_TokensSource(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		authURL  string
+		env      map[string]string
+		expected string
+		err      bool
+	}{
+		{name: "flag", file: "tokens", expected: "tokens"},
+		{name: "env", env: map[string]string{auth.ServerFileEnv: "/run/secrets/tokens"}, expected: "/run/secrets/tokens"},
+		{name: "flag_priority", file: "tokens", env: map[string]string{auth.ServerFileEnv: "/run/secrets/tokens"}, expected: "tokens"},
+		{name: "both_sources", file: "tokens", env: map[string]string{auth.ServerEnv: "1:3312a18b"}, err: true},
+		{name: "callback_and_env", authURL: "http://127.0.0.1:8080", env: map[string]string{auth.ServerEnv: "1:3312a18b"}, err: true},
+		{name: "callback", authURL: "http://127.0.0.1:8080"},
+		{name: "invalid_callback", authURL: "127.0.0.1:8080", err: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				if err := os.Setenv(name, value); err != nil {
+					t.Fatalf("failed to set environment variable: %v", err)
+				}
+			}
+
+			defer func() {
+				for name := range tc.env {
+					if err := os.Unsetenv(name); err != nil {
+						t.Errorf("failed to unset environment variable: %v", err)
+					}
+				}
+			}()
+
+			s, err := New(&common.Params{Port: 28081, Clients: 1, Duration: serverTimeout, TokensFile: tc.file, AuthURL: tc.authURL})
+			if tc.err {
+				if err == nil {
+					t.Error("want error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if s.TokensFile != tc.expected {
+				t.Errorf("want %q, got %q", tc.expected, s.TokensFile)
+			}
+		})
+	}
+}
+
+func TestServer_ReloadTokens(t *testing.T) {
+	var (
+		file    = filepath.Join(t.TempDir(), "tokens")
+		s       = &Server{Params: common.Params{TokensFile: file, Timeout: serverTimeout, Duration: serverTimeout}}
+		clients = map[uint16]*auth.Token{
+			1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+			2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}},
+			3: {ClientID: 3, Secret: []byte{0x01, 0x02, 0x03, 0x04}},
+		}
+	)
+
+	writeFile := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write tokens file: %v", err)
+		}
+	}
+
+	authenticate := func(authenticator auth.Authenticator, clientID uint16) (*auth.Identity, error) {
+		header, err := clients[clientID].Build()
+		if err != nil {
+			t.Fatalf("failed to build token: %v", err)
+		}
+		return authenticator.Authenticate(&auth.Handshake{Header: header})
+	}
+
+	if err := s.reloadTokens(); err == nil {
+		t.Error("want error for not loaded tokens")
+	}
+
+	writeFile("1:3312a18b\n2:666bf6a2 # to remove\n")
+	authenticator, err := s.authenticator()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// invalid file doesn't change current tokens
+	writeFile("1:xyz\n")
+	if err = s.reloadTokens(); !errors.Is(err, auth.ErrTokenFormat) {
+		t.Errorf("want %v, got %v", auth.ErrTokenFormat, err)
+	}
+
+	writeFile("1:3312a18b\n3:01020304\n")
+	if err = s.reloadTokens(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := s.tokens.Len(); n != 2 {
+		t.Errorf("want 2 tokens, got %d", n)
+	}
+
+	for clientID, retired := range map[uint16]bool{1: false, 2: true, 3: false} {
+		identity, e := authenticate(authenticator, clientID)
+		if e != nil {
+			t.Errorf("unexpected error for client %d: %v", clientID, e)
+			continue
+		}
+
+		if identity.RetiredAt.IsZero() == retired {
+			t.Errorf("want retired %v for client %d, got %v", retired, clientID, identity.RetiredAt)
+		}
+	}
+}
+
+func TestServer_StreamRetired(t *testing.T) {
+	s := &Server{sessions: newSessions(1)}
+
+	ss, err := s.sessions.open(context.Background(), 1, nil, protocol.Params{Duration: serverTimeout, Streams: 1}, serverTimeout)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer s.sessions.close(ss)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	// the token was retired before the session opening
+	var (
+		identity = &auth.Identity{ClientID: 1, RetiredAt: ss.start.Add(-time.Second)}
+		errs     = make(chan error, 1)
+	)
+
+	go func() {
+		errs <- s.stream(server, protocol.NewConn(server), identity, &protocol.Params{Session: ss.id}, func() {})
+	}()
+
+	if err = protocol.NewConn(client).ReadMessage(protocol.TypeParams, &protocol.Params{}); !errors.Is(err, protocol.ErrRejected) {
+		t.Errorf("want %v, got %v", protocol.ErrRejected, err)
+	}
+
+	if err = <-errs; !errors.Is(err, ErrUnknownSession) {
+		t.Errorf("want %v, got %v", ErrUnknownSession, err)
+	}
+}
+
+func TestServer_Handshakes(t *testing.T) {
+	s, err := New(&common.Params{Host: "127.0.0.1", Clients: 1, Duration: serverTimeout, Timeout: serverTimeout})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.handshakes = make(chan struct{}, 1)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	accept := func(ctx context.Context) (net.Conn, error) {
+		t.Helper()
+		client, e := net.Dial("tcp", listener.Addr().String())
+		if e != nil {
+			t.Fatalf("failed to dial: %v", e)
+		}
+		defer func() { _ = client.Close() }()
+
+		return s.connAccept(ctx, listener)
+	}
+
+	first, err := accept(context.Background())
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+
+	// the only handshake slot is taken by the first connection
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err = accept(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	admitted := s.admission()
+	admitted()
+	admitted() // the slot is released only once
+
+	second, err := accept(context.Background())
+	if err != nil {
+		t.Fatalf("failed to accept after admission: %v", err)
+	}
+	_ = second.Close()
+
+	if n := len(s.handshakes); n != 1 {
+		t.Errorf("want 1 taken handshake slot, got %d", n)
+	}
+}
+
+func TestServer_Limits(t *testing.T) {
+	testCases := []struct {
+		name      string
+		params    common.Params
+		anonymous bool
+		policy    *auth.Policy
+		used      uint64
+		duration  time.Duration
+		bytes     uint64
+	}{
+		{
+			name:     "client",
+			params:   common.Params{Duration: time.Minute, AnonymousDuration: time.Second, AnonymousBytes: 1024},
+			duration: time.Minute,
+		},
+		{
+			name:      "anonymous",
+			params:    common.Params{Duration: time.Minute, AnonymousDuration: time.Second, AnonymousBytes: 1024},
+			anonymous: true,
+			duration:  time.Second,
+			bytes:     1024,
+		},
+		{
+			name:      "anonymous_server_duration",
+			params:    common.Params{Duration: time.Second, AnonymousDuration: time.Minute},
+			anonymous: true,
+			duration:  time.Second,
+		},
+		{
+			name:      "anonymous_default",
+			params:    common.Params{Duration: time.Minute},
+			anonymous: true,
+			duration:  time.Minute,
+		},
+		{
+			name:     "policy",
+			params:   common.Params{Duration: time.Minute},
+			policy:   &auth.Policy{MaxDuration: time.Second, MaxBytes: 1024},
+			duration: time.Second,
+			bytes:    1024,
+		},
+		{
+			name:     "policy_server_duration",
+			params:   common.Params{Duration: time.Second},
+			policy:   &auth.Policy{MaxDuration: time.Minute},
+			duration: time.Second,
+		},
+		{
+			name:     "quota",
+			params:   common.Params{Duration: time.Minute},
+			policy:   &auth.Policy{MaxBytes: 1024, DailyQuota: 1000, MonthlyQuota: 5000},
+			used:     200,
+			duration: time.Minute,
+			bytes:    400,
+		},
+		{
+			name:     "quota_one_direction",
+			params:   common.Params{Duration: time.Minute},
+			policy:   &auth.Policy{NoUpload: true, MonthlyQuota: 1000},
+			used:     200,
+			duration: time.Minute,
+			bytes:    800,
+		},
+		{
+			name:     "quota_max_bytes",
+			params:   common.Params{Duration: time.Minute},
+			policy:   &auth.Policy{MaxBytes: 100, DailyQuota: 1000},
+			duration: time.Minute,
+			bytes:    100,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{Params: tc.params, usage: newUsage()}
+			s.usage.add(1, tc.used, time.Now())
+
+			var left uint64
+			if tc.policy != nil {
+				left, _ = s.quota(1, tc.policy)
+			}
+
+			duration, size := s.limits(&auth.Identity{ClientID: 1, Anonymous: tc.anonymous, Policy: tc.policy}, left)
+			if duration != tc.duration || size != tc.bytes {
+				t.Errorf("want %v and %d bytes, got %v and %d bytes", tc.duration, tc.bytes, duration, size)
+			}
+		})
+	}
+}
+
+func TestServer_Policy(t *testing.T) {
+	var (
+		params = &common.Params{Host: "127.0.0.1", Port: 28083, Timeout: serverTimeout, Duration: serverTimeout, Clients: 2}
+		tokens = map[uint16]*auth.Token{
+			1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
+			2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}},
+		}
+		stop = make(chan struct{})
+	)
+
+	if err := os.Setenv(auth.ServerEnv, "1:3312a18b scope=download max_sessions=1 daily_quota=2MB,2:666bf6a2 expires=2020-01-01"); err != nil {
+		t.Fatalf("failed to set environment variable: %v", err)
+	}
+
+	defer func() {
+		if err := os.Unsetenv(auth.ServerEnv); err != nil {
+			t.Errorf("failed to unset environment variable: %v", err)
+		}
+	}()
+
+	server, err := New(params)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-stop
+	}()
+
+	go func() {
+		if e := server.Start(ctx); e != nil {
+			t.Errorf("server start: %v", e)
+		}
+		close(stop)
+	}()
+	time.Sleep(time.Second)
+
+	rejected := func(err error, code, reason string) {
+		t.Helper()
+		var remote *protocol.Error
+
+		if !errors.As(err, &remote) || remote.Code != code || !strings.Contains(remote.Message, reason) {
+			t.Errorf("want %s error %q, got %v", code, reason, err)
+		}
+	}
+
+	expired := &testClient{id: 2, addr: &server.addr, token: tokens[2]}
+	_, _, err = expired.connect(true, &protocol.Params{Duration: serverTimeout})
+	rejected(err, protocol.CodeUnauthorized, "token expired")
+
+	client := &testClient{id: 1, addr: &server.addr, token: tokens[1]}
+	sessionParams := &protocol.Params{Duration: serverTimeout, Bytes: 1 << 20}
+
+	conn, pc, err := client.connect(false, sessionParams)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+
+	if !sessionParams.NoUpload || sessionParams.NoDownload || sessionParams.Bytes != 1<<20 || sessionParams.ClientIP != "127.0.0.1" {
+		t.Errorf("unexpected session params: %+v", sessionParams)
+	}
+
+	_, _, err = client.connect(false, &protocol.Params{Duration: serverTimeout})
+	rejected(err, protocol.CodeForbidden, "too many sessions")
+
+	_, _, err = client.connect(false, &protocol.Params{Session: sessionParams.Session})
+	rejected(err, protocol.CodeForbidden, "upload is not allowed")
+
+	if err = client.stream(sessionParams.Session, 0, true); err != nil {
+		t.Errorf("download: %v", err)
+	}
+
+	if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration}); err != nil {
+		t.Errorf("session end: %v", err)
+	}
+	_ = conn.Close()
+
+	// client's sessions are released after the session closing
+	for i := 0; i < 10; i++ {
+		server.active.mu.Lock()
+		released := len(server.active.active) == 0
+		server.active.mu.Unlock()
+
+		if released {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the rest of the quota is reserved by the new session
+	conn, _, err = client.connect(false, &protocol.Params{Duration: serverTimeout})
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, _, err = client.connect(false, &protocol.Params{Duration: serverTimeout})
+	rejected(err, protocol.CodeForbidden, "daily quota 2.00 MB of client 1 is exhausted")
+}
+
+func TestServer_QuotaReservation(t *testing.T) {
+	var (
+		params = &common.Params{Host: "127.0.0.1", Port: 28087, Timeout: serverTimeout, Duration: serverTimeout, Clients: 3}
+		token  = &auth.Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		stop   = make(chan struct{})
+	)
+
+	if err := os.Setenv(auth.ServerEnv, "1:3312a18b scope=download daily_quota=1MB"); err != nil {
+		t.Fatalf("failed to set environment variable: %v", err)
+	}
+
+	defer func() {
+		if err := os.Unsetenv(auth.ServerEnv); err != nil {
+			t.Errorf("failed to unset environment variable: %v", err)
+		}
+	}()
+
+	server, err := New(params)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-stop
+	}()
+
+	go func() {
+		if e := server.Start(ctx); e != nil {
+			t.Errorf("server start: %v", e)
+		}
+		close(stop)
+	}()
+	time.Sleep(time.Second)
+
+	client := &testClient{id: 1, addr: &server.addr, token: token}
+	open := func(size, want uint64) (net.Conn, *protocol.Conn) {
+		t.Helper()
+		sessionParams := &protocol.Params{Duration: serverTimeout, Bytes: size}
+
+		conn, pc, e := client.connect(false, sessionParams)
+		if e != nil {
+			t.Fatalf("failed to open session: %v", e)
+		}
+
+		if sessionParams.Bytes != want {
+			t.Errorf("want %d bytes, got %d", want, sessionParams.Bytes)
+		}
+		return conn, pc
+	}
+
+	// two concurrent sessions share the quota by their reservations
+	firstConn, firstPC := open(1<<19, 1<<19)
+	secondConn, secondPC := open(0, 1<<19)
+
+	var remote *protocol.Error
+	if _, _, err = client.connect(false, &protocol.Params{Duration: serverTimeout}); !errors.As(err, &remote) ||
+		remote.Code != protocol.CodeForbidden || !strings.Contains(remote.Message, "daily quota 1.00 MB of client 1 is exhausted") {
+		t.Errorf("want exhausted quota error, got %v", err)
+	}
+
+	for _, pc := range []*protocol.Conn{firstPC, secondPC} {
+		if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration}); err != nil {
+			t.Errorf("session end: %v", err)
+		}
+	}
+	_ = firstConn.Close()
+	_ = secondConn.Close()
+
+	// nothing is transferred, so reservations are returned to the quota
+	for i := 0; i < 10; i++ {
+		if day, _ := server.usage.get(1, time.Now()); day == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn, _ := open(0, 1<<20)
+	_ = conn.Close()
+}
+
+func TestServer_AdmitUDP(t *testing.T) {
+	s := &Server{Params: common.Params{Duration: time.Minute}, usage: newUsage(), active: newConcurrency()}
+
+	var (
+		identity = &auth.Identity{ClientID: 1, Policy: &auth.Policy{DailyQuota: 1 << 30}}
+		params   = &protocol.Params{Duration: time.Second, UDP: true, Bitrate: 8000, PacketSize: 100}
+	)
+
+	release, reserved, err := s.admit(nil, identity, params)
+	if err != nil {
+		t.Fatalf("failed to admit: %v", err)
+	}
+	defer release()
+
+	// both directions of the flow by its bitrate
+	if want := 2 * params.FlowBytes(); reserved.size != want || want == 0 {
+		t.Errorf("want reserved %d bytes, got %d", want, reserved.size)
+	}
+
+	if day, _ := s.usage.get(1, time.Now()); day != reserved.size {
+		t.Errorf("want used %d bytes, got %d", reserved.size, day)
+	}
+}
+
+func TestServer_Versions(t *testing.T) {
+	var (
+		params = &common.Params{Host: "127.0.0.1", Port: 28086, Timeout: serverTimeout, Duration: serverTimeout, Clients: 1}
+		token  = &auth.Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		stop   = make(chan struct{})
+	)
+
+	if err := os.Setenv(auth.ServerEnv, "1:3312a18b"); err != nil {
+		t.Fatalf("failed to set environment variable: %v", err)
+	}
+
+	defer func() {
+		if err := os.Unsetenv(auth.ServerEnv); err != nil {
+			t.Errorf("failed to unset environment variable: %v", err)
+		}
+	}()
+
+	server, err := New(params)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-stop
+	}()
+
+	go func() {
+		if e := server.Start(ctx); e != nil {
+			t.Errorf("server start: %v", e)
+		}
+		close(stop)
+	}()
+	time.Sleep(time.Second)
+
+	// the first version tests every direction over one connection
+	first := &testClient{id: 1, addr: &server.addr, token: token, version: protocol.MinVersion}
+	for _, download := range []bool{true, false} {
+		conn, pc, e := first.connect(download, &protocol.Params{Duration: serverTimeout})
+		if e != nil {
+			t.Fatalf("failed to connect by version %d, download=%v: %v", protocol.MinVersion, download, e)
+		}
+
+		var report *common.Report
+		if download {
+			report, e = pc.Receive(context.Background(), 0, nil)
+		} else {
+			report, e = pc.Send(context.Background(), serverTimeout, 0, nil)
+		}
+
+		if e != nil || report.Count == 0 {
+			t.Errorf("failed transfer by version %d, download=%v: %v", protocol.MinVersion, download, e)
+		}
+		_ = conn.Close()
+	}
+
+	// latency probes are unexpected frames for the second version
+	client := &testClient{id: 1, addr: &server.addr, token: token, version: protocol.VersionStreams}
+	for _, end := range []bool{true, false} {
+		sessionParams := &protocol.Params{Duration: serverTimeout, UDP: true}
+
+		conn, pc, e := client.connect(false, sessionParams)
+		if e != nil {
+			t.Fatalf("failed to open session by version %d: %v", protocol.VersionStreams, e)
+		}
+
+		if sessionParams.UDP {
+			t.Error("UDP session is opened by version without UDP flows")
+		}
+
+		if err = client.stream(sessionParams.Session, 0, true); err != nil {
+			t.Errorf("download by version %d: %v", protocol.VersionStreams, err)
+		}
+
+		if end {
+			if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration}); err != nil {
+				t.Errorf("session end: %v", err)
+			}
+		} else if _, err = pc.Ping(1); err == nil {
+			t.Errorf("latency probe is replied for version %d", protocol.VersionStreams)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestServer_Bans(t *testing.T) {
+	var (
+		params = &common.Params{
+			Host: "127.0.0.1", Port: 28084, Timeout: serverTimeout, Duration: serverTimeout, Clients: 1,
+			BanFailures: 2, BanDuration: time.Minute,
+		}
+		token = &auth.Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		stop  = make(chan struct{})
+	)
+
+	if err := os.Setenv(auth.ServerEnv, "1:3312a18b"); err != nil {
+		t.Fatalf("failed to set environment variable: %v", err)
+	}
+
+	defer func() {
+		if err := os.Unsetenv(auth.ServerEnv); err != nil {
+			t.Errorf("failed to unset environment variable: %v", err)
+		}
+	}()
+
+	server, err := New(params)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-stop
+	}()
+
+	go func() {
+		if e := server.Start(ctx); e != nil {
+			t.Errorf("server start: %v", e)
+		}
+		close(stop)
+	}()
+	time.Sleep(time.Second)
+
+	var (
+		valid   = &testClient{id: 1, addr: &server.addr, token: token}
+		invalid = &testClient{id: 1, addr: &server.addr, token: &auth.Token{ClientID: 1, Secret: []byte{0x01}}}
+	)
+
+	// a success resets failures
+	for _, c := range []*testClient{invalid, valid, invalid, invalid} {
+		conn, _, e := c.connect(false, &protocol.Params{Duration: serverTimeout})
+		if e == nil {
+			_ = conn.Close()
+		}
+
+		if (e == nil) != (c == valid) {
+			t.Errorf("unexpected handshake result: %v", e)
+		}
+	}
+
+	// connection handling is finished after the client's one
+	time.Sleep(100 * time.Millisecond)
+
+	if _, _, err = valid.connect(false, &protocol.Params{Duration: serverTimeout}); err == nil {
+		t.Error("banned client is connected")
+	}
+
+	bans := server.guard.bans(time.Now())
+	if len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Errorf("unexpected bans: %+v", bans)
+	}
+
+	server.guard.clear(nil, time.Now())
+	conn, _, err := valid.connect(false, &protocol.Params{Duration: serverTimeout})
+	if err != nil {
+		t.Fatalf("failed to connect after clearing bans: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestServer_Access(t *testing.T) {
+	var (
+		accessFile = filepath.Join(t.TempDir(), "access")
+		params     = &common.Params{
+			Host: "127.0.0.1", Port: 28085, Timeout: serverTimeout, Duration: serverTimeout, Clients: 1,
+			Allow: []string{"10.0.0.0/8"}, AccessFile: accessFile,
+		}
+		token = &auth.Token{ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}
+		stop  = make(chan struct{})
+	)
+
+	if err := os.WriteFile(accessFile, []byte("# local\ndeny 127.0.0.0/8\n"), 0600); err != nil {
+		t.Fatalf("failed to write access file: %v", err)
+	}
+
+	if err := os.Setenv(auth.ServerEnv, "1:3312a18b"); err != nil {
+		t.Fatalf("failed to set environment variable: %v", err)
+	}
+
+	defer func() {
+		if err := os.Unsetenv(auth.ServerEnv); err != nil {
+			t.Errorf("failed to unset environment variable: %v", err)
+		}
+	}()
+
+	server, err := New(params)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-stop
+	}()
+
+	go func() {
+		if e := server.Start(ctx); e != nil {
+			t.Errorf("server start: %v", e)
+		}
+		close(stop)
+	}()
+	time.Sleep(time.Second)
+
+	client := &testClient{id: 1, addr: &server.addr, token: token}
+	if _, _, err = client.connect(false, &protocol.Params{Duration: serverTimeout}); err == nil {
+		t.Error("denied client is connected")
+	}
+
+	// invalid rules don't replace current ones
+	if err = os.WriteFile(accessFile, []byte("allow 127.0.0.1/33\n"), 0600); err != nil {
+		t.Fatalf("failed to write access file: %v", err)
+	}
+
+	if err = server.loadAccess(); !errors.Is(err, ErrAccessRule) {
+		t.Errorf("want error %v, got %v", ErrAccessRule, err)
+	}
+
+	if allowed, _ := server.access.Load().check(netip.MustParseAddr("127.0.0.1")); allowed {
+		t.Error("access rules are replaced by invalid ones")
+	}
+
+	if err = os.WriteFile(accessFile, []byte("allow 127.0.0.1\n"), 0600); err != nil {
+		t.Fatalf("failed to write access file: %v", err)
+	}
+
+	if err = server.loadAccess(); err != nil {
+		t.Fatalf("failed to reload access rules: %v", err)
+	}
+
+	conn, _, err := client.connect(false, &protocol.Params{Duration: serverTimeout})
+	if err != nil {
+		t.Fatalf("failed to connect after access rules reload: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestServer_Authenticate(t *testing.T) {
+	tokens := auth.Tokens{1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}}}
+
+	testCases := []struct {
+		name         string
+		version      uint8
+		rejectLegacy bool
+		expires      time.Time
+		err          error
+	}{
+		{name: "hmac", version: auth.TokenHMAC, rejectLegacy: true},
+		{name: "legacy", version: auth.TokenLegacy},
+		{name: "rejected_legacy", version: auth.TokenLegacy, rejectLegacy: true, err: auth.ErrLegacyToken},
+		{name: "expired", version: auth.TokenHMAC, expires: time.Now(), err: auth.ErrExpired},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			token := &auth.Token{ClientID: 1, Secret: tokens[1].Secret, Version: tc.version}
+
+			header, err := token.Build()
+			if err != nil {
+				t.Fatalf("failed to build token: %v", err)
 			}
-			s, err := New(params)
 
-			if (err != nil) != tc.withError {
-				t.Errorf("want error %v, got %v", tc.withError, err)
+			tokens[1].Policy = nil
+			if !tc.expires.IsZero() {
+				tokens[1].Policy = &auth.Policy{Expires: tc.expires}
 			}
 
-			if err == nil && s == nil {
-				t.Error("want server, got nil")
+			s := &Server{Params: common.Params{RejectLegacy: tc.rejectLegacy}, replays: auth.NewReplayCache(1)}
+			result, err := s.authenticate(tokens, &auth.Handshake{Header: header})
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) || !errors.Is(err, auth.ErrUnauthorized) {
+					t.Errorf("want %v, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.Token == nil || result.Token.Version != tc.version {
+				t.Errorf("want version %d token, got %+v", tc.version, result.Token)
+			}
+
+			if _, err = s.authenticate(tokens, &auth.Handshake{Header: header}); !errors.Is(err, auth.ErrReplay) {
+				t.Errorf("want %v, got %v", auth.ErrReplay, err)
 			}
 		})
 	}
 }
 
 type testClient struct {
-	id    uint16
-	addr  *net.TCPAddr
-	token *auth.Token
+	id      uint16
+	addr    *net.TCPAddr
+	token   *auth.Token
+	version uint8 // zero is protocol.Version
 }
 
-func (c *testClient) connect(download bool) (net.Conn, error) {
+func (c *testClient) connect(download bool, params *protocol.Params) (net.Conn, *protocol.Conn, error) {
 	conn, err := net.Dial(c.addr.Network(), c.addr.String())
 	if err != nil {
-		return nil, fmt.Errorf("dial: %w", err)
+		return nil, nil, fmt.Errorf("dial: %w", err)
+	}
+
+	version := protocol.Version
+	if c.version > 0 {
+		version = c.version
+	}
+
+	pc := protocol.NewConn(conn)
+	if err = pc.WritePreamble(version); err != nil {
+		return nil, nil, err
+	}
+
+	hello := &protocol.Hello{}
+	if err = pc.ReadMessage(protocol.TypeHello, hello); err != nil {
+		return nil, nil, fmt.Errorf("hello: %w", err)
+	}
+
+	token := *c.token
+	token.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	token.Download = download
+	token.Version = auth.Negotiate(hello.Token, hello.Challenge)
+	token.Challenge = hello.Challenge
+
+	if version < protocol.VersionStreams {
+		// the first version clients know only legacy tokens
+		token.Version, token.Challenge = auth.TokenLegacy, nil
+	}
+
+	header, err := token.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = pc.WriteFrame(protocol.TypeAuth, header); err != nil {
+		return nil, nil, err
 	}
 
-	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
-	c.token.IP = remoteAddr.IP
-	c.token.Download = download
+	if header, err = pc.ReadFrame(protocol.TypeAuth); err != nil {
+		return nil, nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	if err = token.VerifyReply(header); err != nil {
+		return nil, nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	isStream := params.Session != 0 || version < protocol.VersionStreams
+	if err = pc.WriteMessage(protocol.TypeParams, params); err != nil {
+		return nil, nil, err
+	}
+
+	*params = protocol.Params{}
+	if err = pc.ReadMessage(protocol.TypeParams, params); err != nil {
+		return nil, nil, fmt.Errorf("params: %w", err)
+	}
 
-	if err = c.token.Handshake(conn); err != nil {
-		return nil, fmt.Errorf("handshake: %w", err)
+	if isStream {
+		if err = pc.ReadMessage(protocol.TypeStart, &protocol.Start{}); err != nil {
+			return nil, nil, fmt.Errorf("start: %w", err)
+		}
 	}
 
-	return conn, nil
+	return conn, pc, nil
 }
 
-func (c *testClient) do() error {
-	// upload
-	conn, err := c.connect(false)
+// stream does one data stream test, the stream must transfer exactly its part of the size limit if it's set.
+func (c *testClient) stream(session uint64, index int, download bool) error {
+	params := &protocol.Params{Session: session, Stream: index}
+
+	conn, pc, err := c.connect(download, params)
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	r := common.NewReader(context.Background())
-	_, err = io.Copy(conn, r)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var (
+		report *common.Report
+		size   = params.StreamBytes(index)
+	)
+
+	if download {
+		report, err = pc.Receive(context.Background(), 0, nil)
+	} else {
+		report, err = pc.Send(context.Background(), params.Duration, size, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("stream %d, download=%v: %w", index, download, err)
+	}
 
-	if err = common.SkipError(err); err != nil {
-		return fmt.Errorf("upload read/write: %w", err)
+	if report.Count == 0 {
+		return fmt.Errorf("stream %d, download=%v: empty report", index, download)
 	}
 
-	if err = conn.Close(); err != nil {
-		return fmt.Errorf("close upload: %w", err)
+	if size > 0 && report.Count != size {
+		return fmt.Errorf("stream %d, download=%v: want %d bytes, got %d", index, download, size, report.Count)
 	}
 
-	// download
-	if conn, err = c.connect(true); err != nil {
-		return fmt.Errorf("connect: %w", err)
+	return nil
+}
+
+func (c *testClient) do(streams int, size uint64) error {
+	params := &protocol.Params{Duration: serverTimeout, Streams: streams, Bytes: size}
+
+	conn, pc, err := c.connect(false, params)
+	if err != nil {
+		return fmt.Errorf("session: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout/2)
-	defer cancel()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if params.Session == 0 || params.Streams != streams || params.Bytes != size {
+		return fmt.Errorf("unexpected session params: %+v", params)
+	}
+
+	if _, err = pc.Ping(1); err != nil {
+		return fmt.Errorf("session ping: %w", err)
+	}
+
+	for _, download := range []bool{false, true} {
+		errs := make(chan error, streams)
+
+		for i := 0; i < streams; i++ {
+			go func(i int, download bool) {
+				errs <- c.stream(params.Session, i, download)
+			}(i, download)
+		}
+
+		for i := 0; i < streams; i++ {
+			if e := <-errs; e != nil {
+				err = errors.Join(err, e)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration}); err != nil {
+		return fmt.Errorf("session end: %w", err)
+	}
+
+	return nil
+}
+
+// doUDP does a UDP session with upload and download flows.
+func (c *testClient) doUDP() error {
+	params := &protocol.Params{Duration: serverTimeout / 2, UDP: true, Bitrate: 8 * 1000 * 1000}
+
+	conn, pc, err := c.connect(false, params)
+	if err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if !params.UDP || params.PacketSize != protocol.DefaultPacketSize {
+		return fmt.Errorf("unexpected session params: %+v", params)
+	}
+
+	udp, err := net.Dial("udp", conn.RemoteAddr().String())
+	if err != nil {
+		return fmt.Errorf("dial udp: %w", err)
+	}
+
+	defer func() {
+		_ = udp.Close()
+	}()
+
+	// upload
+	if err = pc.WriteMessage(protocol.TypeFlow, &protocol.Flow{}); err != nil {
+		return err
+	}
+
+	if err = pc.ReadMessage(protocol.TypeStart, &protocol.Start{}); err != nil {
+		return fmt.Errorf("upload start: %w", err)
+	}
+
+	report, err := pc.SendFlow(context.Background(), func(b []byte) error {
+		_, e := udp.Write(b)
+		return e
+	}, params)
+
+	if err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+
+	if report.Received == 0 {
+		return fmt.Errorf("upload: empty report %+v", report)
+	}
+
+	// download, registration datagrams are sent until the start message
+	if err = pc.WriteMessage(protocol.TypeFlow, &protocol.Flow{Download: true}); err != nil {
+		return err
+	}
+
+	started := make(chan struct{})
+	go func() {
+		header := make([]byte, protocol.DatagramHeaderSize)
+		(&protocol.Datagram{Session: params.Session}).Encode(header)
+
+		for {
+			_, _ = udp.Write(header)
+
+			select {
+			case <-started:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
 
-	w := common.NewWriter(ctx)
-	_, err = io.Copy(w, conn)
+	err = pc.ReadMessage(protocol.TypeStart, &protocol.Start{})
+	close(started)
 
-	if err != nil && !errors.Is(err, common.ErrWriterTimeout) {
-		return fmt.Errorf("download read/write: %w", err)
+	if err != nil {
+		return fmt.Errorf("download start: %w", err)
+	}
+
+	buf := make([]byte, protocol.MaxDatagramSize)
+
+	counter := protocol.NewDatagramCounter(0, 0)
+	go func() {
+		for {
+			n, e := udp.Read(buf)
+			if e != nil {
+				return
+			}
+
+			if d, e := protocol.DecodeDatagram(buf[:n]); e == nil {
+				counter.Add(d, n, time.Now())
+			}
+		}
+	}()
+
+	if report, err = pc.ReceiveFlow(counter); err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+
+	if report.Received == 0 {
+		return fmt.Errorf("download: empty report %+v", report)
+	}
+
+	if err = pc.WriteMessage(protocol.TypeEnd, &protocol.End{Reason: protocol.ReasonDuration}); err != nil {
+		return fmt.Errorf("session end: %w", err)
 	}
 
-	return conn.Close()
+	return nil
 }
 
 func tokensToString(tokens map[uint16]*auth.Token) string {
@@ -125,7 +1268,10 @@ func tokensToString(tokens map[uint16]*auth.Token) string {
 
 func TestStart(t *testing.T) {
 	var (
-		params = &common.Params{Host: "127.0.0.1", Port: 28082, Timeout: serverTimeout, Clients: 1}
+		params = &common.Params{
+			Host: "127.0.0.1", Port: 28082, Timeout: serverTimeout, Duration: serverTimeout, Clients: 1,
+			Audit: filepath.Join(t.TempDir(), "audit.log"),
+		}
 		tokens = map[uint16]*auth.Token{
 			1: {ClientID: 1, Secret: []byte{0x33, 0x12, 0xa1, 0x8b}},
 			2: {ClientID: 2, Secret: []byte{0x66, 0x6b, 0xf6, 0xa2}},
@@ -165,7 +1311,150 @@ func TestStart(t *testing.T) {
 	client := &testClient{id: 2, addr: &server.addr, token: tokens[2]}
 
 	time.Sleep(2 * time.Second)
-	if err = client.do(); err != nil {
+	if err = client.do(2, 0); err != nil {
 		t.Errorf("client do: %v", err)
 	}
+
+	if err = client.do(3, 1<<20+1); err != nil {
+		t.Errorf("client do with size limit: %v", err)
+	}
+
+	if err = client.doUDP(); err != nil {
+		t.Errorf("client do UDP: %v", err)
+	}
+
+	// records are written after sessions closing, the server is stopped to wait them
+	cancel()
+	<-stop
+
+	records := readAudit(t, params.Audit)
+	if n := len(records); n != 3 {
+		t.Fatalf("want 3 audit records, got %d", n)
+	}
+
+	for i, r := range records {
+		if r.ClientID != 2 || r.Reason != reasonCompleted || r.UDP != (i == 2) || len(r.Transfers) != 2 {
+			t.Errorf("unexpected audit record %d: %+v", i, r)
+		}
+
+		for action, tr := range r.Transfers {
+			if tr.Bytes == 0 || tr.Reason != reasonCompleted || tr.BitsPerSecond <= 0 {
+				t.Errorf("unexpected %s transfer of record %d: %+v", action, i, tr)
+			}
+
+			if i == 1 && tr.Bytes != 1<<20+1 {
+				t.Errorf("want %d bytes of %s transfer, got %d", 1<<20+1, action, tr.Bytes)
+			}
+
+			if (tr.Datagrams != nil) != r.UDP {
+				t.Errorf("unexpected datagrams of %s transfer of record %d: %v", action, i, tr.Datagrams)
+			}
+		}
+	}
+}
+
+func readAudit(t *testing.T, name string) []*record {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+
+	var records []*record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		r := &record{}
+		if err = json.Unmarshal([]byte(line), r); err != nil {
+			t.Fatalf("failed to decode audit record %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func TestHello(t *testing.T) {
+	testCases := []struct {
+		name     string
+		preamble func(pc *protocol.Conn, w io.Writer) error
+		version  uint8
+		want     error
+	}{
+		{
+			name:     "valid",
+			preamble: func(pc *protocol.Conn, _ io.Writer) error { return pc.WritePreamble(protocol.Version) },
+			version:  protocol.Version,
+		},
+		{
+			name:     "min_version",
+			preamble: func(pc *protocol.Conn, _ io.Writer) error { return pc.WritePreamble(protocol.MinVersion) },
+			version:  protocol.MinVersion,
+		},
+		{
+			name:     "newer",
+			preamble: func(pc *protocol.Conn, _ io.Writer) error { return pc.WritePreamble(protocol.Version + 1) },
+			version:  protocol.Version,
+		},
+		{
+			name:     "unsupported",
+			preamble: func(pc *protocol.Conn, _ io.Writer) error { return pc.WritePreamble(0) },
+			want:     protocol.ErrUnsupportedVersion,
+		},
+		{
+			name: "legacy",
+			preamble: func(_ *protocol.Conn, w io.Writer) error {
+				_, err := w.Write(make([]byte, 147)) // old clients send only auth token
+				return err
+			},
+			want: protocol.ErrUnsupportedVersion,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() {
+				_ = client.Close()
+				_ = server.Close()
+			}()
+
+			var (
+				serverErr = make(chan error, 1)
+				challenge []byte
+				version   uint8
+			)
+
+			go func() {
+				var e error
+				version, challenge, e = hello(protocol.NewConn(server))
+				serverErr <- e
+				_ = server.Close()
+			}()
+
+			// pipe is synchronous and server doesn't read all legacy token bytes,
+			// so write errors are expected and ignored
+			pc := protocol.NewConn(client)
+			go func() {
+				_ = tc.preamble(pc, client)
+			}()
+
+			h := &protocol.Hello{}
+			err := pc.ReadMessage(protocol.TypeHello, h)
+			if !errors.Is(err, tc.want) && !(tc.want == nil && err == nil) {
+				t.Errorf("client want %v, got %v", tc.want, err)
+			}
+
+			if err = <-serverErr; !errors.Is(err, tc.want) && !(tc.want == nil && err == nil) {
+				t.Errorf("server want %v, got %v", tc.want, err)
+			}
+
+			if err == nil && (len(challenge) == 0 || !bytes.Equal(challenge, h.Challenge) || h.Token != auth.TokenVersion) {
+				t.Errorf("unexpected hello %+v, challenge %x", h, challenge)
+			}
+
+			if err == nil && (version != tc.version || h.Version != tc.version) {
+				t.Errorf("want version %d, got %d and hello %d", tc.version, version, h.Version)
+			}
+		})
+	}
 }
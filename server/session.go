@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// maxStreams is a maximum number of parallel streams per direction in one session.
+const maxStreams = 64
+
+var (
+	// ErrBusy is returned when there are no free slots for a new session.
+	ErrBusy = errors.New("server is busy")
+
+	// ErrForbidden is returned when client's policy doesn't allow the request.
+	ErrForbidden = errors.New("forbidden by client's policy")
+
+	// ErrUnknownSession is returned when a stream tries to join to unknown session.
+	ErrUnknownSession = errors.New("unknown session")
+
+	// ErrTooManyStreams is returned when a session already has all negotiated streams.
+	ErrTooManyStreams = errors.New("too many streams")
+)
+
+// negotiate updates client's requested parameters by server limits.
+// Test duration can't be greater than the server's one, the size limit can't be less than streams number.
+// Positive maxBytes limits the size of every direction, for UDP flows it's done by the bitrate,
+// which is also limited by positive maxBitrate.
+func negotiate(params *protocol.Params, maxDuration time.Duration, maxBytes, maxBitrate uint64) {
+	if params.Duration <= 0 || params.Duration > maxDuration {
+		params.Duration = maxDuration
+	}
+
+	if maxBytes > 0 && (params.Bytes == 0 || params.Bytes > maxBytes) {
+		params.Bytes = maxBytes
+	}
+
+	params.Streams = min(max(params.Streams, 1), maxStreams)
+
+	if params.UDP {
+		// datagrams flow is only one, its size is limited by the duration and bitrate
+		params.Streams, params.Bytes = 1, 0
+
+		if params.Bitrate == 0 {
+			params.Bitrate = protocol.DefaultBitrate
+		}
+
+		if maxBitrate > 0 {
+			params.Bitrate = min(params.Bitrate, maxBitrate)
+		}
+
+		if params.PacketSize == 0 {
+			params.PacketSize = protocol.DefaultPacketSize
+		}
+		params.PacketSize = min(max(params.PacketSize, protocol.DatagramHeaderSize), protocol.MaxDatagramSize)
+
+		if maxBytes > 0 {
+			bitrate := uint64(float64(maxBytes*8) / params.Duration.Seconds())
+			params.Bitrate = max(min(params.Bitrate, bitrate), 1)
+		}
+	} else {
+		params.Bitrate, params.PacketSize = 0, 0
+	}
+
+	if params.Bytes > 0 {
+		params.Bytes = max(params.Bytes, uint64(params.Streams))
+	}
+}
+
+// session is a client's test session, it's alive while its control connection is open.
+// UDP datagrams of the session are accepted only from the control connection's IP address.
+type session struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	id       uint64
+	clientID uint16
+	ip       net.IP
+	params   protocol.Params
+	start    time.Time
+	reserved reservation
+	active   [2]int // active streams by direction index
+	streams  sync.WaitGroup
+
+	mu        sync.Mutex
+	register  chan *net.UDPAddr
+	counter   *protocol.DatagramCounter
+	transfers map[string]*transferRecord
+}
+
+// transferred adds a receiver's report of the finished stream or UDP flow of the action,
+// datagrams statistics are set only for UDP flows.
+func (ss *session) transferred(action string, report *common.Report, datagrams *common.UDPReport, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	t, ok := ss.transfers[action]
+	if !ok {
+		t = &transferRecord{}
+		ss.transfers[action] = t
+	}
+
+	t.add(report, err)
+	if datagrams != nil {
+		t.Datagrams = datagrams
+	}
+}
+
+// wait waits the end of active streams not longer than timeout, it returns false on timeout.
+func (ss *session) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		ss.streams.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// record returns the audit record of the finished session, err is its control connection error.
+func (ss *session) record(address string, err error) *record {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	r := &record{
+		Session:   ss.id,
+		ClientID:  ss.clientID,
+		IP:        ss.ip.String(),
+		Address:   address,
+		UDP:       ss.params.UDP,
+		Streams:   ss.params.Streams,
+		Start:     ss.start,
+		End:       time.Now(),
+		Transfers: make(map[string]*transferRecord, len(ss.transfers)),
+		Reason:    terminationReason(err),
+	}
+
+	for action, t := range ss.transfers {
+		tr := *t
+		r.Transfers[action] = &tr
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// expect sets a receiver for the client's registration datagrams
+// (or counter for data ones), nil values stop the current receiving.
+func (ss *session) expect(register chan *net.UDPAddr, counter *protocol.DatagramCounter) {
+	ss.mu.Lock()
+	ss.register, ss.counter = register, counter
+	ss.mu.Unlock()
+}
+
+// datagram handles a received datagram of the session.
+func (ss *session) datagram(d *protocol.Datagram, size int, addr *net.UDPAddr, arrival time.Time) {
+	if !ss.ip.Equal(addr.IP) {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if d.Seq == 0 {
+		if ss.register != nil {
+			select {
+			case ss.register <- addr:
+			default:
+			}
+		}
+		return
+	}
+
+	if ss.counter != nil {
+		ss.counter.Add(d, size, arrival)
+	}
+}
+
+// sessions is a registry of active sessions, their number is limited by the semaphore.
+type sessions struct {
+	mu        sync.Mutex
+	items     map[uint64]*session
+	semaphore chan struct{}
+}
+
+// newSessions creates a new sessions registry with clients limit.
+func newSessions(clients int) *sessions {
+	return &sessions{items: make(map[uint64]*session), semaphore: make(chan struct{}, clients)}
+}
+
+// open creates a new session, it waits a free slot not longer than timeout.
+func (s *sessions) open(ctx context.Context, clientID uint16, ip net.IP, params protocol.Params, timeout time.Duration) (*session, error) {
+	var idBytes [8]byte
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.semaphore <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		<-s.semaphore
+		return nil, fmt.Errorf("session id: %w", err)
+	}
+
+	params.Session = binary.BigEndian.Uint64(idBytes[:])
+
+	ss := &session{
+		id:        params.Session,
+		clientID:  clientID,
+		ip:        ip,
+		params:    params,
+		start:     time.Now(),
+		transfers: make(map[string]*transferRecord),
+	}
+	ss.ctx, ss.cancel = context.WithCancel(ctx)
+
+	s.mu.Lock()
+	s.items[ss.id] = ss
+	s.mu.Unlock()
+
+	return ss, nil
+}
+
+// close removes the session and aborts its active streams.
+func (s *sessions) close(ss *session) {
+	s.mu.Lock()
+	delete(s.items, ss.id)
+	s.mu.Unlock()
+
+	ss.cancel()
+	<-s.semaphore
+}
+
+// directionIndex returns an index of the direction in session's active streams.
+func directionIndex(download bool) int {
+	if download {
+		return 0
+	}
+
+	return 1
+}
+
+// join adds a new stream of the direction to the existing session of the same client.
+// Streams are limited for every direction, so a finishing download stream doesn't block upload ones.
+func (s *sessions) join(id uint64, clientID uint16, download bool) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, ok := s.items[id]
+	if !ok || ss.clientID != clientID {
+		return nil, ErrUnknownSession
+	}
+
+	if ss.params.UDP {
+		return nil, errors.Join(ErrTooManyStreams, errors.New("UDP session has no streams"))
+	}
+
+	i := directionIndex(download)
+	if ss.active[i] >= ss.params.Streams {
+		return nil, errors.Join(ErrTooManyStreams, fmt.Errorf("limit %d", ss.params.Streams))
+	}
+
+	ss.active[i]++
+	ss.streams.Add(1)
+	return ss, nil
+}
+
+// get returns an active session by its ID or nil.
+func (s *sessions) get(id uint64) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.items[id]
+}
+
+// leave removes the stream of the direction from the session.
+func (s *sessions) leave(ss *session, download bool) {
+	s.mu.Lock()
+	ss.active[directionIndex(download)]--
+	s.mu.Unlock()
+
+	ss.streams.Done()
+}
+
+// slots returns the number of occupied semaphore slots.
+func (s *sessions) slots() int {
+	return len(s.semaphore)
+}
+
+// count returns the number of active sessions.
+func (s *sessions) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.items)
+}
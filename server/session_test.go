@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/spts/protocol"
+)
+
+func TestSessions(t *testing.T) {
+	var (
+		s      = newSessions(1)
+		ctx    = context.Background()
+		params = protocol.Params{Duration: time.Second, Streams: 2}
+		ip     = net.IPv4(127, 0, 0, 1)
+	)
+
+	ss, err := s.open(ctx, 1, ip, params, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+
+	if ss.id == 0 || ss.params.Session != ss.id || ss.params.Streams != 2 {
+		t.Errorf("unexpected session params: %+v", ss.params)
+	}
+
+	if n := s.count(); n != 1 {
+		t.Errorf("want 1 session, got %d", n)
+	}
+
+	// only one session is allowed
+	if _, err = s.open(ctx, 2, ip, params, time.Millisecond); !errors.Is(err, ErrBusy) {
+		t.Errorf("want %v, got %v", ErrBusy, err)
+	}
+
+	if _, err = s.join(ss.id, 2, true); !errors.Is(err, ErrUnknownSession) {
+		t.Errorf("want %v for other client, got %v", ErrUnknownSession, err)
+	}
+
+	if _, err = s.join(ss.id+1, 1, true); !errors.Is(err, ErrUnknownSession) {
+		t.Errorf("want %v for unknown ID, got %v", ErrUnknownSession, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = s.join(ss.id, 1, true); err != nil {
+			t.Fatalf("failed to join stream %d: %v", i, err)
+		}
+	}
+
+	if _, err = s.join(ss.id, 1, true); !errors.Is(err, ErrTooManyStreams) {
+		t.Errorf("want %v, got %v", ErrTooManyStreams, err)
+	}
+
+	// upload streams are limited separately, e.g. when download ones are finishing
+	if _, err = s.join(ss.id, 1, false); err != nil {
+		t.Errorf("failed to join upload stream: %v", err)
+	}
+
+	s.leave(ss, true)
+	if _, err = s.join(ss.id, 1, true); err != nil {
+		t.Errorf("failed to join stream after leaving: %v", err)
+	}
+
+	s.close(ss)
+	if err = ss.ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("want canceled session context, got %v", err)
+	}
+
+	if n := s.count(); n != 0 {
+		t.Errorf("want 0 sessions, got %d", n)
+	}
+
+	// semaphore is released
+	if ss, err = s.open(ctx, 2, ip, params, time.Millisecond); err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+
+	s.close(ss)
+}
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		params   protocol.Params
+		maxBytes uint64
+		want     protocol.Params
+	}{
+		{
+			name:   "default",
+			params: protocol.Params{},
+			want:   protocol.Params{Duration: time.Second, Streams: 1},
+		},
+		{
+			name:   "requested",
+			params: protocol.Params{Duration: time.Millisecond, Streams: 2, Bytes: 100},
+			want:   protocol.Params{Duration: time.Millisecond, Streams: 2, Bytes: 100},
+		},
+		{
+			name:   "limited",
+			params: protocol.Params{Duration: time.Minute, Streams: maxStreams + 1},
+			want:   protocol.Params{Duration: time.Second, Streams: maxStreams},
+		},
+		{
+			name:   "udp",
+			params: protocol.Params{Duration: time.Second, Streams: 4, Bytes: 100, UDP: true, PacketSize: 1},
+			want: protocol.Params{
+				Duration:   time.Second,
+				Streams:    1,
+				UDP:        true,
+				Bitrate:    protocol.DefaultBitrate,
+				PacketSize: protocol.DatagramHeaderSize,
+			},
+		},
+		{
+			name:   "max_bitrate",
+			params: protocol.Params{Duration: time.Second, UDP: true, Bitrate: 10 * protocol.DefaultMaxBitrate},
+			want: protocol.Params{
+				Duration:   time.Second,
+				Streams:    1,
+				UDP:        true,
+				Bitrate:    protocol.DefaultMaxBitrate,
+				PacketSize: protocol.DefaultPacketSize,
+			},
+		},
+		{
+			name:   "tcp_bitrate",
+			params: protocol.Params{Duration: time.Second, Streams: 1, Bitrate: 100, PacketSize: 100},
+			want:   protocol.Params{Duration: time.Second, Streams: 1},
+		},
+		{
+			name:   "small_size",
+			params: protocol.Params{Duration: time.Second, Streams: 4, Bytes: 1},
+			want:   protocol.Params{Duration: time.Second, Streams: 4, Bytes: 4},
+		},
+		{
+			name:     "max_bytes",
+			params:   protocol.Params{Duration: time.Second, Streams: 2},
+			maxBytes: 1000,
+			want:     protocol.Params{Duration: time.Second, Streams: 2, Bytes: 1000},
+		},
+		{
+			name:     "max_bytes_requested",
+			params:   protocol.Params{Duration: time.Second, Streams: 2, Bytes: 500},
+			maxBytes: 1000,
+			want:     protocol.Params{Duration: time.Second, Streams: 2, Bytes: 500},
+		},
+		{
+			name:     "max_bytes_udp",
+			params:   protocol.Params{Duration: 500 * time.Millisecond, UDP: true},
+			maxBytes: 1000,
+			want: protocol.Params{
+				Duration:   500 * time.Millisecond,
+				Streams:    1,
+				UDP:        true,
+				Bitrate:    16000,
+				PacketSize: protocol.DefaultPacketSize,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			negotiate(&tc.params, time.Second, tc.maxBytes, protocol.DefaultMaxBitrate)
+			if tc.params != tc.want {
+				t.Errorf("want %+v, got %+v", tc.want, tc.params)
+			}
+		})
+	}
+}
+
+func TestSession_Datagram(t *testing.T) {
+	var (
+		ss       = &session{id: 1, ip: net.IPv4(127, 0, 0, 1)}
+		addr     = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+		other    = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5000}
+		register = make(chan *net.UDPAddr, 1)
+		counter  = protocol.NewDatagramCounter(0, 0)
+		now      = time.Now()
+	)
+
+	// nothing is expected
+	ss.datagram(&protocol.Datagram{Session: 1}, 24, addr, now)
+
+	ss.expect(register, nil)
+	ss.datagram(&protocol.Datagram{Session: 1}, 24, other, now)
+	select {
+	case <-register:
+		t.Error("registration from other IP address")
+	default:
+	}
+
+	ss.datagram(&protocol.Datagram{Session: 1}, 24, addr, now)
+	if got := <-register; got != addr {
+		t.Errorf("want %v, got %v", addr, got)
+	}
+
+	ss.expect(nil, counter)
+	ss.datagram(&protocol.Datagram{Session: 1, Seq: 1, Time: now}, 100, addr, now)
+	ss.datagram(&protocol.Datagram{Session: 1, Seq: 2, Time: now}, 100, other, now)
+	ss.expect(nil, nil)
+	ss.datagram(&protocol.Datagram{Session: 1, Seq: 3, Time: now}, 100, addr, now)
+
+	if r := counter.Report(3); r.Received != 1 || r.Lost != 2 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/protocol"
+)
+
+// ErrUDPRegister is returned when the client's registration datagram was not received in time.
+var ErrUDPRegister = errors.New("udp registration timeout")
+
+// serveUDP reads datagrams and passes them to their sessions until the UDP connection is closed.
+func (s *Server) serveUDP() {
+	buf := make([]byte, protocol.MaxDatagramSize)
+
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			slog.Debug("udp", "read_error", err)
+			continue
+		}
+
+		d, err := protocol.DecodeDatagram(buf[:n])
+		if err != nil {
+			slog.Debug("udp", "address", addr, "error", err)
+			continue
+		}
+
+		if ss := s.sessions.get(d.Session); ss != nil {
+			ss.datagram(d, n, addr, time.Now())
+		}
+	}
+}
+
+// flow handles the client's request of UDP flow in the session.
+func (s *Server) flow(ss *session, pc *protocol.Conn, t protocol.Type, payload []byte) error {
+	if t != protocol.TypeFlow || !ss.params.UDP {
+		err := errors.Join(protocol.ErrUnexpectedFrame, fmt.Errorf("got %s in session %d", t, ss.id))
+		return errors.Join(err, pc.WriteError(protocol.CodeParams, err.Error()))
+	}
+
+	flow := &protocol.Flow{}
+	if err := json.Unmarshal(payload, flow); err != nil {
+		return fmt.Errorf("decode %s message: %w", t, err)
+	}
+
+	if !ss.params.Allowed(flow.Download) {
+		action := "upload"
+		if flow.Download {
+			action = "download"
+		}
+		return reject(pc, ErrForbidden, protocol.CodeForbidden, fmt.Errorf("udp %s is not allowed", action))
+	}
+
+	slog.Info("flow", "session", ss.id, "client", ss.clientID, "download", flow.Download)
+
+	if flow.Download {
+		return s.udpDownload(ss, pc)
+	}
+
+	return s.udpUpload(ss, pc)
+}
+
+// udpDownload waits the client's registration datagram and sends datagrams to its address.
+func (s *Server) udpDownload(ss *session, pc *protocol.Conn) error {
+	var (
+		addr     *net.UDPAddr
+		register = make(chan *net.UDPAddr, 1)
+	)
+
+	ss.expect(register, nil)
+	select {
+	case addr = <-register:
+	case <-time.After(s.Timeout):
+	}
+	ss.expect(nil, nil)
+
+	if addr == nil {
+		return errors.Join(ErrUDPRegister, pc.WriteError(protocol.CodeParams, ErrUDPRegister.Error()))
+	}
+
+	if err := pc.WriteMessage(protocol.TypeStart, &protocol.Start{Time: time.Now()}); err != nil {
+		return err
+	}
+
+	report, err := pc.SendFlow(ss.ctx, func(b []byte) error {
+		_, e := s.udp.WriteToUDP(b, addr)
+		return e
+	}, &ss.params)
+
+	s.udpTransferred(ss, "download", report, err)
+	if err != nil {
+		return errors.Join(ErrDataWriteRead, fmt.Errorf("udp download: %w", err))
+	}
+
+	return nil
+}
+
+// udpUpload counts the client's datagrams until its end message and replies with a report,
+// the flow is aborted if the client sends more than its bitrate allows.
+func (s *Server) udpUpload(ss *session, pc *protocol.Conn) error {
+	counter := protocol.NewDatagramCounter(ss.params.FlowDatagrams(), ss.params.FlowBytes())
+
+	ss.expect(nil, counter)
+	defer ss.expect(nil, nil)
+
+	if err := pc.WriteMessage(protocol.TypeStart, &protocol.Start{Time: time.Now()}); err != nil {
+		return err
+	}
+
+	report, err := pc.ReceiveFlow(counter)
+
+	s.udpTransferred(ss, "upload", report, err)
+	if err != nil {
+		return errors.Join(ErrDataWriteRead, fmt.Errorf("udp upload: %w", err))
+	}
+
+	return nil
+}
+
+// udpTransferred logs and counts the finished UDP flow, the report can be nil if the flow failed.
+func (s *Server) udpTransferred(ss *session, action string, report *common.UDPReport, err error) {
+	if report == nil {
+		ss.transferred(action, nil, nil, err)
+		return
+	}
+
+	ss.transferred(action, &report.Report, report, err)
+	s.metrics.transfer(action, ss.clientID, report.Count)
+
+	attrs := []any{
+		"session", ss.id, "client", ss.clientID,
+		"count", common.ByteSize(report.Count), "speed", report.Speed(), "sent", report.Sent,
+		"lost", report.Lost, "out_of_order", report.OutOfOrder, "duplicates", report.Duplicates,
+		"jitter", report.Jitter,
+	}
+
+	if err != nil {
+		slog.Warn("udp "+action, append(attrs, "partial", true)...)
+		return
+	}
+
+	slog.Info("udp "+action, attrs...)
+}
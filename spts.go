@@ -8,11 +8,14 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/z0rr0/spts/client"
 	"github.com/z0rr0/spts/common"
+	"github.com/z0rr0/spts/exporter"
+	"github.com/z0rr0/spts/protocol"
 	"github.com/z0rr0/spts/server"
 )
 
@@ -33,11 +36,53 @@ func main() {
 		debug      bool
 		version    bool
 		dot        bool
+		udp        bool
 
-		port    uint16 = 28082
-		host           = "localhost"
-		timeout        = 3 * time.Second
-		clients        = 1
+		port     uint16 = 28082
+		host            = "localhost"
+		timeout         = 3 * time.Second
+		duration        = 3 * time.Second
+		size     uint64
+		clients  = 1
+		streams  = 1
+
+		bitrate    uint64 = protocol.DefaultBitrate
+		maxBitrate uint64 = protocol.DefaultMaxBitrate
+		packetSize        = protocol.DefaultPacketSize
+
+		format  = client.FormatText
+		output  string
+		metrics string
+		admin   string
+		audit   string
+
+		exporterAddr string
+		onScrape     bool
+		interval     = 5 * time.Minute
+
+		useTLS         bool
+		tlsCert        string
+		tlsKey         string
+		tlsFingerprint string
+		tlsClientCA    string
+		rejectLegacy   bool
+		strictAuth     bool
+		tokensFile     string
+		authURL        string
+		anonymous      bool
+
+		anonymousDuration time.Duration
+		anonymousBytes    uint64
+		anonymousSessions = 1
+
+		ipRate        int
+		ipConnections int
+		banFailures   int
+		banDuration   = 15 * time.Minute
+
+		allow      []string
+		deny       []string
+		accessFile string
 	)
 
 	defer func() {
@@ -47,12 +92,81 @@ func main() {
 	}()
 
 	flag.BoolVar(&serverMode, "server", serverMode, "run in server mode")
-	flag.DurationVar(&timeout, "timeout", timeout, "timeout for requests")
+	flag.DurationVar(&timeout, "timeout", timeout, "connection and handshake timeout")
+	flag.DurationVar(&duration, "duration", duration, "test duration for every direction (max allowed one for server mode)")
 	flag.StringVar(&host, "host", host, "host to listen on for server mode or connect to for client mode")
 	flag.BoolVar(&version, "version", version, "print version and exit")
 	flag.BoolVar(&debug, "debug", debug, "enable debug mode")
 	flag.BoolVar(&dot, "dot", dot, "show dot progress output (for client mode)")
 	flag.IntVar(&clients, "clients", clients, "max clients (for server mode)")
+	flag.IntVar(&streams, "streams", streams, "parallel TCP streams for each direction (for client mode)")
+	flag.Func("bytes", "data size limit for every direction, e.g. 500MB (for client mode)", func(s string) error {
+		v, err := common.ParseSize(s)
+		if err != nil {
+			return err
+		}
+		size = v
+		return nil
+	})
+	flag.BoolVar(&udp, "udp", udp, "UDP test mode instead of TCP streams (for client mode)")
+	flag.IntVar(&packetSize, "packet-size", packetSize, "UDP datagram size in bytes (for client mode)")
+	flag.Func("bitrate", "UDP target bitrate in bits/s, e.g. 100M (for client mode, default 10M)", func(s string) error {
+		v, err := common.ParseBitrate(s)
+		if err != nil {
+			return err
+		}
+		bitrate = v
+		return nil
+	})
+	flag.Func("max-bitrate", "max UDP bitrate of clients in bits/s, e.g. 1G (for server mode, default 100M)", func(s string) error {
+		v, err := common.ParseBitrate(s)
+		if err != nil {
+			return err
+		}
+		maxBitrate = v
+		return nil
+	})
+	flag.StringVar(&format, "format", format, "result output format: text, json, csv or influx (for client mode)")
+	flag.StringVar(&output, "output", output, "file to append results to instead of stdout (for client mode)")
+	flag.StringVar(&metrics, "metrics", metrics, "HTTP address of Prometheus metrics, e.g. :9090 (for server mode)")
+	flag.StringVar(&admin, "admin", admin, "HTTP address of bans management for loopback clients, e.g. 127.0.0.1:9091 (for server mode)")
+	flag.StringVar(&audit, "audit", audit, "file to append JSON records of finished sessions to (for server mode)")
+	flag.StringVar(&exporterAddr, "exporter", exporterAddr, "run in exporter mode with Prometheus metrics on HTTP address, e.g. :9469")
+	flag.DurationVar(&interval, "interval", interval, "tests interval (minimum one for -on-scrape) in exporter mode")
+	flag.BoolVar(&onScrape, "on-scrape", onScrape, "run tests on metrics scrape instead of schedule in exporter mode")
+	flag.BoolVar(&useTLS, "tls", useTLS, "use TLS transport")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "TLS certificate file, server generates a self-signed one if it's empty, client authenticates by it")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "TLS private key file of the certificate")
+	flag.StringVar(&tlsFingerprint, "tls-fingerprint", tlsFingerprint, "pinned SHA-256 fingerprint of server's certificate, it enables TLS (for client mode)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", tlsClientCA, "CA certificates file to authenticate clients by their TLS certificates, it enables TLS (for server mode)")
+	flag.BoolVar(&rejectLegacy, "reject-legacy-tokens", rejectLegacy, "reject clients with legacy auth tokens (for server mode)")
+	flag.BoolVar(&strictAuth, "strict-auth", strictAuth, "require the server to prove the shared secret by challenge-response before any test data (for client mode)")
+	flag.StringVar(&tokensFile, "tokens-file", tokensFile, "file of clients' tokens, one \"clientID:secret\" per line, reloaded by SIGHUP (for server mode)")
+	flag.StringVar(&authURL, "auth-url", authURL, "HTTP auth service URL to get clients' secrets (for server mode)")
+	flag.BoolVar(&anonymous, "anonymous", anonymous, "allow anonymous clients without tokens (for server mode)")
+	flag.DurationVar(&anonymousDuration, "anonymous-duration", anonymousDuration, "max test duration of anonymous clients, 0 - server's one (for server mode)")
+	flag.Func("anonymous-bytes", "max data size of every direction for anonymous clients, e.g. 100MB (for server mode)", func(s string) error {
+		v, err := common.ParseSize(s)
+		if err != nil {
+			return err
+		}
+		anonymousBytes = v
+		return nil
+	})
+	flag.IntVar(&anonymousSessions, "anonymous-sessions", anonymousSessions, "max concurrent sessions of anonymous clients (for server mode)")
+	flag.IntVar(&ipRate, "ip-rate", ipRate, "max new connections per minute from one IP address, 0 - not limited (for server mode)")
+	flag.IntVar(&ipConnections, "ip-connections", ipConnections, "max concurrent connections from one IP address, 0 - not limited (for server mode)")
+	flag.IntVar(&banFailures, "ban-failures", banFailures, "failed handshakes to ban IP address, 0 - no bans (for server mode)")
+	flag.DurationVar(&banDuration, "ban-duration", banDuration, "IP address ban duration and failed handshakes counting window (for server mode)")
+	flag.Func("allow", "comma-separated CIDR ranges of allowed clients, others are denied (for server mode)", func(s string) error {
+		allow = append(allow, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.Func("deny", "comma-separated CIDR ranges of denied clients (for server mode)", func(s string) error {
+		deny = append(deny, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.StringVar(&accessFile, "access-file", accessFile, "file of \"allow CIDR\" and \"deny CIDR\" rules, reloaded by SIGHUP (for server mode)")
 	flag.Func("port", "port to listen on"+fmt.Sprintf(" (integer in range 1..%d)", common.MaxPortNumber), func(s string) error {
 		if p, err := common.ParsePort(s); err != nil {
 			return err
@@ -71,11 +185,32 @@ func main() {
 		return
 	}
 
-	initLogger(debug)
+	if exporterAddr == "" {
+		// exporter options are rejected instead of silent ignoring by a single test
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "interval" || f.Name == "on-scrape" {
+				fmt.Fprintf(flag.CommandLine.Output(), "flag -%s requires -exporter\n", f.Name)
+				flag.Usage()
+				os.Exit(2)
+			}
+		})
+	}
+
+	// machine-readable result is printed to stdout, so logs don't mix with it
+	initLogger(debug, format != client.FormatText && output == "" && !serverMode)
 	slog.Debug(
 		"starting",
 		"version", Version, "revision", Revision, "go", GoVersion, "buildDate", BuildDate,
-		"serverMode", serverMode, "host", host, "port", port, "clients", clients, "timeout", timeout,
+		"serverMode", serverMode, "host", host, "port", port, "clients", clients, "streams", streams,
+		"timeout", timeout, "duration", duration, "bytes", size,
+		"udp", udp, "bitrate", bitrate, "maxBitrate", maxBitrate, "packetSize", packetSize, "format", format,
+		"output", output, "metrics", metrics, "admin", admin, "audit", audit, "exporter", exporterAddr, "interval", interval, "onScrape", onScrape,
+		"tls", useTLS, "tlsCert", tlsCert, "tlsKey", tlsKey, "tlsFingerprint", tlsFingerprint,
+		"tlsClientCA", tlsClientCA, "rejectLegacy", rejectLegacy, "strictAuth", strictAuth,
+		"tokensFile", tokensFile, "authURL", authURL, "anonymous", anonymous,
+		"anonymousDuration", anonymousDuration, "anonymousBytes", anonymousBytes, "anonymousSessions", anonymousSessions,
+		"ipRate", ipRate, "ipConnections", ipConnections, "banFailures", banFailures, "banDuration", banDuration,
+		"allow", allow, "deny", deny, "accessFile", accessFile,
 	)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -89,20 +224,73 @@ func main() {
 		cancel()
 	}()
 
-	params := &common.Params{Host: host, Port: port, Timeout: timeout, Clients: clients, Dot: dot}
+	params := &common.Params{
+		Host:       host,
+		Port:       port,
+		Timeout:    timeout,
+		Duration:   duration,
+		Bytes:      size,
+		Clients:    clients,
+		Streams:    streams,
+		Dot:        dot,
+		UDP:        udp,
+		Bitrate:    bitrate,
+		PacketSize: packetSize,
+		MaxBitrate: maxBitrate,
+		Format:     format,
+		Output:     output,
+		Metrics:    metrics,
+		Admin:      admin,
+		Audit:      audit,
+		Exporter:   exporterAddr,
+		Interval:   interval,
+		OnScrape:   onScrape,
+
+		TLS:            useTLS,
+		TLSCert:        tlsCert,
+		TLSKey:         tlsKey,
+		TLSFingerprint: tlsFingerprint,
+		TLSClientCA:    tlsClientCA,
+		RejectLegacy:   rejectLegacy,
+		StrictAuth:     strictAuth,
+		TokensFile:     tokensFile,
+		AuthURL:        authURL,
+		Anonymous:      anonymous,
+
+		AnonymousDuration: anonymousDuration,
+		AnonymousBytes:    anonymousBytes,
+		AnonymousSessions: anonymousSessions,
+
+		IPRate:        ipRate,
+		IPConnections: ipConnections,
+		BanFailures:   banFailures,
+		BanDuration:   banDuration,
+
+		Allow:      allow,
+		Deny:       deny,
+		AccessFile: accessFile,
+	}
 	if err := start(ctx, serverMode, params); err != nil {
 		slog.Error("processing", "error", err)
 		os.Exit(1)
 	}
 }
 
-func initLogger(debug bool) {
-	var level = slog.LevelInfo
+func initLogger(debug, stderr bool) {
+	var (
+		level = slog.LevelInfo
+		w     = os.Stdout
+	)
+
 	if debug {
 		level = slog.LevelDebug
 	}
 
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+	if stderr {
+		w = os.Stderr
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
 }
 
 func start(ctx context.Context, serverMode bool, params *common.Params) error {
@@ -111,9 +299,12 @@ func start(ctx context.Context, serverMode bool, params *common.Params) error {
 		err error
 	)
 
-	if serverMode {
+	switch {
+	case serverMode:
 		s, err = server.New(params)
-	} else {
+	case params.Exporter != "":
+		s, err = exporter.New(params)
+	default:
 		s, err = client.New(params)
 	}
 
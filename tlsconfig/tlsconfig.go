@@ -0,0 +1,179 @@
+// Package tlsconfig provides TLS configurations of the optional encrypted transport.
+//
+// The server uses a configured certificate or generates a self-signed one on start,
+// the client verifies the server's certificate by system roots or by a pinned SHA-256 fingerprint.
+// Optionally, the server verifies clients' certificates by configured CA (mutual TLS).
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// certValidity is a validity period of the generated certificate.
+const certValidity = 365 * 24 * time.Hour
+
+var (
+	// ErrFingerprint is returned when the server's certificate doesn't match the pinned fingerprint.
+	ErrFingerprint = errors.New("certificate fingerprint mismatch")
+
+	// ErrCertificate is returned for invalid certificate configuration.
+	ErrCertificate = errors.New("invalid certificate")
+)
+
+// Fingerprint returns SHA-256 fingerprint of DER encoded certificate as colon separated hex string.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// ParseFingerprint decodes hex fingerprint, colons and case are ignored.
+func ParseFingerprint(s string) ([]byte, error) {
+	value, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, errors.Join(ErrFingerprint, fmt.Errorf("decode: %w", err))
+	}
+
+	if n := len(value); n != sha256.Size {
+		return nil, errors.Join(ErrFingerprint, fmt.Errorf("invalid length %d", n))
+	}
+
+	return value, nil
+}
+
+// Server returns server's TLS configuration with the certificate from files
+// or with a generated self-signed one if both file names are empty.
+// It also returns the certificate fingerprint for clients pinning.
+func Server(certFile, keyFile string) (*tls.Config, string, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+
+	if certFile == "" && keyFile == "" {
+		cert, err = SelfSigned()
+	} else {
+		cert, err = Certificate(certFile, keyFile)
+	}
+
+	if err != nil {
+		return nil, "", errors.Join(ErrCertificate, err)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return cfg, Fingerprint(cert.Certificate[0]), nil
+}
+
+// Certificate loads the certificate and its private key from PEM files.
+func Certificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errors.Join(ErrCertificate, errors.New("both certificate and key files are required"))
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, errors.Join(ErrCertificate, err)
+	}
+
+	return cert, nil
+}
+
+// WithClientCA enables verification of clients' certificates by CA certificates from PEM file.
+// Clients without certificates are still accepted, so they can be authorized by other methods.
+func WithClientCA(cfg *tls.Config, caFile string) error {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return errors.Join(ErrCertificate, fmt.Errorf("read client CA: %w", err))
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.Join(ErrCertificate, fmt.Errorf("no client CA certificates in %s", caFile))
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// Client returns client's TLS configuration for the server name.
+// If the fingerprint is not empty, the server's certificate is verified only by it (self-signed ones are allowed),
+// otherwise system roots are used.
+func Client(serverName, fingerprint string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if fingerprint == "" {
+		return cfg, nil
+	}
+
+	pinned, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	// the default verification is replaced by the fingerprint check
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.Join(ErrFingerprint, errors.New("no server certificate"))
+		}
+
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pinned) {
+			return errors.Join(ErrFingerprint, fmt.Errorf("got %s", Fingerprint(cs.PeerCertificates[0].Raw)))
+		}
+
+		return nil
+	}
+
+	return cfg, nil
+}
+
+// SelfSigned generates a new self-signed ECDSA certificate.
+func SelfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "spts"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,228 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	fingerprint := Fingerprint([]byte("certificate"))
+
+	testCases := []struct {
+		name    string
+		value   string
+		withErr bool
+	}{
+		{name: "colons", value: fingerprint},
+		{name: "lower", value: strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))},
+		{name: "short", value: fingerprint[:10], withErr: true},
+		{name: "invalid", value: "XYZ", withErr: true},
+		{name: "empty", withErr: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ParseFingerprint(tc.value)
+			if tc.withErr {
+				if !errors.Is(err, ErrFingerprint) {
+					t.Errorf("want %v, got %v", ErrFingerprint, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if Fingerprint([]byte("certificate")) != fingerprint || len(value) != 32 {
+				t.Errorf("unexpected value: %x", value)
+			}
+		})
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to PEM files.
+func writeCertificate(t *testing.T) (string, string, string) {
+	cert, err := SelfSigned()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+	)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err = os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err = os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	return certFile, keyFile, Fingerprint(cert.Certificate[0])
+}
+
+func TestServer(t *testing.T) {
+	certFile, keyFile, fingerprint := writeCertificate(t)
+
+	testCases := []struct {
+		name        string
+		certFile    string
+		keyFile     string
+		fingerprint string
+		withErr     bool
+	}{
+		{name: "self_signed"},
+		{name: "files", certFile: certFile, keyFile: keyFile, fingerprint: fingerprint},
+		{name: "no_key", certFile: certFile, withErr: true},
+		{name: "invalid_files", certFile: keyFile, keyFile: certFile, withErr: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fp, err := Server(tc.certFile, tc.keyFile)
+			if tc.withErr {
+				if !errors.Is(err, ErrCertificate) {
+					t.Errorf("want %v, got %v", ErrCertificate, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(cfg.Certificates) != 1 || fp != Fingerprint(cfg.Certificates[0].Certificate[0]) {
+				t.Errorf("unexpected configuration, fingerprint %s", fp)
+			}
+
+			if tc.fingerprint != "" && fp != tc.fingerprint {
+				t.Errorf("want %s, got %s", tc.fingerprint, fp)
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	serverConfig, fingerprint, err := Server("", "")
+	if err != nil {
+		t.Fatalf("failed to create server config: %v", err)
+	}
+
+	other, err := SelfSigned()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		fingerprint string
+		err         error
+	}{
+		{name: "pinned", fingerprint: fingerprint},
+		{name: "mismatch", fingerprint: Fingerprint(other.Certificate[0]), err: ErrFingerprint},
+		{name: "system_roots", err: &tls.CertificateVerificationError{}},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig, e := Client("localhost", tc.fingerprint)
+			if e != nil {
+				t.Fatalf("failed to create client config: %v", e)
+			}
+
+			listener, e := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+			if e != nil {
+				t.Fatalf("failed to listen: %v", e)
+			}
+			defer func() { _ = listener.Close() }()
+
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					_ = conn.(*tls.Conn).Handshake()
+					_ = conn.Close()
+				}
+			}()
+
+			conn, e := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+			if e == nil {
+				_ = conn.Close()
+			}
+
+			switch target := tc.err.(type) {
+			case nil:
+				if e != nil {
+					t.Errorf("unexpected error: %v", e)
+				}
+			case *tls.CertificateVerificationError:
+				if !errors.As(e, &target) {
+					t.Errorf("want verification error, got %v", e)
+				}
+			default:
+				if !errors.Is(e, tc.err) {
+					t.Errorf("want %v, got %v", tc.err, e)
+				}
+			}
+		})
+	}
+
+	if _, err = Client("localhost", "invalid"); !errors.Is(err, ErrFingerprint) {
+		t.Errorf("want %v, got %v", ErrFingerprint, err)
+	}
+}
+
+func TestWithClientCA(t *testing.T) {
+	certFile, keyFile, _ := writeCertificate(t)
+
+	testCases := []struct {
+		name    string
+		caFile  string
+		withErr bool
+	}{
+		{name: "valid", caFile: certFile},
+		{name: "no_certificates", caFile: keyFile, withErr: true},
+		{name: "not_found", caFile: filepath.Join(t.TempDir(), "ca.pem"), withErr: true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &tls.Config{}
+
+			err := WithClientCA(cfg, tc.caFile)
+			if tc.withErr {
+				if !errors.Is(err, ErrCertificate) {
+					t.Errorf("want %v, got %v", ErrCertificate, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if cfg.ClientCAs == nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+				t.Errorf("unexpected configuration: %v, %v", cfg.ClientCAs, cfg.ClientAuth)
+			}
+		})
+	}
+}